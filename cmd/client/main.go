@@ -1,9 +1,253 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/certs"
+	"github.com/preegnees/gobox/internal/wire"
+	cl "github.com/preegnees/gobox/pkg/client/client"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/client/supervisor"
+)
+
+// Коды завершения
+const (
+	EXIT_OK           = 0 // остановлен сигналом или завершился штатно
+	EXIT_ERROR        = 1 // клиент остановлен из-за ошибки
+	EXIT_USAGE        = 2 // неверные аргументы
+	EXIT_REJECTED     = 3 // сервер отказал в подключении
+	EXIT_UNAUTHORIZED = 4 // токен устройства неизвестен серверу или отозван
 )
 
+const VERSION = "0.1.0"
+
+const USAGE = `usage: gobox <command> [arguments]
+
+commands:
+  sync <dir> [flags]   sync folder with server
+  version              print version
+  help                 print this help
+`
+
 func main() {
-	fmt.Println("ClientDataTransfer")
-}
\ No newline at end of file
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, USAGE)
+		return EXIT_USAGE
+	}
+
+	switch args[0] {
+	case "sync":
+		return runSync(args[1:], stderr)
+	case "version":
+		fmt.Fprintln(stdout, "gobox", VERSION)
+		return EXIT_OK
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, USAGE)
+		return EXIT_OK
+	default:
+		fmt.Fprintf(stderr, "unknown command: %s\n\n%s", args[0], USAGE)
+		return EXIT_USAGE
+	}
+}
+
+// runSync. Синхронизирует папку с сервером до сигнала SIGINT/SIGTERM
+func runSync(args []string, stderr io.Writer) int {
+
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", "localhost:7070", "server address")
+	token := fs.String("token", os.Getenv("GOBOX_TOKEN"), "device token issued by gobox-server device add")
+	root := fs.String("root", cl.ROOT, "sync root id on server")
+	useTLS := fs.Bool("tls", false, "connect over TLS 1.3, implied by other -tls-* flags")
+	tlsCA := fs.String("tls-ca", "", "CA file to verify server (default: system roots)")
+	tlsCert := fs.String("tls-cert", "", "device certificate file for mTLS")
+	tlsKey := fs.String("tls-key", "", "device key file for mTLS")
+	serverName := fs.String("tls-server-name", "", "server name in its certificate, if it differs from address")
+	dialTimeout := fs.Duration("dial-timeout", cl.DIAL_TIMEOUT, "dial timeout")
+	maxBackoff := fs.Duration("max-backoff", cl.MAX_BACKOFF, "max delay between reconnects")
+	compression := fs.String("compression", strings.Join(wire.Compressions(), ","), "chunk compression in order of preference, none disables it")
+	hash := fs.String("hash", ut.HASH_SHA256, "preferred file hash algorithm, the server may choose another one: "+strings.Join(ut.Hashers(), ", "))
+	debug := fs.Bool("debug", false, "debug logs")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: gobox sync <dir> [flags]")
+		fs.PrintDefaults()
+	}
+
+	// папка может стоять как до флагов, так и после них
+	dir := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		dir, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	if dir == "" {
+		dir = fs.Arg(0)
+	}
+	if dir == "" {
+		fs.Usage()
+		return EXIT_USAGE
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(stderr, "-tls-cert and -tls-key go together")
+		return EXIT_USAGE
+	}
+	hasher, err := ut.NewHasher(*hash)
+	if err != nil {
+		fmt.Fprintf(stderr, "unknown -hash: %s\n", *hash)
+		return EXIT_USAGE
+	}
+
+	// предпочтительный алгоритм первым, остальные - на случай, если сервер его не поддерживает
+	hashes := []string{hasher.Name()}
+	for _, name := range ut.Hashers() {
+		if name != hasher.Name() {
+			hashes = append(hashes, name)
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+	if *debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	var tlsConf *tls.Config
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *serverName != "" {
+		var err error
+		tlsConf, err = certs.ClientConfig(certs.ConfClientTLS{CA: *tlsCA, Cert: *tlsCert, Key: *tlsKey, ServerName: *serverName})
+		if err != nil {
+			logger.Error(err)
+			return EXIT_ERROR
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// клиент создается раньше супервизора, поэтому о переподключении он сообщает через канал
+	reconnected := make(chan struct{}, 1)
+
+	client, err := cl.New(cl.ConfClient{
+		Ctx:          ctx,
+		Log:          logger,
+		Dir:          dir,
+		Addr:         *server,
+		TLS:          tlsConf,
+		Token:        *token,
+		Root:         *root,
+		Hashes:       hashes,
+		Compressions: strings.Split(*compression, ","),
+		DialTimeout:  *dialTimeout,
+		MaxBackoff:   *maxBackoff,
+		OnReconnect: func() {
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if errors.Is(err, cl.ERROR__UNAUTHORIZED__) {
+		logger.Error(err)
+		fmt.Fprintln(stderr, "ask the server admin for a device token: gobox-server device add <name>")
+		return EXIT_UNAUTHORIZED
+	}
+	if errors.Is(err, cl.ERROR__REJECTED__) {
+		logger.Error(err)
+		return EXIT_REJECTED
+	}
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	// файлы хешируются алгоритмом, который выбрал сервер
+	if welcome, ok := client.Welcome(); ok {
+		if hasher, err = ut.NewHasher(welcome.Hash); err != nil {
+			logger.Error(err)
+			return EXIT_ERROR
+		}
+	}
+
+	sv, err := supervisor.New(supervisor.ConfSupervisor{
+		Ctx:     ctx,
+		Log:     logger,
+		Dir:     dir,
+		Client:  client,
+		Fetcher: client,
+		Changes: client.Changes(),
+		Hasher:  hasher,
+	})
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reconnected:
+				if welcome, ok := client.Welcome(); ok {
+					if h, err := ut.NewHasher(welcome.Hash); err == nil {
+						sv.SetHasher(h)
+					} else {
+						logger.Warn(fmt.Sprintf("[main.runSync()] welcome hash: %s, err: %v;", welcome.Hash, err))
+					}
+				}
+				sv.Upload()
+				sv.Resume()
+			}
+		}
+	}()
+
+	// клиент сам останавливается, например когда токен отозвали: супервизор останавливает пакеты
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-client.Done():
+			if err := client.Err(); err != nil {
+				sv.SendError(cl.IDENTIFIER, nil, err)
+			}
+		}
+	}()
+
+	logger.Info(fmt.Sprintf("[main.runSync()] sync dir: %s with server: %s;", dir, *server))
+
+	if err := sv.Run(); err != nil {
+		logger.Error(err)
+		if errors.Is(err, cl.ERROR__UNAUTHORIZED__) {
+			fmt.Fprintln(stderr, "ask the server admin for a device token: gobox-server device add <name>")
+			return EXIT_UNAUTHORIZED
+		}
+		return EXIT_ERROR
+	}
+
+	cancel()
+	<-client.Done()
+	logger.Info(fmt.Sprintf("[main.runSync()] stopped, backlog: %d;", client.Backlog()))
+
+	return EXIT_OK
+}
@@ -1,5 +1,374 @@
 package main
 
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/certs"
+	"github.com/preegnees/gobox/pkg/server/devices"
+	"github.com/preegnees/gobox/pkg/server/server"
+	"github.com/preegnees/gobox/pkg/server/storage"
+)
+
+// Коды завершения
+const (
+	EXIT_OK    = 0
+	EXIT_ERROR = 1
+	EXIT_USAGE = 2
+)
+
+const USAGE = `usage: gobox-server [command] [arguments]
+
+commands:
+  serve [flags]                 run server (default)
+  init-ca [flags]               create local CA and server certificate for TLS
+  device add <name> [flags]     register device and print its token,
+                                with -ca also issue and pin its TLS certificate
+  device list [flags]           list devices
+  device revoke <id|name> [flags]
+                                revoke device token
+  gc [flags]                    remove chunks no file refers to,
+                                safe while the server is running
+  help                          print this help
+`
+
 func main() {
-	println("ServerDataTransfer")
-}
\ No newline at end of file
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+
+	// без команды - serve, как и раньше: gobox-server -addr :7070
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args, stderr)
+	}
+
+	switch args[0] {
+	case "serve":
+		return runServe(args[1:], stderr)
+	case "init-ca":
+		return runInitCA(args[1:], stdout, stderr)
+	case "device":
+		return runDevice(args[1:], stdout, stderr)
+	case "gc":
+		return runGC(args[1:], stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, USAGE)
+		return EXIT_OK
+	default:
+		fmt.Fprintf(stderr, "unknown command: %s\n\n%s", args[0], USAGE)
+		return EXIT_USAGE
+	}
+}
+
+// runServe. Запускает сервер до сигнала SIGINT/SIGTERM
+func runServe(args []string, stderr io.Writer) int {
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", ":7070", "listen address")
+	dir := fs.String("dir", "gobox-storage", "storage root")
+	root := fs.String("root", server.ROOT, "sync root id served by this server")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file, enables TLS 1.3")
+	tlsKey := fs.String("tls-key", "", "TLS key file")
+	clientCA := fs.String("tls-client-ca", "", "CA file for device certificates, enables mTLS")
+	debug := fs.Bool("debug", false, "debug logs")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	if (*tlsCert == "") != (*tlsKey == "") || (*clientCA != "" && *tlsCert == "") {
+		fmt.Fprintln(stderr, "-tls-cert and -tls-key go together, -tls-client-ca needs them")
+		return EXIT_USAGE
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+	if *debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	st, err := storage.New(storage.ConfStorage{Log: logger, Dir: *dir})
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+	defer st.Close()
+
+	reg, err := devices.New(devices.ConfDevices{Log: logger, Dir: *dir})
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	list, err := reg.List()
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+	if len(list) == 0 {
+		logger.Warn("[main.runServe()] no devices registered, add one with: gobox-server device add <name>;")
+	}
+
+	// без mTLS сервер не видит сертификатов, и устройства с закрепленным сертификатом никогда не подключатся
+	if *clientCA == "" {
+		pinned := []string{}
+		for _, d := range list {
+			if d.Cert != "" && d.Revoked == 0 {
+				pinned = append(pinned, d.Name)
+			}
+		}
+		if len(pinned) > 0 {
+			fmt.Fprintf(stderr, "pinned device certificates need mTLS, add -tls-client-ca; devices: %s\n", strings.Join(pinned, ", "))
+			return EXIT_USAGE
+		}
+	}
+
+	var tlsConf *tls.Config
+	if *tlsCert != "" {
+		tlsConf, err = certs.ServerConfig(certs.ConfServerTLS{Cert: *tlsCert, Key: *tlsKey, ClientCA: *clientCA})
+		if err != nil {
+			logger.Error(err)
+			return EXIT_ERROR
+		}
+	} else {
+		logger.Warn("[main.runServe()] TLS is off, data goes in cleartext;")
+	}
+
+	srv, err := server.New(server.ConfServer{
+		Ctx:     ctx,
+		Log:     logger,
+		Addr:    *addr,
+		TLS:     tlsConf,
+		Devices: reg,
+		Root:    *root,
+		Storage: st,
+	})
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	if err := srv.Serve(); err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	return EXIT_OK
+}
+
+// runDevice. Управление токенами устройств. Работает с файлом реестра напрямую,
+// запущенный сервер подхватывает изменения сам
+func runDevice(args []string, stdout, stderr io.Writer) int {
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, USAGE)
+		return EXIT_USAGE
+	}
+	cmd, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("device "+cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", "gobox-storage", "storage root")
+	caDir := fs.String("ca", "", "add: CA dir from init-ca, issue and pin device TLS certificate")
+	out := fs.String("out", ".", "add: where to write device certificate and key")
+	cert := fs.String("cert", "", "add: pin existing device certificate file")
+
+	// аргумент может стоять как до флагов, так и после них
+	arg := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		arg, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	if arg == "" {
+		arg = fs.Arg(0)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+
+	reg, err := devices.New(devices.ConfDevices{Log: logger, Dir: *dir})
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	switch cmd {
+	case "add":
+		if arg == "" {
+			fmt.Fprintln(stderr, "usage: gobox-server device add <name> [-dir dir]")
+			return EXIT_USAGE
+		}
+		if *caDir != "" && *cert != "" {
+			fmt.Fprintln(stderr, "use either -ca or -cert")
+			return EXIT_USAGE
+		}
+		d, token, err := reg.Add(arg)
+		if err != nil {
+			logger.Error(err)
+			return EXIT_ERROR
+		}
+		if code := pinCert(reg, d, *caDir, *out, *cert, stderr, logger); code != EXIT_OK {
+			return code
+		}
+		fmt.Fprintf(stderr, "device %s (%s) added, the token is shown only once:\n", d.Name, d.ID)
+		fmt.Fprintln(stdout, token)
+		return EXIT_OK
+
+	case "list":
+		list, err := reg.List()
+		if err != nil {
+			logger.Error(err)
+			return EXIT_ERROR
+		}
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tCERT\tCREATED\tREVOKED")
+		for _, d := range list {
+			cert := "-"
+			if len(d.Cert) > 16 {
+				cert = d.Cert[:16]
+			} else if d.Cert != "" {
+				cert = d.Cert
+			}
+			revoked := "-"
+			if d.Revoked != 0 {
+				revoked = time.Unix(d.Revoked, 0).Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, cert, time.Unix(d.Created, 0).Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+		return EXIT_OK
+
+	case "revoke":
+		if arg == "" {
+			fmt.Fprintln(stderr, "usage: gobox-server device revoke <id|name> [-dir dir]")
+			return EXIT_USAGE
+		}
+		d, err := reg.Revoke(arg)
+		if errors.Is(err, devices.ERROR__UNKNOWN_DEVICE__) {
+			fmt.Fprintf(stderr, "unknown device: %s\n", arg)
+			return EXIT_ERROR
+		}
+		if err != nil {
+			logger.Error(err)
+			return EXIT_ERROR
+		}
+		fmt.Fprintf(stdout, "device %s (%s) revoked\n", d.Name, d.ID)
+		return EXIT_OK
+
+	default:
+		fmt.Fprintf(stderr, "unknown device command: %s\n\n%s", cmd, USAGE)
+		return EXIT_USAGE
+	}
+}
+
+// pinCert. Выпускает сертификат устройства (caDir) или берет готовый (cert) и закрепляет его за устройством.
+// Без сертификата устройство остается незакрепленным
+func pinCert(reg *devices.Registry, d devices.Device, caDir, out, cert string, stderr io.Writer, logger *logrus.Logger) int {
+
+	if caDir == "" && cert == "" {
+		return EXIT_OK
+	}
+
+	var fp string
+	var err error
+	if caDir != "" {
+		cert, fp, err = certs.Issue(caDir, d.ID, out)
+	} else {
+		fp, err = certs.FingerprintFile(cert)
+	}
+	if err == nil {
+		_, err = reg.Pin(d.ID, fp)
+	}
+	if err != nil {
+		logger.Error(err)
+		// устройство без обещанного сертификата не оставляем
+		reg.Revoke(d.ID)
+		return EXIT_ERROR
+	}
+
+	fmt.Fprintf(stderr, "device certificate: %s, pinned: %s\n", cert, fp)
+
+	return EXIT_OK
+}
+
+// runGC. Удаляет куски без ссылок. Работает с хранилищем напрямую, сервер можно не останавливать
+func runGC(args []string, stdout, stderr io.Writer) int {
+
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", "gobox-storage", "storage root")
+	grace := fs.Duration("grace", storage.GRACE, "keep chunks used more recently than this")
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	debug := fs.Bool("debug", false, "debug logs")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+	if *debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	report, err := storage.GC(storage.ConfGC{Log: logger, Dir: *dir, Grace: *grace, DryRun: *dryRun})
+	if err != nil {
+		logger.Error(err)
+		return EXIT_ERROR
+	}
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	fmt.Fprintf(stdout, "chunks: %d, referenced: %d, %s: %d (%d bytes)\n",
+		report.Chunks, report.Referenced, verb, report.Removed, report.Freed)
+
+	return EXIT_OK
+}
+
+// runInitCA. Создает локальный CA и сертификат сервера для небольшой установки
+func runInitCA(args []string, stdout, stderr io.Writer) int {
+
+	fs := flag.NewFlagSet("init-ca", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", "gobox-ca", "where to write CA and server certificate")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "comma separated server names and IPs")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	err := certs.InitCA(*dir, strings.Split(*hosts, ","))
+	if errors.Is(err, certs.ERROR__EXISTS__) {
+		fmt.Fprintf(stderr, "CA already exists in %s\n", *dir)
+		return EXIT_ERROR
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return EXIT_ERROR
+	}
+
+	fmt.Fprintf(stdout, `CA created in %[1]s
+server:  gobox-server serve -tls-cert %[1]s/%[2]s -tls-key %[1]s/%[3]s -tls-client-ca %[1]s/%[4]s
+device:  gobox-server device add <name> -ca %[1]s
+client:  gobox sync <dir> -tls-ca %[1]s/%[4]s -tls-cert <id>.crt -tls-key <id>.key
+`, *dir, certs.SERVER_CERT, certs.SERVER_KEY, certs.CA_CERT)
+
+	return EXIT_OK
+}
@@ -4,7 +4,14 @@ go 1.19
 
 require (
 	github.com/fsnotify/fsnotify v1.6.0
+	github.com/klauspost/compress v1.16.7
 	github.com/sirupsen/logrus v1.9.0
+	github.com/zeebo/xxh3 v1.0.2
+	golang.org/x/text v0.14.0
+	lukechampine.com/blake3 v1.2.1
 )
 
-require golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+require (
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	golang.org/x/sys v0.5.0 // indirect
+)
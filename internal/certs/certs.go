@@ -0,0 +1,318 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Файлы, которые создает InitCA
+const (
+	CA_CERT     = "ca.crt"
+	CA_KEY      = "ca.key"
+	SERVER_CERT = "server.crt"
+	SERVER_KEY  = "server.key"
+)
+
+// Сроки действия сертификатов
+const (
+	CA_VALIDITY   = 10 * 365 * 24 * time.Hour
+	LEAF_VALIDITY = 2 * 365 * 24 * time.Hour
+)
+
+var (
+	ERROR__EXISTS__  = errors.New("err certificate authority already exists")
+	ERROR__NO_CERT__ = errors.New("err no certificate in file")
+)
+
+// ConfServerTLS. TLS сервера. ClientCA включает mTLS: клиент обязан предъявить сертификат, подписанный этим CA
+type ConfServerTLS struct {
+	Cert     string
+	Key      string
+	ClientCA string
+}
+
+// ConfClientTLS. TLS клиента. CA - корень для проверки сервера (пустой - системные корни),
+// Cert и Key - сертификат устройства для mTLS, ServerName - имя сервера, если оно отличается от адреса
+type ConfClientTLS struct {
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+}
+
+// ServerConfig. tls.Config сервера, только TLS 1.3
+func ServerConfig(cnf ConfServerTLS) (*tls.Config, error) {
+
+	pair, err := tls.LoadX509KeyPair(cnf.Cert, cnf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("[certs.ServerConfig()] (tls.LoadX509KeyPair) cert: %s, key: %s, err: %w;", cnf.Cert, cnf.Key, err)
+	}
+
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{pair},
+	}
+
+	if cnf.ClientCA != "" {
+		pool, err := loadPool(cnf.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// ClientConfig. tls.Config клиента, только TLS 1.3
+func ClientConfig(cnf ConfClientTLS) (*tls.Config, error) {
+
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: cnf.ServerName,
+	}
+
+	if cnf.CA != "" {
+		pool, err := loadPool(cnf.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+
+	if cnf.Cert != "" || cnf.Key != "" {
+		pair, err := tls.LoadX509KeyPair(cnf.Cert, cnf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("[certs.ClientConfig()] (tls.LoadX509KeyPair) cert: %s, key: %s, err: %w;", cnf.Cert, cnf.Key, err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+
+	return conf, nil
+}
+
+// Fingerprint. sha256 сертификата (DER) в hex, по нему сервер закрепляет сертификат за устройством
+func Fingerprint(cert *x509.Certificate) string {
+
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FingerprintFile. Fingerprint первого сертификата из PEM файла
+func FingerprintFile(file string) (string, error) {
+
+	cert, err := loadCert(file)
+	if err != nil {
+		return "", err
+	}
+
+	return Fingerprint(cert), nil
+}
+
+// InitCA. Создает в dir локальный CA и подписанный им сертификат сервера для hosts (имена и IP).
+// Существующий CA не перезаписывается
+func InitCA(dir string, hosts []string) error {
+
+	if _, err := os.Stat(filepath.Join(dir, CA_KEY)); err == nil {
+		return fmt.Errorf("[certs.InitCA()] dir: %s, werr: %w;", dir, ERROR__EXISTS__)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("[certs.InitCA()] (os.Stat) dir: %s, err: %w;", dir, err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("[certs.InitCA()] (os.MkdirAll) dir: %s, err: %w;", dir, err)
+	}
+
+	tmpl, err := template("gobox CA", CA_VALIDITY)
+	if err != nil {
+		return err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.MaxPathLenZero = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("[certs.InitCA()] (ecdsa.GenerateKey) err: %w;", err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("[certs.InitCA()] (x509.CreateCertificate) err: %w;", err)
+	}
+
+	if err := write(dir, CA_CERT, CA_KEY, der, key); err != nil {
+		return err
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("[certs.InitCA()] (x509.ParseCertificate) err: %w;", err)
+	}
+
+	return issue(ca, key, dir, SERVER_CERT, SERVER_KEY, "gobox server", hosts, x509.ExtKeyUsageServerAuth)
+}
+
+// Issue. Выпускает сертификат устройства name, подписанный CA из caDir, и кладет его в out как <name>.crt и <name>.key.
+// Возвращает путь к сертификату и его Fingerprint
+func Issue(caDir string, name string, out string) (string, string, error) {
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(caDir, CA_CERT), filepath.Join(caDir, CA_KEY))
+	if err != nil {
+		return "", "", fmt.Errorf("[certs.Issue()] (tls.LoadX509KeyPair) dir: %s, err: %w;", caDir, err)
+	}
+
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", "", fmt.Errorf("[certs.Issue()] (x509.ParseCertificate) err: %w;", err)
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", "", fmt.Errorf("[certs.Issue()] dir: %s, CA key is not ECDSA;", caDir)
+	}
+
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return "", "", fmt.Errorf("[certs.Issue()] (os.MkdirAll) dir: %s, err: %w;", out, err)
+	}
+
+	if err := issue(ca, key, out, name+".crt", name+".key", name, nil, x509.ExtKeyUsageClientAuth); err != nil {
+		return "", "", err
+	}
+
+	file := filepath.Join(out, name+".crt")
+	fp, err := FingerprintFile(file)
+	if err != nil {
+		return "", "", err
+	}
+
+	return file, fp, nil
+}
+
+// issue. Выпускает конечный сертификат, подписанный ca
+func issue(ca *x509.Certificate, caKey *ecdsa.PrivateKey, dir, certFile, keyFile, name string, hosts []string, usage x509.ExtKeyUsage) error {
+
+	tmpl, err := template(name, LEAF_VALIDITY)
+	if err != nil {
+		return err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("[certs.issue()] (ecdsa.GenerateKey) name: %s, err: %w;", name, err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("[certs.issue()] (x509.CreateCertificate) name: %s, err: %w;", name, err)
+	}
+
+	return write(dir, certFile, keyFile, der, key)
+}
+
+// template. Общие поля сертификата
+func template(name string, validity time.Duration) (*x509.Certificate, error) {
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("[certs.template()] (rand.Int) err: %w;", err)
+	}
+
+	now := time.Now()
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// write. Записывает сертификат и ключ в PEM. Ключ доступен только владельцу
+func write(dir, certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("[certs.write()] (x509.MarshalPKCS8PrivateKey) err: %w;", err)
+	}
+
+	certPath := filepath.Join(dir, certFile)
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("[certs.write()] (os.WriteFile) path: %s, err: %w;", certPath, err)
+	}
+
+	keyPath := filepath.Join(dir, keyFile)
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return fmt.Errorf("[certs.write()] (os.WriteFile) path: %s, err: %w;", keyPath, err)
+	}
+
+	return nil
+}
+
+// loadPool. Пул корневых сертификатов из PEM файла
+func loadPool(file string) (*x509.CertPool, error) {
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("[certs.loadPool()] (os.ReadFile) path: %s, err: %w;", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("[certs.loadPool()] path: %s, werr: %w;", file, ERROR__NO_CERT__)
+	}
+
+	return pool, nil
+}
+
+// loadCert. Первый сертификат из PEM файла
+func loadCert(file string) (*x509.Certificate, error) {
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("[certs.loadCert()] (os.ReadFile) path: %s, err: %w;", file, err)
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("[certs.loadCert()] path: %s, werr: %w;", file, ERROR__NO_CERT__)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("[certs.loadCert()] (x509.ParseCertificate) path: %s, err: %w;", file, err)
+		}
+		return cert, nil
+	}
+}
@@ -0,0 +1,126 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const PATH = "TestDir"
+
+// handshake. TLS рукопожатие через loopback, возвращает ошибки клиента и сервера
+func handshake(server *tls.Config, client *tls.Config) (*tls.ConnectionState, error, error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		defer c.Close()
+		srv := tls.Server(c, server)
+		err = srv.Handshake()
+		ch <- result{srv.ConnectionState(), err}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	cli := tls.Client(c, client)
+	cliErr := cli.Handshake()
+	if cliErr == nil {
+		// клиент TLS 1.3 узнает об отказе сервера только при чтении
+		cli.Read(make([]byte, 1))
+	}
+
+	r := <-ch
+
+	return &r.state, cliErr, r.err
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ca := filepath.Join(PATH, "ca")
+	if err := InitCA(ca, []string{"localhost", "127.0.0.1"}); err != nil {
+		panic(err)
+	}
+	if err := InitCA(ca, nil); !errors.Is(err, ERROR__EXISTS__) {
+		t.Fatalf("err: %v", err)
+	}
+
+	cert, fp, err := Issue(ca, "laptop", filepath.Join(PATH, "devices"))
+	if err != nil {
+		panic(err)
+	}
+
+	server, err := ServerConfig(ConfServerTLS{
+		Cert:     filepath.Join(ca, SERVER_CERT),
+		Key:      filepath.Join(ca, SERVER_KEY),
+		ClientCA: filepath.Join(ca, CA_CERT),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := ClientConfig(ConfClientTLS{
+		CA:         filepath.Join(ca, CA_CERT),
+		Cert:       cert,
+		Key:        filepath.Join(PATH, "devices", "laptop.key"),
+		ServerName: "localhost",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	state, cliErr, srvErr := handshake(server, client)
+	if cliErr != nil || srvErr != nil {
+		t.Fatalf("client: %v, server: %v", cliErr, srvErr)
+	}
+	if state.Version != tls.VersionTLS13 {
+		t.Fatalf("version: %x", state.Version)
+	}
+	if len(state.PeerCertificates) == 0 || Fingerprint(state.PeerCertificates[0]) != fp {
+		panic("device certificate fingerprint mismatch")
+	}
+
+	// без сертификата устройства сервер не пускает
+	noCert, err := ClientConfig(ConfClientTLS{CA: filepath.Join(ca, CA_CERT), ServerName: "localhost"})
+	if err != nil {
+		panic(err)
+	}
+	if _, _, srvErr := handshake(server, noCert); srvErr == nil {
+		panic("client without certificate is accepted")
+	}
+
+	// чужой CA: клиент не доверяет серверу
+	other := filepath.Join(PATH, "other")
+	if err := InitCA(other, []string{"localhost"}); err != nil {
+		panic(err)
+	}
+	foreign, err := ClientConfig(ConfClientTLS{CA: filepath.Join(other, CA_CERT), ServerName: "localhost"})
+	if err != nil {
+		panic(err)
+	}
+	if _, cliErr, _ := handshake(server, foreign); cliErr == nil {
+		panic("server with foreign CA is trusted")
+	}
+}
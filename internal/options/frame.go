@@ -0,0 +1,157 @@
+package options
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Кадр: | version 1 | type 1 | flags 1 | length 4 | payload length | crc32 4 |
+// Числа big-endian, crc32 (IEEE) считается по заголовку и payload
+const (
+	VERSION       byte = 1
+	HEADER_SIZE        = 7
+	CHECKSUM_SIZE      = 4
+	// MAX_PAYLOAD. Ограничение длины payload, чтобы испорченный заголовок не заставил выделить гигабайты
+	MAX_PAYLOAD = 16 << 20
+)
+
+var (
+	ERROR__SHORT_FRAME__ = errors.New("err frame is too short")
+	ERROR__VERSION__     = errors.New("err unsupported frame version")
+	ERROR__CHECKSUM__    = errors.New("err frame checksum mismatch")
+	ERROR__TOO_LARGE__   = errors.New("err frame payload is too large")
+)
+
+// Frame. Один кадр протокола. Type задает смысл Payload, Flags - признаки кадра (например, сжатие)
+type Frame struct {
+	Version byte
+	Type    byte
+	Flags   byte
+	Payload []byte
+}
+
+// ToString. Frame struct в строку
+func (f *Frame) ToString() string {
+	return fmt.Sprintf("Version: %d; Type: %d; Flags: %d; Payload: %d bytes;", f.Version, f.Type, f.Flags, len(f.Payload))
+}
+
+// MarshalFrame. Кадр в байты. Version 0 заменяется на текущую VERSION
+func MarshalFrame(f Frame) ([]byte, error) {
+
+	if len(f.Payload) > MAX_PAYLOAD {
+		return nil, fmt.Errorf("[options.MarshalFrame()] type: %d, len: %d, werr: %w;", f.Type, len(f.Payload), ERROR__TOO_LARGE__)
+	}
+
+	if f.Version == 0 {
+		f.Version = VERSION
+	}
+
+	buf := make([]byte, HEADER_SIZE+len(f.Payload)+CHECKSUM_SIZE)
+	buf[0] = f.Version
+	buf[1] = f.Type
+	buf[2] = f.Flags
+	binary.BigEndian.PutUint32(buf[3:HEADER_SIZE], uint32(len(f.Payload)))
+	copy(buf[HEADER_SIZE:], f.Payload)
+
+	end := HEADER_SIZE + len(f.Payload)
+	binary.BigEndian.PutUint32(buf[end:], crc32.ChecksumIEEE(buf[:end]))
+
+	return buf, nil
+}
+
+// UnmarshalFrame. Байты в кадр. data должен содержать ровно один кадр
+func UnmarshalFrame(data []byte) (Frame, error) {
+
+	if len(data) < HEADER_SIZE+CHECKSUM_SIZE {
+		return Frame{}, fmt.Errorf("[options.UnmarshalFrame()] len: %d, werr: %w;", len(data), ERROR__SHORT_FRAME__)
+	}
+
+	length, err := checkHeader(data[:HEADER_SIZE])
+	if err != nil {
+		return Frame{}, err
+	}
+
+	if len(data) != HEADER_SIZE+length+CHECKSUM_SIZE {
+		return Frame{}, fmt.Errorf(
+			"[options.UnmarshalFrame()] len: %d, payload: %d, werr: %w;",
+			len(data), length, ERROR__SHORT_FRAME__,
+		)
+	}
+
+	return decodeFrame(data)
+}
+
+// WriteFrame. Записывает кадр в поток
+func WriteFrame(w io.Writer, f Frame) error {
+
+	data, err := MarshalFrame(f)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("[options.WriteFrame()] (w.Write) type: %d, err: %w;", f.Type, err)
+	}
+
+	return nil
+}
+
+// ReadFrame. Читает следующий кадр из потока. io.EOF возвращается как есть, если поток закончился между кадрами
+func ReadFrame(r io.Reader) (Frame, error) {
+
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return Frame{}, err
+		}
+		return Frame{}, fmt.Errorf("[options.ReadFrame()] (io.ReadFull) header, err: %w;", err)
+	}
+
+	length, err := checkHeader(header)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	data := make([]byte, HEADER_SIZE+length+CHECKSUM_SIZE)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[HEADER_SIZE:]); err != nil {
+		return Frame{}, fmt.Errorf("[options.ReadFrame()] (io.ReadFull) payload: %d, err: %w;", length, err)
+	}
+
+	return decodeFrame(data)
+}
+
+// checkHeader. Проверяет версию и длину payload из заголовка
+func checkHeader(header []byte) (int, error) {
+
+	if header[0] != VERSION {
+		return 0, fmt.Errorf("[options.checkHeader()] version: %d, werr: %w;", header[0], ERROR__VERSION__)
+	}
+
+	length := binary.BigEndian.Uint32(header[3:HEADER_SIZE])
+	if length > MAX_PAYLOAD {
+		return 0, fmt.Errorf("[options.checkHeader()] payload: %d, werr: %w;", length, ERROR__TOO_LARGE__)
+	}
+
+	return int(length), nil
+}
+
+// decodeFrame. Сверяет контрольную сумму и разбирает кадр, длина data уже проверена
+func decodeFrame(data []byte) (Frame, error) {
+
+	end := len(data) - CHECKSUM_SIZE
+	sum := binary.BigEndian.Uint32(data[end:])
+	if got := crc32.ChecksumIEEE(data[:end]); got != sum {
+		return Frame{}, fmt.Errorf("[options.decodeFrame()] expected: %d, got: %d, werr: %w;", sum, got, ERROR__CHECKSUM__)
+	}
+
+	return Frame{
+		Version: data[0],
+		Type:    data[1],
+		Flags:   data[2],
+		Payload: data[HEADER_SIZE:end],
+	}, nil
+}
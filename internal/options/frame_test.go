@@ -0,0 +1,107 @@
+package options
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+
+	frames := []Frame{
+		{Type: 1, Payload: []byte("\x00\x00\x00\x00hello")},
+		{Type: 5, Flags: 1},
+		{Type: 4, Payload: bytes.Repeat([]byte{0xff}, 1<<16)},
+	}
+
+	var stream bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&stream, f); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, want := range frames {
+		got, err := ReadFrame(&stream)
+		if err != nil {
+			panic(err)
+		}
+		if got.Version != VERSION || got.Type != want.Type || got.Flags != want.Flags || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("got: %s, want: %s", got.ToString(), want.ToString())
+		}
+	}
+
+	if _, err := ReadFrame(&stream); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFrameBroken(t *testing.T) {
+
+	data, err := MarshalFrame(Frame{Type: 5, Payload: []byte("payload")})
+	if err != nil {
+		panic(err)
+	}
+
+	corrupt := append([]byte{}, data...)
+	corrupt[HEADER_SIZE] ^= 1
+	if _, err := UnmarshalFrame(corrupt); !errors.Is(err, ERROR__CHECKSUM__) {
+		t.Fatalf("checksum, err: %v", err)
+	}
+
+	version := append([]byte{}, data...)
+	version[0] = VERSION + 1
+	if _, err := UnmarshalFrame(version); !errors.Is(err, ERROR__VERSION__) {
+		t.Fatalf("version, err: %v", err)
+	}
+
+	if _, err := UnmarshalFrame(data[:len(data)-1]); !errors.Is(err, ERROR__SHORT_FRAME__) {
+		t.Fatalf("short, err: %v", err)
+	}
+
+	if _, err := ReadFrame(bytes.NewReader(data[:len(data)-1])); err == nil || err == io.EOF {
+		t.Fatalf("truncated stream, err: %v", err)
+	}
+
+	huge := []byte{VERSION, 5, 0, 0xff, 0xff, 0xff, 0xff}
+	if _, err := ReadFrame(bytes.NewReader(huge)); !errors.Is(err, ERROR__TOO_LARGE__) {
+		t.Fatalf("huge, err: %v", err)
+	}
+
+	if _, err := MarshalFrame(Frame{Payload: make([]byte, MAX_PAYLOAD+1)}); !errors.Is(err, ERROR__TOO_LARGE__) {
+		t.Fatalf("marshal huge, err: %v", err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+
+	for _, fr := range []Frame{{Type: 1}, {Type: 5, Flags: 1, Payload: []byte("chunk")}} {
+		data, err := MarshalFrame(fr)
+		if err != nil {
+			panic(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{VERSION, 0, 0, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		fr, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		back, err := MarshalFrame(fr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.HasPrefix(data, back) {
+			t.Fatalf("data: %q, back: %q", data, back)
+		}
+
+		if _, err := UnmarshalFrame(back); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+}
@@ -1,61 +1,111 @@
 package options
 
 import (
-	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 )
 
+// Размеры полей куска файла в битах
 const (
 	FILE_PATH_SIZE      = 16
 	CURRENT_OFFSET_SIZE = 32
 	INDEX_SIZE          = 16
-	BUFFER_SIZE         = 8
 )
 
-const (
-	BOUND     = "\x00\x00\x00\x00"
-	DELIMITER = "\x00\x00"
+var (
+	ERROR__BROKEN_OPTIONS__ = errors.New("err broken options")
+	ERROR__FIELD_OVERFLOW__ = errors.New("err options field overflow")
 )
 
+// Options. Кусок файла.
+// Opt - закодированный кусок: | len(FilePath) | FilePath | CurrentOffset | Index | Buffer |,
+// он передается как payload кадра (см. Frame). Длина Buffer не кодируется: Buffer занимает остаток payload,
+// длину которого задает кадр
 type Options struct {
 	FilePath      string
-	CurrentOffset string
-	Index         string
-	Buffer        string
+	CurrentOffset int64
+	Index         uint16
+	Buffer        []byte
 	Opt           []byte
 	Err           error
 }
 
+// EncodeOptions. Кодирует поля в o.Opt, ошибка записывается в o.Err
 func EncodeOptions(ctx context.Context, log *log.Logger, o *Options) {
 
-	buf := new(bytes.Buffer)
+	o.Err = nil
 
-	data := []string{
-		BOUND, 
-		o.FilePath, DELIMITER, 
-		o.CurrentOffset, DELIMITER, 
-		o.Index, DELIMITER, 
-		o.Buffer, 
-		BOUND,
+	if len(o.FilePath) == 0 || len(o.FilePath) >= 1<<FILE_PATH_SIZE {
+		o.Err = fmt.Errorf("[options.EncodeOptions()] path len: %d, werr: %w;", len(o.FilePath), ERROR__FIELD_OVERFLOW__)
+		return
 	}
 
-	for _, v := range data {
-		_, err := buf.WriteString(v)
-		if err != nil {
-			o.Err = err
-		}
+	if o.CurrentOffset < 0 || o.CurrentOffset >= 1<<CURRENT_OFFSET_SIZE {
+		o.Err = fmt.Errorf("[options.EncodeOptions()] offset: %d, werr: %w;", o.CurrentOffset, ERROR__FIELD_OVERFLOW__)
+		return
 	}
 
-	o.Opt = buf.Bytes()
+	buf := make([]byte, 0, size(len(o.FilePath), len(o.Buffer)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(o.FilePath)))
+	buf = append(buf, o.FilePath...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(o.CurrentOffset))
+	buf = binary.BigEndian.AppendUint16(buf, o.Index)
+	buf = append(buf, o.Buffer...)
+
+	o.Opt = buf
 }
 
+// DecodeOptions. Разбирает o.Opt в поля. На испорченных данных не паникует, а записывает ошибку в o.Err.
+// Buffer ссылается на память o.Opt
 func DecodeOptions(ctx context.Context, log *log.Logger, o *Options) {
 
-	opts := bytes.Split(bytes.Split(o.Opt, []byte(BOUND))[1], []byte(DELIMITER))
-	
-	o.FilePath = string(opts[0])
-	o.CurrentOffset = string(opts[1])
-	o.Index = string(opts[2])
-	o.Buffer = string(opts[3])
+	o.Err = nil
+	data := o.Opt
+
+	pathLen, data, ok := take(data, FILE_PATH_SIZE/8)
+	if !ok {
+		o.Err = fmt.Errorf("[options.DecodeOptions()] path len, werr: %w;", ERROR__BROKEN_OPTIONS__)
+		return
+	}
+
+	// кусок без пути никому не нужен, а пустой путь - верный признак мусора
+	path, data, ok := take(data, int(binary.BigEndian.Uint16(pathLen)))
+	if !ok || len(path) == 0 {
+		o.Err = fmt.Errorf("[options.DecodeOptions()] path, werr: %w;", ERROR__BROKEN_OPTIONS__)
+		return
+	}
+
+	offset, data, ok := take(data, CURRENT_OFFSET_SIZE/8)
+	if !ok {
+		o.Err = fmt.Errorf("[options.DecodeOptions()] offset, werr: %w;", ERROR__BROKEN_OPTIONS__)
+		return
+	}
+
+	index, data, ok := take(data, INDEX_SIZE/8)
+	if !ok {
+		o.Err = fmt.Errorf("[options.DecodeOptions()] index, werr: %w;", ERROR__BROKEN_OPTIONS__)
+		return
+	}
+
+	o.FilePath = string(path)
+	o.CurrentOffset = int64(binary.BigEndian.Uint32(offset))
+	o.Index = binary.BigEndian.Uint16(index)
+	o.Buffer = data
+}
+
+// size. Длина закодированного куска
+func size(pathLen int, bufLen int) int {
+	return (FILE_PATH_SIZE+CURRENT_OFFSET_SIZE+INDEX_SIZE)/8 + pathLen + bufLen
+}
+
+// take. Отрезает n байт от начала data
+func take(data []byte, n int) ([]byte, []byte, bool) {
+
+	if n < 0 || len(data) < n {
+		return nil, data, false
+	}
+	return data[:n], data[n:], true
 }
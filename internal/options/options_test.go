@@ -1,39 +1,40 @@
 package options
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"log"
 	"testing"
 )
 
 func TestEncode(t *testing.T) {
-	
+
 	ctx := context.TODO()
 	log := log.Logger{}
 	opt := Options{
-		FilePath: "hello world",
-		CurrentOffset: "4096",
-		Index: "17",
-		Buffer: "1024",
+		FilePath:      "hello\x00\x00world/\x00\x00\x00\x00.txt",
+		CurrentOffset: 3 << 30,
+		Index:         17,
+		Buffer:        []byte("\x00\x00\x00\x001024\x00\x00"),
 	}
 
-
 	EncodeOptions(ctx, &log, &opt)
 	opt1 := opt
 	if opt.Err != nil {
 		t.Error(opt.Err)
 	}
 
-	DecodeOptions(ctx, &log, &opt)
-	opt2 := opt
-	if opt.Err != nil {
-		t.Error(opt.Err)
+	opt2 := Options{Opt: opt.Opt}
+	DecodeOptions(ctx, &log, &opt2)
+	if opt2.Err != nil {
+		t.Error(opt2.Err)
 	}
 
 	if opt1.FilePath != opt2.FilePath {
 		t.Fail()
 	}
-	if opt1.Buffer != opt2.Buffer {
+	if !bytes.Equal(opt1.Buffer, opt2.Buffer) {
 		t.Fail()
 	}
 	if opt1.CurrentOffset != opt2.CurrentOffset {
@@ -42,4 +43,78 @@ func TestEncode(t *testing.T) {
 	if opt1.Index != opt2.Index {
 		t.Fail()
 	}
-}
\ No newline at end of file
+}
+
+func TestEncodeOverflow(t *testing.T) {
+
+	opts := []Options{
+		{FilePath: string(make([]byte, 1<<FILE_PATH_SIZE))},
+		{FilePath: "file.txt", CurrentOffset: -1},
+		{FilePath: "file.txt", CurrentOffset: 1 << CURRENT_OFFSET_SIZE},
+		{FilePath: "", Buffer: []byte("data")},
+	}
+
+	for _, opt := range opts {
+		EncodeOptions(context.TODO(), log.Default(), &opt)
+		if !errors.Is(opt.Err, ERROR__FIELD_OVERFLOW__) {
+			t.Fatalf("err: %v", opt.Err)
+		}
+	}
+}
+
+func TestDecodeBroken(t *testing.T) {
+
+	opt := Options{FilePath: "file.txt", CurrentOffset: 10, Index: 1, Buffer: []byte("data")}
+	EncodeOptions(context.TODO(), log.Default(), &opt)
+	if opt.Err != nil {
+		panic(opt.Err)
+	}
+
+	broken := [][]byte{
+		nil,
+		{0},
+		opt.Opt[:len(opt.Opt)-len(opt.Buffer)-1],
+		// старый формат с разделителями
+		[]byte("\x00\x00\x00\x00file.txt\x00\x0010\x00\x001\x00\x00data\x00\x00\x00\x00"),
+	}
+
+	for _, data := range broken {
+		o := Options{Opt: data}
+		DecodeOptions(context.TODO(), log.Default(), &o)
+		if o.Err == nil {
+			t.Fatalf("data: %q, decoded without error", data)
+		}
+	}
+}
+
+func FuzzDecodeOptions(f *testing.F) {
+
+	for _, opt := range []Options{
+		{FilePath: "file.txt", CurrentOffset: 0, Index: 0, Buffer: []byte("hello")},
+		{FilePath: "a/\x00b", CurrentOffset: 1 << 31, Index: 7},
+	} {
+		EncodeOptions(context.TODO(), log.Default(), &opt)
+		f.Add(opt.Opt)
+	}
+	f.Add([]byte{})
+	f.Add([]byte("\x00\x00\x00\x00a\x00\x00b\x00\x00c\x00\x00d\x00\x00\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		o := Options{Opt: data}
+		DecodeOptions(context.TODO(), log.Default(), &o)
+		if o.Err != nil {
+			return
+		}
+
+		// разобранное без ошибки кодируется обратно в те же байты
+		back := Options{FilePath: o.FilePath, CurrentOffset: o.CurrentOffset, Index: o.Index, Buffer: o.Buffer}
+		EncodeOptions(context.TODO(), log.Default(), &back)
+		if back.Err != nil {
+			t.Fatalf("err: %v", back.Err)
+		}
+		if !bytes.Equal(back.Opt, data) {
+			t.Fatalf("data: %q, back: %q", data, back.Opt)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package wire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/preegnees/gobox/internal/options"
+)
+
+// Признаки кадра (options.Frame.Flags). Младшие биты - алгоритм, которым сжат payload, 0 - payload не сжат.
+// Алгоритм записан в самом кадре, поэтому получатель разжимает кадр без знания о договоренности
+const (
+	FLAG_GZIP        byte = 1
+	FLAG_ZSTD        byte = 2
+	FLAG_COMPRESSION byte = 0x0f
+)
+
+const (
+	// MIN_COMPRESS. Куски меньше не сжимаются: выигрыш меньше заголовка алгоритма
+	MIN_COMPRESS = 512
+	// SAMPLE_SIZE и SAMPLES. Энтропия оценивается по нескольким участкам куска, а не по всему куску
+	SAMPLE_SIZE = 4 << 10
+	SAMPLES     = 4
+	// MAX_ENTROPY. Бит на байт, выше которых данные считаются уже сжатыми или случайными
+	MAX_ENTROPY = 7.5
+)
+
+var (
+	ERROR__UNKNOWN_COMPRESSION__ = errors.New("err unknown compression")
+	ERROR__DECOMPRESS__          = errors.New("err broken compressed payload")
+)
+
+// compressed. Расширения файлов, содержимое которых уже сжато
+var compressed = map[string]struct{}{
+	".7z": {}, ".aac": {}, ".apk": {}, ".avi": {}, ".br": {}, ".bz2": {}, ".docx": {}, ".flac": {},
+	".gif": {}, ".gz": {}, ".heic": {}, ".jar": {}, ".jpeg": {}, ".jpg": {}, ".lz4": {}, ".m4a": {},
+	".mkv": {}, ".mov": {}, ".mp3": {}, ".mp4": {}, ".odt": {}, ".ogg": {}, ".png": {}, ".pptx": {},
+	".rar": {}, ".tgz": {}, ".webm": {}, ".webp": {}, ".woff2": {}, ".xlsx": {}, ".xz": {}, ".zip": {},
+	".zst": {},
+}
+
+// codec. Алгоритм сжатия payload
+type codec struct {
+	flag       byte
+	compress   func([]byte) ([]byte, error)
+	decompress func([]byte) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	COMPRESSION_GZIP: {flag: FLAG_GZIP, compress: gzipCompress, decompress: gzipDecompress},
+	COMPRESSION_ZSTD: {flag: FLAG_ZSTD, compress: zstdCompress, decompress: zstdDecompress},
+}
+
+// Compressions. Алгоритмы сжатия, которые понимает эта сборка, в порядке предпочтения
+func Compressions() []string {
+	return []string{COMPRESSION_ZSTD, COMPRESSION_GZIP, COMPRESSION_NONE}
+}
+
+// SetCompression. Включает сжатие кусков, о котором договорились в Hello/Welcome.
+// COMPRESSION_NONE и пустое имя (Welcome старого сервера) выключают сжатие. Принимать сжатые кадры соединение умеет всегда
+func (c *Conn) SetCompression(name string) error {
+
+	if name == "" {
+		name = COMPRESSION_NONE
+	}
+
+	if _, ok := codecs[name]; !ok && name != COMPRESSION_NONE {
+		return fmt.Errorf("[wire.SetCompression()] name: %s, werr: %w;", name, ERROR__UNKNOWN_COMPRESSION__)
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.compression = name
+
+	return nil
+}
+
+// pack. Сжимает payload куска файла file, если это имеет смысл. Сжатый payload берется, только если он короче.
+// Заголовок Options в payload мал, поэтому энтропия payload - это энтропия данных куска
+func pack(f *options.Frame, name string, file string) error {
+
+	cd, ok := codecs[name]
+	if !ok || f.Type != TYPE_CHUNK || len(f.Payload) < MIN_COMPRESS || !Compressible(file, f.Payload) {
+		return nil
+	}
+
+	data, err := cd.compress(f.Payload)
+	if err != nil {
+		return fmt.Errorf("[wire.pack()] name: %s, err: %w;", name, err)
+	}
+
+	if len(data) < len(f.Payload) {
+		f.Payload = data
+		f.Flags |= cd.flag
+	}
+
+	return nil
+}
+
+// unpack. Разжимает payload, если кадр сжат
+func unpack(f *options.Frame) error {
+
+	flag := f.Flags & FLAG_COMPRESSION
+	if flag == 0 {
+		return nil
+	}
+
+	for name, cd := range codecs {
+		if cd.flag != flag {
+			continue
+		}
+		data, err := cd.decompress(f.Payload)
+		if err != nil {
+			return fmt.Errorf("[wire.unpack()] name: %s, err: %v, werr: %w;", name, err, ERROR__DECOMPRESS__)
+		}
+		f.Payload = data
+		f.Flags &^= FLAG_COMPRESSION
+		return nil
+	}
+
+	return fmt.Errorf("[wire.unpack()] flags: %d, werr: %w;", f.Flags, ERROR__UNKNOWN_COMPRESSION__)
+}
+
+// Compressible. Стоит ли сжимать кусок файла path: уже сжатые форматы узнаются по расширению,
+// остальное - по энтропии нескольких участков куска
+func Compressible(file string, data []byte) bool {
+
+	if _, ok := compressed[strings.ToLower(path.Ext(file))]; ok {
+		return false
+	}
+
+	return entropy(data) <= MAX_ENTROPY
+}
+
+// entropy. Энтропия Шеннона (бит на байт) по SAMPLES участкам data длиной SAMPLE_SIZE
+func entropy(data []byte) float64 {
+
+	var counts [256]int
+	total := 0
+
+	step := len(data) / SAMPLES
+	for i := 0; i < SAMPLES; i++ {
+		start := i * step
+		end := start + SAMPLE_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		for _, b := range data[start:end] {
+			counts[b]++
+		}
+		total += end - start
+		if step == 0 {
+			break
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	var h float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(total)
+		h -= p * math.Log2(p)
+	}
+
+	return h
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// разжатый payload не больше кадра, иначе маленький кадр мог бы занять гигабайты
+	out, err := io.ReadAll(io.LimitReader(r, options.MAX_PAYLOAD+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > options.MAX_PAYLOAD {
+		return nil, options.ERROR__TOO_LARGE__
+	}
+
+	return out, nil
+}
+
+// Кодировщик и декодировщик zstd можно использовать из разных горутин, они создаются один раз
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdInit() {
+
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(options.MAX_PAYLOAD))
+	})
+}
+
+func zstdCompress(data []byte) ([]byte, error) {
+
+	if zstdInit(); zstdErr != nil {
+		return nil, zstdErr
+	}
+
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func zstdDecompress(data []byte) ([]byte, error) {
+
+	if zstdInit(); zstdErr != nil {
+		return nil, zstdErr
+	}
+
+	out, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > options.MAX_PAYLOAD {
+		return nil, options.ERROR__TOO_LARGE__
+	}
+
+	return out, nil
+}
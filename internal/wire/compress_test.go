@@ -0,0 +1,109 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/preegnees/gobox/internal/options"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+// chunk. Кадр куска файла path
+func chunk(path string, data []byte) *Message {
+
+	opt := options.Options{FilePath: path, Buffer: data}
+	options.EncodeOptions(context.TODO(), log.Default(), &opt)
+	if opt.Err != nil {
+		panic(opt.Err)
+	}
+
+	return &Message{Type: TYPE_CHUNK, Info: pc.Info{Path: path}, Chunk: opt.Opt}
+}
+
+func TestCompression(t *testing.T) {
+
+	text := bytes.Repeat([]byte("func main() { fmt.Println(\"hello, gobox\") }\n"), 2000)
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	cases := []struct {
+		name       string
+		msg        *Message
+		compressed bool
+	}{
+		{"text", chunk("src/main.go", text), true},
+		{"random", chunk("data.bin", random), false},
+		{"archive", chunk("backup.ZIP", text), false},
+		{"small", chunk("a.txt", []byte("hello")), false},
+	}
+
+	for _, name := range []string{COMPRESSION_ZSTD, COMPRESSION_GZIP, COMPRESSION_NONE} {
+		for _, c := range cases {
+			a, b := net.Pipe()
+			client := NewConn(a)
+			if err := client.SetCompression(name); err != nil {
+				panic(err)
+			}
+
+			go func() {
+				if err := client.Send(c.msg); err != nil {
+					panic(err)
+				}
+			}()
+
+			// кадр читается как есть, чтобы увидеть флаг сжатия
+			f, err := options.ReadFrame(bufio.NewReader(b))
+			if err != nil {
+				panic(err)
+			}
+			a.Close()
+			b.Close()
+
+			want := c.compressed && name != COMPRESSION_NONE
+			if (f.Flags&FLAG_COMPRESSION != 0) != want {
+				t.Fatalf("compression: %s, case: %s, flags: %d", name, c.name, f.Flags)
+			}
+			if want && len(f.Payload) > len(c.msg.Chunk)/4 {
+				t.Fatalf("compression: %s, case: %s, payload: %d of %d", name, c.name, len(f.Payload), len(c.msg.Chunk))
+			}
+
+			if err := unpack(&f); err != nil {
+				panic(err)
+			}
+			if !bytes.Equal(f.Payload, c.msg.Chunk) {
+				t.Fatalf("compression: %s, case: %s, payload mismatch", name, c.name)
+			}
+		}
+	}
+
+	if err := NewConn(nil).SetCompression("lz4"); !errors.Is(err, ERROR__UNKNOWN_COMPRESSION__) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+
+	// маленький кадр, который разжимается больше MAX_PAYLOAD
+	zeros := make([]byte, options.MAX_PAYLOAD+1)
+	for name, cd := range codecs {
+		data, err := cd.compress(zeros)
+		if err != nil {
+			panic(err)
+		}
+		f := options.Frame{Type: TYPE_CHUNK, Flags: cd.flag, Payload: data}
+		if err := unpack(&f); !errors.Is(err, ERROR__DECOMPRESS__) {
+			t.Fatalf("compression: %s, err: %v", name, err)
+		}
+	}
+
+	f := options.Frame{Type: TYPE_CHUNK, Flags: 0x0f, Payload: []byte("x")}
+	if err := unpack(&f); !errors.Is(err, ERROR__UNKNOWN_COMPRESSION__) {
+		t.Fatalf("err: %v", err)
+	}
+}
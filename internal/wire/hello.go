@@ -0,0 +1,98 @@
+package wire
+
+import (
+	"fmt"
+
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+)
+
+// Версия протокола (смысл сообщений). Формат кадра версионируется отдельно (options.VERSION).
+// Сервер принимает клиентов с версиями от MIN_PROTOCOL до PROTOCOL
+const (
+	PROTOCOL     = 1
+	MIN_PROTOCOL = 1
+)
+
+// Коды отказа в TYPE_REJECT
+const (
+	REJECT_BAD_HELLO    byte = 1 // первое сообщение не Hello или в нем не хватает полей
+	REJECT_UNAUTHORIZED byte = 2 // неизвестный или отозванный токен устройства
+	REJECT_PROTOCOL     byte = 3 // версия протокола клиента не поддерживается
+	REJECT_CAPABILITY   byte = 4 // нет общего алгоритма хеширования
+	REJECT_ROOT         byte = 5 // сервер не обслуживает эту папку синхронизации
+)
+
+// Алгоритмы сжатия, которые понимают клиент и сервер. Имена алгоритмов хеширования - ut.HASH_*
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+// Hashes. Алгоритмы хеширования файлов, которые понимает эта сборка (ut.Hashers), первый - по умолчанию
+func Hashes() []string {
+	return ut.Hashers()
+}
+
+// Hello. Первое сообщение клиента.
+// Hashes и Compressions перечислены в порядке предпочтения клиента, Root - идентификатор папки синхронизации
+type Hello struct {
+	Device       string
+	Protocol     int
+	Token        string `json:",omitempty"`
+	Hashes       []string
+	Compressions []string
+	Root         string
+}
+
+// ToString. Hello struct в строку, без токена
+func (h *Hello) ToString() string {
+	return fmt.Sprintf(
+		"Device: %s; Protocol: %d; Hashes: %v; Compressions: %v; Root: %s;",
+		h.Device, h.Protocol, h.Hashes, h.Compressions, h.Root,
+	)
+}
+
+// Welcome. Ответ сервера: версия протокола и алгоритмы, которыми пользуются обе стороны.
+// Hash - алгоритм хеширования файлов, которым клиент считает хеши в Info
+type Welcome struct {
+	Protocol    int
+	Hash        string
+	Compression string
+}
+
+// ToString. Welcome struct в строку
+func (w *Welcome) ToString() string {
+	return fmt.Sprintf("Protocol: %d; Hash: %s; Compression: %s;", w.Protocol, w.Hash, w.Compression)
+}
+
+// Reason. Текст для кода отказа
+func Reason(code byte) string {
+
+	switch code {
+	case REJECT_BAD_HELLO:
+		return "bad hello"
+	case REJECT_UNAUTHORIZED:
+		return "unauthorized"
+	case REJECT_PROTOCOL:
+		return "unsupported protocol version"
+	case REJECT_CAPABILITY:
+		return "no common capabilities"
+	case REJECT_ROOT:
+		return "unknown sync root"
+	}
+	return fmt.Sprintf("unknown reason %d", code)
+}
+
+// Choose. Первый из предпочтений клиента, который есть у сервера. false, если общих нет
+func Choose(preferred []string, supported []string) (string, bool) {
+
+	for _, p := range preferred {
+		for _, s := range supported {
+			if p == s {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
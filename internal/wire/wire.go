@@ -0,0 +1,182 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/preegnees/gobox/internal/options"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+// Типы сообщений, которые передаются между клиентом и сервером
+const (
+	TYPE_HELLO   byte = 1 // клиент представляется серверу (Hello)
+	TYPE_WELCOME byte = 2 // сервер принял клиента и выбрал возможности (Welcome)
+	TYPE_ERROR   byte = 3 // ошибка (от сервера) или отчет об ошибке (от клиента)
+	TYPE_INFO    byte = 4 // метаданные файла или папки (pc.Info), от сервера - изменение, которое сделал другой клиент
+	TYPE_CHUNK   byte = 5 // кусок файла (закодированный options.Options)
+	TYPE_REJECT  byte = 6 // сервер отказал клиенту (Code, Text)
+	TYPE_NEED    byte = 7 // серверу не хватает кусков файла Info.Path (Hashes), клиент отвечает TYPE_CHUNK
+	TYPE_GET     byte = 8 // клиент просит интервалы Ranges файла Info.Path версии Info.Hash, сервер отвечает TYPE_CHUNK
+	TYPE_SENT    byte = 9 // сервер отправил все куски по TYPE_GET для Info.Path, непустой Text - почему отдать не удалось
+)
+
+// Range. Полуинтервал байт файла [Start, End)
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// Message. Сообщение протокола. Каждое сообщение передается одним кадром options.Frame с типом Type:
+// для TYPE_CHUNK payload - Chunk, для остальных типов - JSON с остальными полями.
+// У TYPE_CHUNK Info не передается, по Info.Path отправитель решает, сжимать ли кусок
+type Message struct {
+	Type    byte
+	Hello   *Hello
+	Welcome *Welcome
+	Code    byte
+	Ident   int
+	Text    string
+	Info    pc.Info
+	Hashes  []string
+	Ranges  []Range
+	Chunk   []byte
+}
+
+// body. Поля сообщения, которые передаются в JSON
+type body struct {
+	Hello   *Hello   `json:",omitempty"`
+	Welcome *Welcome `json:",omitempty"`
+	Code    byte     `json:",omitempty"`
+	Ident   int      `json:",omitempty"`
+	Text    string   `json:",omitempty"`
+	Info    pc.Info
+	Hashes  []string `json:",omitempty"`
+	Ranges  []Range  `json:",omitempty"`
+}
+
+// ToString. Message struct в строку
+func (m *Message) ToString() string {
+	return fmt.Sprintf(
+		"Type: %d; Code: %d; Ident: %d; Text: %s; Info: {%s}; Hashes: %d; Ranges: %d; Chunk: %d bytes;",
+		m.Type, m.Code, m.Ident, m.Text, m.Info.ToString(), len(m.Hashes), len(m.Ranges), len(m.Chunk),
+	)
+}
+
+// Conn. Соединение, по которому передаются сообщения. Send можно вызывать из разных горутин.
+// compression - алгоритм, которым сжимаются отправляемые куски (см. SetCompression)
+type Conn struct {
+	conn        net.Conn
+	mx          sync.Mutex
+	w           *bufio.Writer
+	r           *bufio.Reader
+	compression string
+}
+
+// NewConn. Оборачивает сетевое соединение
+func NewConn(conn net.Conn) *Conn {
+
+	return &Conn{
+		conn:        conn,
+		w:           bufio.NewWriter(conn),
+		r:           bufio.NewReader(conn),
+		compression: COMPRESSION_NONE,
+	}
+}
+
+// Send. Отправляет сообщение
+func (c *Conn) Send(m *Message) error {
+
+	f, err := encode(m)
+	if err != nil {
+		return err
+	}
+
+	c.mx.Lock()
+	compression := c.compression
+	c.mx.Unlock()
+
+	// сжатие не держит мьютекс: куски могут сжиматься параллельно
+	if err := pack(&f, compression, m.Info.Path); err != nil {
+		return err
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if err := options.WriteFrame(c.w, f); err != nil {
+		return fmt.Errorf("[wire.Send()] (options.WriteFrame) type: %d, err: %w;", m.Type, err)
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("[wire.Send()] (w.Flush) type: %d, err: %w;", m.Type, err)
+	}
+	return nil
+}
+
+// Recv. Читает следующее сообщение. Вызывать только из одной горутины
+func (c *Conn) Recv() (*Message, error) {
+
+	f, err := options.ReadFrame(c.r)
+	if err != nil {
+		return nil, fmt.Errorf("[wire.Recv()] (options.ReadFrame) err: %w;", err)
+	}
+
+	if err := unpack(&f); err != nil {
+		return nil, err
+	}
+
+	return decode(f)
+}
+
+// encode. Сообщение в кадр
+func encode(m *Message) (options.Frame, error) {
+
+	f := options.Frame{Type: m.Type}
+
+	if m.Type == TYPE_CHUNK {
+		f.Payload = m.Chunk
+		return f, nil
+	}
+
+	data, err := json.Marshal(body{Hello: m.Hello, Welcome: m.Welcome, Code: m.Code, Ident: m.Ident, Text: m.Text, Info: m.Info, Hashes: m.Hashes, Ranges: m.Ranges})
+	if err != nil {
+		return f, fmt.Errorf("[wire.encode()] (json.Marshal) type: %d, err: %w;", m.Type, err)
+	}
+	f.Payload = data
+
+	return f, nil
+}
+
+// decode. Кадр в сообщение
+func decode(f options.Frame) (*Message, error) {
+
+	m := &Message{Type: f.Type}
+
+	if f.Type == TYPE_CHUNK {
+		m.Chunk = f.Payload
+		return m, nil
+	}
+
+	var b body
+	if err := json.Unmarshal(f.Payload, &b); err != nil {
+		return nil, fmt.Errorf("[wire.decode()] (json.Unmarshal) type: %d, err: %w;", f.Type, err)
+	}
+	m.Hello, m.Welcome, m.Code = b.Hello, b.Welcome, b.Code
+	m.Ident, m.Text, m.Info, m.Hashes, m.Ranges = b.Ident, b.Text, b.Info, b.Hashes, b.Ranges
+
+	return m, nil
+}
+
+// RemoteAddr. Адрес другой стороны
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close. Закрывает соединение
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
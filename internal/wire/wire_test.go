@@ -0,0 +1,61 @@
+package wire
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+)
+
+func TestSendRecv(t *testing.T) {
+
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+
+	messages := []*Message{
+		{Type: TYPE_HELLO, Hello: &Hello{Device: "d", Protocol: PROTOCOL, Token: "secret", Hashes: []string{ut.HASH_BLAKE3}, Compressions: []string{COMPRESSION_ZSTD}, Root: "r"}},
+		{Type: TYPE_WELCOME, Welcome: &Welcome{Protocol: PROTOCOL, Hash: ut.HASH_BLAKE3, Compression: COMPRESSION_NONE}},
+		{Type: TYPE_REJECT, Code: REJECT_PROTOCOL, Text: "too old"},
+		{Type: TYPE_INFO, Info: pc.Info{Action: fsnotify.Rename, OldPath: "a\x00.txt", Path: "b.txt", Hash: "h"}},
+		{Type: TYPE_INFO, Info: pc.Info{Action: fsnotify.Write, Path: "big.img", Hash: "h", Size: 3, Chunks: []pc.Chunk{{Hash: "c1", Size: 1}, {Hash: "c2", Size: 2}}}},
+		{Type: TYPE_NEED, Info: pc.Info{Path: "big.img"}, Hashes: []string{"c2"}},
+		{Type: TYPE_CHUNK, Chunk: []byte("\x00\x00\x00\x00chunk")},
+		{Type: TYPE_GET, Info: pc.Info{Path: "big.img", Hash: "h"}, Ranges: []Range{{Start: 0, End: 1}, {Start: 2, End: 3}}},
+		{Type: TYPE_SENT, Info: pc.Info{Path: "big.img", Hash: "h"}, Text: "file changed"},
+		{Type: TYPE_ERROR, Ident: 3, Text: "err"},
+	}
+
+	go func() {
+		for _, m := range messages {
+			if err := client.Send(m); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	for _, want := range messages {
+		got, err := server.Recv()
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got: %s, want: %s", got.ToString(), want.ToString())
+		}
+	}
+}
+
+func TestChoose(t *testing.T) {
+
+	if got, ok := Choose([]string{"zstd", "gzip", "none"}, []string{"none", "gzip"}); !ok || got != "gzip" {
+		t.Fatalf("got: %s, ok: %v", got, ok)
+	}
+	if _, ok := Choose([]string{"zstd"}, []string{"none"}); ok {
+		panic("no common algorithm")
+	}
+}
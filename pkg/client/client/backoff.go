@@ -0,0 +1,35 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff. Экспоненциальная задержка между попытками подключения со случайным разбросом
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// next. Задержка перед следующей попыткой: половина фиксирована, половина случайна,
+// чтобы клиенты после падения сервера не подключались одновременно
+func (b *backoff) next() time.Duration {
+
+	d := b.min
+	for i := 0; i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// reset. Сбрасывает счетчик после успешного подключения
+func (b *backoff) reset() {
+	b.attempt = 0
+}
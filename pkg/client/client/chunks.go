@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/preegnees/gobox/internal/options"
+	"github.com/preegnees/gobox/internal/wire"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+// need. Отправляет куски файла, которых нет на сервере (TYPE_NEED).
+// Файл режется заново тем же chunker, что и при построении манифеста. Если файл уже изменился,
+// части кусков не найдется: сервер получит новый манифест со следующим событием
+func (c *Client) need(conn *wire.Conn, m *wire.Message) {
+
+	c.log.Debug(fmt.Sprintf("[client.need()] path: %s, chunks: %d;", m.Info.Path, len(m.Hashes)))
+
+	need := make(map[string]struct{}, len(m.Hashes))
+	for _, h := range m.Hashes {
+		need[h] = struct{}{}
+	}
+
+	local, err := pc.ToLocal(c.dir, m.Info.Path)
+	if err != nil {
+		c.log.Warn(fmt.Sprintf("[client.need()] (pc.ToLocal) path: %s, err: %v;", m.Info.Path, err))
+		return
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		c.log.Warn(fmt.Sprintf("[client.need()] (os.Open) path: %s, err: %v;", local, err))
+		return
+	}
+	defer f.Close()
+
+	ch, err := chunker.New(f, chunker.ConfChunker{})
+	if err != nil {
+		c.log.Error(err)
+		return
+	}
+
+	var index uint16
+	for len(need) > 0 {
+		offset, data, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.log.Warn(fmt.Sprintf("[client.need()] (ch.Next) path: %s, err: %v;", local, err))
+			return
+		}
+
+		hash := chunker.Hash(data)
+		if _, ok := need[hash]; !ok {
+			continue
+		}
+		delete(need, hash)
+
+		opt := options.Options{FilePath: m.Info.Path, CurrentOffset: offset, Index: index, Buffer: data}
+		options.EncodeOptions(c.ctx, nil, &opt)
+		if opt.Err != nil {
+			c.log.Error(opt.Err)
+			return
+		}
+		index++
+
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_CHUNK, Info: pc.Info{Path: m.Info.Path}, Chunk: opt.Opt}); err != nil {
+			c.log.Warn(fmt.Sprintf("[client.need()] (conn.Send) path: %s, err: %v;", m.Info.Path, err))
+			return
+		}
+	}
+
+	if len(need) > 0 {
+		c.log.Warn(fmt.Sprintf("[client.need()] path: %s, file changed, chunks not found: %d;", m.Info.Path, len(need)))
+	}
+}
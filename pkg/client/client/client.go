@@ -2,27 +2,611 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/wire"
+	er "github.com/preegnees/gobox/pkg/client/errors"
 	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	"github.com/preegnees/gobox/pkg/client/queue"
+)
+
+// Значения по умолчанию
+const (
+	DIAL_TIMEOUT = 5 * time.Second
+	KEEP_ALIVE   = 15 * time.Second
+	MIN_BACKOFF  = 500 * time.Millisecond
+	MAX_BACKOFF  = time.Minute
+)
+
+// ROOT. Идентификатор папки синхронизации по умолчанию
+const ROOT = "default"
+
+// Данный идентификатор привязан к данному пакету
+const IDENTIFIER = 4
+
+var (
+	// ERROR__REJECTED__. Сервер отказал в подключении
+	ERROR__REJECTED__ = errors.New("server rejected the connection")
+	// ERROR__UNAUTHORIZED__. Токен устройства неизвестен серверу или отозван
+	ERROR__UNAUTHORIZED__ = errors.New("device token is invalid or revoked")
 )
 
-var _ IClient = (*client)(nil)
+// Rejection. Отказ сервера с кодом причины (wire.REJECT_*). errors.Is(err, ERROR__REJECTED__) верно для любого кода,
+// errors.Is(err, ERROR__UNAUTHORIZED__) - только для отказа из-за токена
+type Rejection struct {
+	Code byte
+	Text string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", ERROR__REJECTED__, wire.Reason(r.Code), r.Text)
+}
+
+func (r *Rejection) Is(target error) bool {
+	return target == ERROR__REJECTED__ || (target == ERROR__UNAUTHORIZED__ && r.Code == wire.REJECT_UNAUTHORIZED)
+}
+
+// fatal. Ошибка, после которой клиент остановлен насовсем. Для супервизора это er.ERROR__WILL_CAUSE_A_STOP__,
+// причина (например ERROR__UNAUTHORIZED__) остается в цепочке
+type fatal struct {
+	err error
+}
+
+func (f *fatal) Error() string {
+	return f.err.Error()
+}
 
+func (f *fatal) Unwrap() error {
+	return f.err
+}
+
+func (f *fatal) Is(target error) bool {
+	return target == er.ERROR__WILL_CAUSE_A_STOP__
+}
+
+var _ IClient = (*Client)(nil)
+
+// IClient. интерфейс, через который пакеты клиента общаются с сервером
 type IClient interface {
 	SendError(int, context.CancelFunc, error)
 	SendDeviation(pc.Info)
 }
 
-type client struct{}
+// ConfClient. Конфигурация клиента.
+// Device - идентификатор устройства, если пустой, то берется из Dir (создается при первом запуске).
+// Root - идентификатор папки синхронизации на сервере.
+// TLS - настройки TLS (certs.ClientConfig), nil - без шифрования.
+// Hashes и Compressions - поддерживаемые алгоритмы в порядке предпочтения, по умолчанию все (wire.Hashes, wire.Compressions).
+// Сервер выбирает из них общие и сообщает в Welcome: файлы хешируются алгоритмом Welcome.Hash.
+// OnReconnect вызывается после каждого восстановления соединения, например чтобы заново выгрузить состояние папки
+type ConfClient struct {
+	Ctx          context.Context
+	Log          *logrus.Logger
+	Dir          string
+	Addr         string
+	TLS          *tls.Config
+	Token        string
+	Device       string
+	Root         string
+	Hashes       []string
+	Compressions []string
+	DialTimeout  time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	OnReconnect  func()
+}
+
+func (c *ConfClient) ToString() string {
+
+	return fmt.Sprintf(
+		"context: %v, levelLog: %s, dir: %s, addr: %s, tls: %v, device: %s, root: %s, dialTimeout: %v, minBackoff: %v, maxBackoff: %v",
+		c.Ctx, c.Log.Level, c.Dir, c.Addr, c.TLS != nil, c.Device, c.Root, c.DialTimeout, c.MinBackoff, c.MaxBackoff,
+	)
+}
+
+// Client. Сетевой клиент сервера gobox.
+// События сначала попадают в очередь на диске и отправляются, когда есть соединение
+type Client struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	log         *logrus.Logger
+	dir         string
+	addr        string
+	tls         *tls.Config
+	hello       wire.Hello
+	dialTimeout time.Duration
+	backoff     backoff
+	onReconnect func()
+	queue       *queue.Queue
+	notify      chan struct{}
+	done        chan struct{}
+	mx          sync.Mutex
+	conn        *wire.Conn
+	welcome     *wire.Welcome
+	fetches     map[string]*fetch
+	inbox       []pc.Info
+	arrived     chan struct{}
+	changes     chan pc.Info
+	err         error
+}
+
+// New. Создает клиента. Если сервер недоступен, клиент работает офлайн и подключается позже
+func New(cnf ConfClient) (*Client, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[client.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[client.New()] struct cnf: %v;", cnf.ToString()))
+
+	if cnf.Addr == "" {
+		return nil, fmt.Errorf("[client.New()] addr is empty;")
+	}
+
+	if cnf.DialTimeout <= 0 {
+		cnf.DialTimeout = DIAL_TIMEOUT
+	}
+
+	if cnf.MinBackoff <= 0 {
+		cnf.MinBackoff = MIN_BACKOFF
+	}
+
+	if cnf.MaxBackoff <= 0 {
+		cnf.MaxBackoff = MAX_BACKOFF
+	}
+
+	// верхняя граница не ниже нижней, даже если задана только нижняя
+	if cnf.MaxBackoff < cnf.MinBackoff {
+		cnf.MaxBackoff = cnf.MinBackoff
+	}
+
+	if cnf.Root == "" {
+		cnf.Root = ROOT
+	}
+
+	if len(cnf.Hashes) == 0 {
+		cnf.Hashes = wire.Hashes()
+	}
+
+	if len(cnf.Compressions) == 0 {
+		cnf.Compressions = wire.Compressions()
+	}
+
+	if cnf.Device == "" {
+		device, err := loadDevice(cnf.Dir)
+		if err != nil {
+			return nil, err
+		}
+		cnf.Device = device
+	}
+
+	q, err := queue.New(queue.ConfQueue{Log: cnf.Log, Dir: cnf.Dir})
+	if err != nil {
+		return nil, fmt.Errorf("[client.New()] (queue.New) err: %w;", err)
+	}
+
+	ctx, cancel := context.WithCancel(cnf.Ctx)
+
+	c := &Client{
+		ctx:    ctx,
+		cancel: cancel,
+		log:    cnf.Log,
+		dir:    cnf.Dir,
+		addr:   cnf.Addr,
+		tls:    cnf.TLS,
+		hello: wire.Hello{
+			Device:       cnf.Device,
+			Protocol:     wire.PROTOCOL,
+			Token:        cnf.Token,
+			Hashes:       cnf.Hashes,
+			Compressions: cnf.Compressions,
+			Root:         cnf.Root,
+		},
+		dialTimeout: cnf.DialTimeout,
+		backoff:     backoff{min: cnf.MinBackoff, max: cnf.MaxBackoff},
+		onReconnect: cnf.OnReconnect,
+		queue:       q,
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		fetches:     make(map[string]*fetch),
+		arrived:     make(chan struct{}, 1),
+		changes:     make(chan pc.Info),
+	}
+
+	conn, welcome, err := c.connect()
+	if errors.Is(err, ERROR__REJECTED__) {
+		cancel()
+		q.Close()
+		return nil, err
+	}
+	if err != nil {
+		cnf.Log.Warn(fmt.Sprintf("[client.New()] server unavailable, offline mode, err: %v;", err))
+	}
+	if conn != nil {
+		c.conn = conn
+		c.welcome = welcome
+		go c.watch(conn)
+	}
+
+	go c.run()
+	go c.deliver()
+
+	return c, nil
+}
+
+// SendError. Отправляет на сервер отчет об ошибке пакета с идентификатором indentifier.
+// Отчеты не копятся в очереди: без соединения они только пишутся в лог
+func (c *Client) SendError(indentifier int, cancel context.CancelFunc, err error) {
+
+	c.log.Error(fmt.Sprintf("[client.SendError()] identifier: %d, err: %v;", indentifier, err))
+
+	conn := c.current()
+	if conn == nil {
+		return
+	}
+
+	m := &wire.Message{
+		Type:  wire.TYPE_ERROR,
+		Ident: indentifier,
+		Text:  err.Error(),
+	}
+	if err := conn.Send(m); err != nil {
+		c.log.Error(fmt.Errorf("[client.SendError()] (conn.Send) err: %w;", err))
+		c.drop(conn)
+	}
+}
+
+// SendDeviation. Ставит метаданные файла или папки в очередь на отправку
+func (c *Client) SendDeviation(info pc.Info) {
+
+	c.log.Debug(fmt.Sprintf("[client.SendDeviation()] info: %s;", info.ToString()))
+
+	if err := c.queue.Push(info); err != nil {
+		c.log.Error(fmt.Errorf("[client.SendDeviation()] (queue.Push) err: %w;", err))
+		return
+	}
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Backlog. Количество событий, которые еще не отправлены на сервер
+func (c *Client) Backlog() int {
+	return c.queue.Len()
+}
+
+// Done. Закрывается, когда клиент остановлен и очередь закрыта
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Changes. Изменения, которые сделали другие клиенты (сервер рассылает их как TYPE_INFO), в порядке прихода.
+// Закрывается, когда клиент остановлен
+func (c *Client) Changes() <-chan pc.Info {
+	return c.changes
+}
+
+// Err. Почему клиент остановился сам, например из-за отозванного токена.
+// nil, если клиент работает или остановлен контекстом
+func (c *Client) Err() error {
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.err
+}
+
+// Connected. Есть ли сейчас соединение с сервером
+func (c *Client) Connected() bool {
+	return c.current() != nil
+}
+
+// Welcome. Возможности, о которых договорились с сервером при последнем подключении. false, если подключения еще не было
+func (c *Client) Welcome() (wire.Welcome, bool) {
 
-func New() (IClient, error) {
-	return &client{}, nil
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.welcome == nil {
+		return wire.Welcome{}, false
+	}
+	return *c.welcome, true
 }
 
-func (c *client) SendError(indentifier int, ctx context.CancelFunc, err error) {
-	
+// run. Отправляет очередь, пока есть соединение, и переподключается с экспоненциальной задержкой, когда его нет
+func (c *Client) run() {
+
+	defer close(c.done)
+	defer c.queue.Close()
+	defer func() {
+		if conn := c.current(); conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn := c.current()
+		if conn == nil {
+			var err error
+			var welcome *wire.Welcome
+			conn, welcome, err = c.connect()
+			// с отозванным токеном переподключаться бесполезно
+			if errors.Is(err, ERROR__UNAUTHORIZED__) {
+				c.stop(err)
+				return
+			}
+			if err != nil {
+				delay := c.backoff.next()
+				c.log.Warn(fmt.Sprintf(
+					"[client.run()] reconnect attempt: %d failed, retry in: %v, err: %v;",
+					c.backoff.attempt, delay, err,
+				))
+				select {
+				case <-c.ctx.Done():
+					c.log.Debug("[client.run()] context done;")
+					return
+				case <-time.After(delay):
+				}
+				continue
+			}
+			c.mx.Lock()
+			c.conn = conn
+			c.welcome = welcome
+			c.mx.Unlock()
+			c.log.Info(fmt.Sprintf(
+				"[client.run()] reconnected to: %s after attempts: %d, backlog: %d;",
+				c.addr, c.backoff.attempt, c.queue.Len(),
+			))
+			c.backoff.reset()
+
+			go c.watch(conn)
+
+			if c.onReconnect != nil {
+				go c.onReconnect()
+			}
+		}
+
+		if err := c.flush(conn); err != nil {
+			c.log.Warn(err)
+			c.drop(conn)
+			continue
+		}
+
+		select {
+		case <-c.ctx.Done():
+			c.log.Debug("[client.run()] context done;")
+			return
+		case <-c.notify:
+		}
+	}
 }
 
-func (c *client) SendDeviation(info pc.Info) {
-	
+// flush. Отправляет очередь по порядку. Событие удаляется из очереди только после отправки
+func (c *Client) flush(conn *wire.Conn) error {
+
+	for {
+		info, ok := c.queue.Peek()
+		if !ok {
+			return nil
+		}
+
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_INFO, Info: info}); err != nil {
+			return fmt.Errorf("[client.flush()] (conn.Send) path: %s, err: %w;", info.Path, err)
+		}
+
+		if err := c.queue.Pop(); err != nil {
+			return fmt.Errorf("[client.flush()] (queue.Pop) err: %w;", err)
+		}
+	}
+}
+
+// watch. Читает соединение, чтобы сразу заметить его обрыв, отвечает на запросы кусков (TYPE_NEED),
+// передает загрузкам (Fetch) куски от сервера, а в Changes - изменения других клиентов.
+// После обрыва run переподключается
+func (c *Client) watch(conn *wire.Conn) {
+
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.log.Warn(fmt.Sprintf("[client.watch()] connection lost, err: %v;", err))
+			}
+			c.drop(conn)
+			return
+		}
+
+		switch m.Type {
+		case wire.TYPE_ERROR:
+			c.log.Error(fmt.Sprintf("[client.watch()] server err: %s;", m.Text))
+		case wire.TYPE_INFO:
+			c.change(m.Info)
+		case wire.TYPE_NEED:
+			go c.need(conn, m)
+		case wire.TYPE_CHUNK:
+			c.chunk(conn, m)
+		case wire.TYPE_SENT:
+			c.sent(conn, m)
+		case wire.TYPE_REJECT:
+			err := fmt.Errorf("[client.watch()] err: %w;", &Rejection{Code: m.Code, Text: m.Text})
+			if errors.Is(err, ERROR__UNAUTHORIZED__) {
+				c.stop(err)
+				continue
+			}
+			c.log.Warn(err)
+		}
+	}
+}
+
+// change. Кладет изменение от сервера в очередь для Changes. watch не ждет, пока изменение заберут:
+// применение изменения (например, загрузка файла) само ждет от watch куски
+func (c *Client) change(info pc.Info) {
+
+	c.log.Debug(fmt.Sprintf("[client.change()] info: %s;", info.ToString()))
+
+	c.mx.Lock()
+	c.inbox = append(c.inbox, info)
+	c.mx.Unlock()
+
+	select {
+	case c.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// deliver. Отдает изменения из очереди в Changes по порядку, пока клиент не остановлен
+func (c *Client) deliver() {
+
+	defer close(c.changes)
+
+	for {
+		c.mx.Lock()
+		inbox := c.inbox
+		c.inbox = nil
+		c.mx.Unlock()
+
+		for _, info := range inbox {
+			select {
+			case c.changes <- info:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-c.arrived:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// stop. Останавливает клиента насовсем, причина доступна через Err
+func (c *Client) stop(err error) {
+
+	c.log.Error(fmt.Sprintf("[client.stop()] err: %v;", err))
+
+	c.mx.Lock()
+	if c.err == nil {
+		c.err = &fatal{err: err}
+	}
+	c.mx.Unlock()
+
+	c.cancel()
+}
+
+// connect. Подключается к серверу и договаривается о возможностях (Hello)
+func (c *Client) connect() (*wire.Conn, *wire.Welcome, error) {
+
+	dialer := &net.Dialer{Timeout: c.dialTimeout, KeepAlive: KEEP_ALIVE}
+
+	var nc net.Conn
+	var err error
+	if c.tls != nil {
+		// рукопожатие TLS входит в DialContext и ограничено тем же таймаутом
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(c.ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(c.ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("[client.connect()] (dialer.DialContext) addr: %s, err: %w;", c.addr, err)
+	}
+	conn := wire.NewConn(nc)
+
+	welcome, err := hello(conn, c.hello, c.dialTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := conn.SetCompression(welcome.Compression); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("[client.connect()] (conn.SetCompression) err: %w;", err)
+	}
+
+	c.log.Debug(fmt.Sprintf("[client.connect()] addr: %s, welcome: %s;", c.addr, welcome.ToString()))
+
+	return conn, welcome, nil
+}
+
+// current. Текущее соединение или nil, если клиент офлайн
+func (c *Client) current() *wire.Conn {
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.conn
+}
+
+// drop. Закрывает сломанное соединение и переводит клиента в офлайн
+func (c *Client) drop(conn *wire.Conn) {
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.conn == conn {
+		c.conn = nil
+	}
+	conn.Close()
+
+	for path, f := range c.fetches {
+		if f.conn == conn {
+			f.finish(fmt.Errorf("[client.drop()] path: %s, connection lost;", path))
+		}
+	}
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// hello. Отправляет Hello и ждет ответа сервера. Отказ сервера возвращается как *Rejection
+func hello(conn *wire.Conn, h wire.Hello, timeout time.Duration) (*wire.Welcome, error) {
+
+	if err := conn.Send(&wire.Message{Type: wire.TYPE_HELLO, Hello: &h}); err != nil {
+		return nil, fmt.Errorf("[client.hello()] (conn.Send) err: %w;", err)
+	}
+
+	type result struct {
+		m   *wire.Message
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		m, err := conn.Recv()
+		ch <- result{m, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, fmt.Errorf("[client.hello()] (conn.Recv) err: %w;", r.err)
+		}
+		if r.m.Type == wire.TYPE_REJECT {
+			return nil, fmt.Errorf("[client.hello()] err: %w;", &Rejection{Code: r.m.Code, Text: r.m.Text})
+		}
+		if r.m.Type != wire.TYPE_WELCOME || r.m.Welcome == nil {
+			return nil, fmt.Errorf("[client.hello()] unexpected type: %d;", r.m.Type)
+		}
+		// сервер новее клиента и уже не умеет его версию
+		if r.m.Welcome.Protocol < wire.MIN_PROTOCOL || r.m.Welcome.Protocol > h.Protocol {
+			return nil, fmt.Errorf("[client.hello()] err: %w;", &Rejection{
+				Code: wire.REJECT_PROTOCOL,
+				Text: fmt.Sprintf("server: %d, client supports: %d..%d", r.m.Welcome.Protocol, wire.MIN_PROTOCOL, h.Protocol),
+			})
+		}
+		return r.m.Welcome, nil
+	case <-time.After(timeout):
+		conn.Close()
+		return nil, fmt.Errorf("[client.hello()] handshake timeout: %v;", timeout)
+	}
 }
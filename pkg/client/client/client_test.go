@@ -0,0 +1,679 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/options"
+	"github.com/preegnees/gobox/internal/wire"
+	er "github.com/preegnees/gobox/pkg/client/errors"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+)
+
+const TOKEN = "secret"
+
+const PATH = "TestDir"
+
+// listen. Простой сервер в процессе: проверяет токен и пересылает сообщения в канал
+// listen. Заглушка сервера: в ch попадают сообщения после Hello, в hellos - сами Hello
+func listen(t *testing.T, addr string) (net.Listener, chan *wire.Message, chan *wire.Hello) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ch := make(chan *wire.Message, 16)
+	hellos := make(chan *wire.Hello, 16)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := wire.NewConn(c)
+				defer conn.Close()
+
+				m, err := conn.Recv()
+				if err != nil {
+					return
+				}
+				if m.Type != wire.TYPE_HELLO || m.Hello.Token != TOKEN {
+					conn.Send(&wire.Message{Type: wire.TYPE_REJECT, Code: wire.REJECT_UNAUTHORIZED})
+					return
+				}
+				conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: &wire.Welcome{
+					Protocol:    m.Hello.Protocol,
+					Hash:        m.Hello.Hashes[0],
+					Compression: m.Hello.Compressions[0],
+				}})
+				hellos <- m.Hello
+
+				for {
+					m, err := conn.Recv()
+					if err != nil {
+						return
+					}
+					ch <- m
+				}
+			}()
+		}
+	}()
+
+	return l, ch, hellos
+}
+
+func TestSendDeviationAndError(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	l, ch, _ := listen(t, "127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	c, err := New(ConfClient{
+		Ctx:         ctx,
+		Log:         logger,
+		Dir:         PATH,
+		Addr:        l.Addr().String(),
+		Token:       TOKEN,
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	info := pc.Info{Action: fsnotify.Create, Path: "file.txt", Hash: "hash"}
+	c.SendDeviation(info)
+	c.SendError(7, cancel, errors.New("boom"))
+
+	// события идут через очередь, а отчеты об ошибках напрямую, поэтому порядок не важен
+	gotInfo, gotErr := false, false
+	for i := 0; i < 2; i++ {
+		m := <-ch
+		switch {
+		case m.Type == wire.TYPE_INFO && reflect.DeepEqual(m.Info, info):
+			gotInfo = true
+		case m.Type == wire.TYPE_ERROR && m.Ident == 7 && m.Text == "boom":
+			gotErr = true
+		default:
+			t.Fatalf("unexpected message: %s", m.ToString())
+		}
+	}
+	if !gotInfo || !gotErr {
+		t.Fatalf("gotInfo: %v, gotErr: %v", gotInfo, gotErr)
+	}
+}
+
+func TestNeed(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	data := make([]byte, 6<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.WriteFile(filepath.Join(PATH, "file.bin"), data, 0666); err != nil {
+		panic(err)
+	}
+	_, _, chunks, err := chunker.Manifest(logrus.New(), ut.Hasher{}, filepath.Join(PATH, "file.bin"), chunker.ConfChunker{})
+	if err != nil {
+		panic(err)
+	}
+	if len(chunks) < 3 {
+		t.Fatalf("chunks: %d", len(chunks))
+	}
+
+	// сервер просит второй и последний куски
+	want := map[string]struct{}{chunks[1].Hash: {}, chunks[len(chunks)-1].Hash: {}}
+	offsets := map[string]int64{}
+	var offset int64
+	for _, c := range chunks {
+		offsets[c.Hash] = offset
+		offset += c.Size
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	got := make(chan options.Options, 4)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := wire.NewConn(c)
+		defer conn.Close()
+		m, err := conn.Recv()
+		if err != nil {
+			return
+		}
+		conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: &wire.Welcome{
+			Protocol:    m.Hello.Protocol,
+			Hash:        m.Hello.Hashes[0],
+			Compression: m.Hello.Compressions[0],
+		}})
+		conn.Send(&wire.Message{
+			Type:   wire.TYPE_NEED,
+			Info:   pc.Info{Path: "file.bin"},
+			Hashes: []string{chunks[1].Hash, chunks[len(chunks)-1].Hash},
+		})
+		for {
+			m, err := conn.Recv()
+			if err != nil {
+				return
+			}
+			if m.Type != wire.TYPE_CHUNK {
+				continue
+			}
+			opt := options.Options{Opt: m.Chunk}
+			options.DecodeOptions(context.TODO(), nil, &opt)
+			got <- opt
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	if _, err := New(ConfClient{
+		Ctx:   ctx,
+		Log:   logrus.New(),
+		Dir:   PATH,
+		Addr:  l.Addr().String(),
+		Token: TOKEN,
+	}); err != nil {
+		panic(err)
+	}
+
+	for len(want) > 0 {
+		select {
+		case opt := <-got:
+			if opt.Err != nil {
+				panic(opt.Err)
+			}
+			hash := chunker.Hash(opt.Buffer)
+			if _, ok := want[hash]; !ok || opt.FilePath != "file.bin" || opt.CurrentOffset != offsets[hash] {
+				t.Fatalf("unexpected chunk, path: %s, offset: %d", opt.FilePath, opt.CurrentOffset)
+			}
+			delete(want, hash)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing chunks: %d", len(want))
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	// сервер отвечает на первый TYPE_GET двумя кусками, а на второй обрывает соединение
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := wire.NewConn(c)
+		defer conn.Close()
+		m, err := conn.Recv()
+		if err != nil {
+			return
+		}
+		conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: &wire.Welcome{
+			Protocol:    m.Hello.Protocol,
+			Hash:        m.Hello.Hashes[0],
+			Compression: wire.COMPRESSION_NONE,
+		}})
+		for gets := 0; ; {
+			m, err := conn.Recv()
+			if err != nil {
+				return
+			}
+			if m.Type != wire.TYPE_GET {
+				continue
+			}
+			if gets++; gets > 1 {
+				return
+			}
+			for _, r := range m.Ranges {
+				opt := options.Options{FilePath: m.Info.Path, CurrentOffset: r.Start, Buffer: []byte("data")[:r.End-r.Start]}
+				options.EncodeOptions(context.TODO(), nil, &opt)
+				conn.Send(&wire.Message{Type: wire.TYPE_CHUNK, Chunk: opt.Opt})
+			}
+			conn.Send(&wire.Message{Type: wire.TYPE_SENT, Info: m.Info})
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	c, err := New(ConfClient{Ctx: ctx, Log: logrus.New(), Dir: PATH, Addr: l.Addr().String(), Token: TOKEN, MaxBackoff: time.Hour})
+	if err != nil {
+		panic(err)
+	}
+
+	got := map[int64]string{}
+	write := func(opt options.Options) error {
+		got[opt.CurrentOffset] = string(opt.Buffer)
+		return nil
+	}
+
+	info := pc.Info{Path: "file.txt", Hash: "h"}
+	if err := c.Fetch(info, []wire.Range{{Start: 0, End: 2}, {Start: 10, End: 14}}, write); err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(got, map[int64]string{0: "da", 10: "data"}) {
+		t.Fatalf("got: %v", got)
+	}
+
+	// обрыв соединения завершает загрузку с ошибкой, а не по таймауту
+	done := make(chan error, 1)
+	go func() { done <- c.Fetch(info, []wire.Range{{Start: 0, End: 4}}, write) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			panic("fetch without server answer succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		panic("fetch is not finished by connection loss")
+	}
+
+	if err := c.Fetch(info, nil, write); !errors.Is(err, ERROR__OFFLINE__) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	l, _, _ := listen(t, "127.0.0.1:0")
+
+	logger := logrus.New()
+
+	_, err := New(ConfClient{
+		Ctx:   context.TODO(),
+		Log:   logger,
+		Dir:   PATH,
+		Addr:  l.Addr().String(),
+		Token: "wrong",
+	})
+	if !errors.Is(err, ERROR__REJECTED__) || !errors.Is(err, ERROR__UNAUTHORIZED__) {
+		t.Fatalf("err: %v", err)
+	}
+
+	var rej *Rejection
+	if !errors.As(err, &rej) || rej.Code != wire.REJECT_UNAUTHORIZED {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	l, _, hellos := listen(t, "127.0.0.1:0")
+
+	logger := logrus.New()
+
+	devices := []string{}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.TODO())
+		c, err := New(ConfClient{
+			Ctx:   ctx,
+			Log:   logger,
+			Dir:   PATH,
+			Addr:  l.Addr().String(),
+			Token: TOKEN,
+			Root:  "team",
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		h := <-hellos
+		if h.Protocol != wire.PROTOCOL || h.Root != "team" || h.Device == "" ||
+			len(h.Hashes) == 0 || len(h.Compressions) == 0 {
+			t.Fatalf("hello: %s", h.ToString())
+		}
+		devices = append(devices, h.Device)
+
+		welcome, ok := c.Welcome()
+		if !ok || welcome.Hash != ut.HASH_SHA256 || welcome.Compression != wire.COMPRESSION_ZSTD {
+			t.Fatalf("welcome: %s, ok: %v", welcome.ToString(), ok)
+		}
+
+		cancel()
+		<-c.Done()
+	}
+
+	// идентификатор устройства сохраняется между запусками
+	if devices[0] != devices[1] {
+		t.Fatalf("devices: %v", devices)
+	}
+}
+
+func TestServerProtocolTooNew(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := wire.NewConn(c)
+		defer conn.Close()
+		if _, err := conn.Recv(); err == nil {
+			conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: &wire.Welcome{Protocol: wire.PROTOCOL + 1}})
+		}
+	}()
+
+	_, err = New(ConfClient{
+		Ctx:   context.TODO(),
+		Log:   logrus.New(),
+		Dir:   PATH,
+		Addr:  l.Addr().String(),
+		Token: TOKEN,
+	})
+
+	var rej *Rejection
+	if !errors.As(err, &rej) || rej.Code != wire.REJECT_PROTOCOL {
+		t.Fatalf("err: %v", err)
+	}
+	if errors.Is(err, ERROR__UNAUTHORIZED__) {
+		t.Fatalf("protocol rejection is unauthorized, err: %v", err)
+	}
+}
+
+func TestOfflineReplay(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	// занимаем свободный порт и сразу освобождаем его: сервер пока недоступен
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	c, err := New(ConfClient{
+		Ctx:           ctx,
+		Log:           logger,
+		Dir:           PATH,
+		Addr:          addr,
+		Token:         TOKEN,
+		MinBackoff:    20 * time.Millisecond,
+		MaxBackoff:    50 * time.Millisecond,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	c.SendDeviation(pc.Info{Action: fsnotify.Create, Path: "file1.txt"})
+	c.SendDeviation(pc.Info{Action: fsnotify.Write, Path: "file2.txt"})
+
+	if c.Backlog() != 2 {
+		t.Fatalf("backlog: %d", c.Backlog())
+	}
+
+	_, ch, _ := listen(t, addr)
+
+	for _, path := range []string{"file1.txt", "file2.txt"} {
+		select {
+		case m := <-ch:
+			if m.Info.Path != path {
+				t.Fatalf("unexpected message: %s", m.ToString())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not replayed", path)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.Backlog() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("backlog: %d", c.Backlog())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	// сервер принимает клиента и сразу рвет соединение, чтобы клиент переподключился
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := wire.NewConn(c)
+			if m, err := conn.Recv(); err == nil {
+				conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: &wire.Welcome{Protocol: m.Hello.Protocol}})
+			}
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	reconnected := make(chan struct{}, 4)
+	_, err = New(ConfClient{
+		Ctx:         ctx,
+		Log:         logger,
+		Dir:         PATH,
+		Addr:        l.Addr().String(),
+		Token:       TOKEN,
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  20 * time.Millisecond,
+		OnReconnect: func() { reconnected <- struct{}{} },
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+}
+
+func TestRevokedAfterStart(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	for _, revoke := range []string{"reject in session", "reject on reconnect"} {
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		defer l.Close()
+
+		// первое подключение сервер принимает, потом токен отзывают
+		go func(revoke string) {
+			for i := 0; ; i++ {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn := wire.NewConn(c)
+				if m, err := conn.Recv(); err == nil {
+					if i == 0 {
+						conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: &wire.Welcome{Protocol: m.Hello.Protocol}})
+					}
+					if i > 0 || revoke == "reject in session" {
+						conn.Send(&wire.Message{Type: wire.TYPE_REJECT, Code: wire.REJECT_UNAUTHORIZED, Text: "revoked"})
+					}
+				}
+				conn.Close()
+			}
+		}(revoke)
+
+		logger := logrus.New()
+
+		c, err := New(ConfClient{
+			Ctx:        context.TODO(),
+			Log:        logger,
+			Dir:        PATH,
+			Addr:       l.Addr().String(),
+			Token:      TOKEN,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 20 * time.Millisecond,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		// клиент не переподключается бесконечно, а останавливается
+		select {
+		case <-c.Done():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: client is not stopped", revoke)
+		}
+
+		err = c.Err()
+		if !errors.Is(err, ERROR__UNAUTHORIZED__) || !errors.Is(err, er.ERROR__WILL_CAUSE_A_STOP__) {
+			t.Fatalf("%s: err: %v", revoke, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+
+	b := backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	for i := 0; i < 10; i++ {
+		d := b.next()
+		if d > time.Second || d < 50*time.Millisecond {
+			t.Fatalf("attempt: %d, delay: %v", i, d)
+		}
+		if i >= 4 && d < 500*time.Millisecond {
+			t.Fatalf("attempt: %d, delay: %v is not capped at max", i, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > 100*time.Millisecond {
+		t.Fatalf("after reset delay: %v", d)
+	}
+}
+
+func TestBackoffConfig(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	// сервер недоступен: клиент создается офлайн, нужна только конфигурация
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cases := []struct {
+		min, max time.Duration
+		wantMin  time.Duration
+		wantMax  time.Duration
+	}{
+		{0, 0, MIN_BACKOFF, MAX_BACKOFF},
+		{time.Second, 10 * time.Second, time.Second, 10 * time.Second},
+		{2 * MAX_BACKOFF, 0, 2 * MAX_BACKOFF, 2 * MAX_BACKOFF},
+		{time.Second, time.Millisecond, time.Second, time.Second},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cl, err := New(ConfClient{Ctx: ctx, Log: logrus.New(), Dir: PATH, Addr: addr, MinBackoff: c.min, MaxBackoff: c.max})
+		if err != nil {
+			panic(err)
+		}
+		if cl.backoff.min != c.wantMin || cl.backoff.max != c.wantMax {
+			t.Fatalf("min: %v, max: %v, backoff: %v..%v", c.min, c.max, cl.backoff.min, cl.backoff.max)
+		}
+		cancel()
+		<-cl.Done()
+	}
+}
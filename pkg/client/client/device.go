@@ -0,0 +1,43 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DEVICE_FILE. Файл с идентификатором устройства в папке синхронизации, игнорируется по префиксу __gobox__
+const DEVICE_FILE = "__gobox__device"
+
+// loadDevice. Читает идентификатор устройства из dir, при первом запуске создает новый
+func loadDevice(dir string) (string, error) {
+
+	path := filepath.Join(dir, DEVICE_FILE)
+
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("[client.loadDevice()] (os.ReadFile) path: %s, err: %w;", path, err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("[client.loadDevice()] (rand.Read) err: %w;", err)
+	}
+	device := hex.EncodeToString(buf)
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(device+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("[client.loadDevice()] (os.WriteFile) path: %s, err: %w;", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("[client.loadDevice()] (os.Rename) path: %s, err: %w;", path, err)
+	}
+
+	return device, nil
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/preegnees/gobox/internal/options"
+	"github.com/preegnees/gobox/internal/wire"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+// FETCH_TIMEOUT. Сколько Fetch ждет следующего куска от сервера
+const FETCH_TIMEOUT = 30 * time.Second
+
+var (
+	// ERROR__OFFLINE__. Нет соединения с сервером
+	ERROR__OFFLINE__ = errors.New("client is offline")
+	// ERROR__NOT_SENT__. Сервер не отдал файл, например потому что у него уже другая версия
+	ERROR__NOT_SENT__ = errors.New("server did not send file ranges")
+)
+
+var _ IFetcher = (*Client)(nil)
+
+// IFetcher. Загрузка интервалов файла с сервера
+type IFetcher interface {
+	Fetch(pc.Info, []wire.Range, func(options.Options) error) error
+}
+
+// fetch. Загрузка, которая ждет куски от сервера
+type fetch struct {
+	conn  *wire.Conn
+	write func(options.Options) error
+	tick  chan struct{}
+	done  chan error
+}
+
+// finish. Завершает загрузку, первый результат выигрывает
+func (f *fetch) finish(err error) {
+
+	select {
+	case f.done <- err:
+	default:
+	}
+}
+
+// Fetch. Запрашивает у сервера интервалы ranges файла info.Path версии info.Hash (TYPE_GET)
+// и отдает полученные куски write. Возвращается, когда сервер отправил все интервалы.
+// Одновременно файл загружается только одним Fetch
+func (c *Client) Fetch(info pc.Info, ranges []wire.Range, write func(options.Options) error) error {
+
+	c.log.Debug(fmt.Sprintf("[client.Fetch()] path: %s, hash: %s, ranges: %d;", info.Path, info.Hash, len(ranges)))
+
+	// загрузка регистрируется под тем же мьютексом, под которым drop завершает загрузки соединения
+	c.mx.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mx.Unlock()
+		return fmt.Errorf("[client.Fetch()] path: %s, werr: %w;", info.Path, ERROR__OFFLINE__)
+	}
+	f := &fetch{conn: conn, write: write, tick: make(chan struct{}, 1), done: make(chan error, 1)}
+	if _, ok := c.fetches[info.Path]; ok {
+		c.mx.Unlock()
+		return fmt.Errorf("[client.Fetch()] path: %s, already fetching;", info.Path)
+	}
+	c.fetches[info.Path] = f
+	c.mx.Unlock()
+
+	defer func() {
+		c.mx.Lock()
+		delete(c.fetches, info.Path)
+		c.mx.Unlock()
+	}()
+
+	m := &wire.Message{Type: wire.TYPE_GET, Info: pc.Info{Path: info.Path, Hash: info.Hash}, Ranges: ranges}
+	if err := conn.Send(m); err != nil {
+		c.drop(conn)
+		return fmt.Errorf("[client.Fetch()] (conn.Send) path: %s, err: %w;", info.Path, err)
+	}
+
+	timer := time.NewTimer(FETCH_TIMEOUT)
+	defer timer.Stop()
+
+	for {
+		select {
+		case err := <-f.done:
+			return err
+		case <-f.tick:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(FETCH_TIMEOUT)
+		case <-timer.C:
+			return fmt.Errorf("[client.Fetch()] path: %s, no data for: %v;", info.Path, FETCH_TIMEOUT)
+		case <-c.ctx.Done():
+			return fmt.Errorf("[client.Fetch()] path: %s, err: %w;", info.Path, c.ctx.Err())
+		}
+	}
+}
+
+// chunk. Отдает кусок от сервера загрузке, которая его ждет. Вызывается из watch, поэтому куски пишутся по порядку
+func (c *Client) chunk(conn *wire.Conn, m *wire.Message) {
+
+	opt := options.Options{Opt: m.Chunk}
+	options.DecodeOptions(c.ctx, nil, &opt)
+	if opt.Err != nil {
+		c.log.Warn(fmt.Sprintf("[client.chunk()] (options.DecodeOptions) err: %v;", opt.Err))
+		return
+	}
+
+	f, ok := c.fetching(conn, opt.FilePath)
+	if !ok {
+		c.log.Warn(fmt.Sprintf("[client.chunk()] path: %s, nobody is fetching;", opt.FilePath))
+		return
+	}
+
+	if err := f.write(opt); err != nil {
+		f.finish(fmt.Errorf("[client.chunk()] path: %s, offset: %d, err: %w;", opt.FilePath, opt.CurrentOffset, err))
+		return
+	}
+
+	select {
+	case f.tick <- struct{}{}:
+	default:
+	}
+}
+
+// sent. Сервер закончил отвечать на TYPE_GET
+func (c *Client) sent(conn *wire.Conn, m *wire.Message) {
+
+	f, ok := c.fetching(conn, m.Info.Path)
+	if !ok {
+		return
+	}
+
+	if m.Text != "" {
+		f.finish(fmt.Errorf("[client.sent()] path: %s, text: %s, werr: %w;", m.Info.Path, m.Text, ERROR__NOT_SENT__))
+		return
+	}
+	f.finish(nil)
+}
+
+// fetching. Загрузка файла path по соединению conn
+func (c *Client) fetching(conn *wire.Conn, path string) (*fetch, bool) {
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	f, ok := c.fetches[path]
+	if !ok || f.conn != conn {
+		return nil, false
+	}
+	return f, true
+}
@@ -8,4 +8,7 @@ var (
 	ERROR__GET_ALL_FILES_FROM_DIR__ = errors.New("Err get files from folder (ioutil.ReadDir)")
 	ERROR__WILL_CAUSE_A_STOP__      = errors.New("Err will cause a stop")
 	ERROR__GET_METADATA__ = errors.New("err get metadata")
+	ERROR__HASH_MISMATCH__ = errors.New("err hash mismatch")
+	ERROR__READ_IGNORE_FILE__ = errors.New("err read ignore file")
+	ERROR__INVALID_PATH__ = errors.New("err path is not inside sync folder")
 )
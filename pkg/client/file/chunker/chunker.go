@@ -0,0 +1,225 @@
+package chunker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	er "github.com/preegnees/gobox/pkg/client/errors"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+)
+
+// Размеры кусков по умолчанию. Кусок целиком помещается в кадр (options.MAX_PAYLOAD),
+// а манифест файла в несколько гигабайт - в одно сообщение Info
+const (
+	MIN_SIZE = 256 << 10
+	AVG_SIZE = 1 << 20
+	MAX_SIZE = 4 << 20
+)
+
+var ERROR__BAD_SIZES__ = errors.New("err chunk sizes must be 0 < min < avg < max, avg a power of two")
+
+// gear. Случайные числа для rolling hash (FastCDC). Таблица должна совпадать у всех клиентов,
+// поэтому она строится из фиксированного seed, а не из crypto/rand
+var gear [256]uint64
+
+func init() {
+
+	// splitmix64
+	seed := uint64(0x676f626f78)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// ConfChunker. Размеры кусков, 0 - значение по умолчанию
+type ConfChunker struct {
+	Min int
+	Avg int
+	Max int
+}
+
+func (c *ConfChunker) ToString() string {
+
+	return fmt.Sprintf("min: %d, avg: %d, max: %d", c.Min, c.Avg, c.Max)
+}
+
+// Chunker. Делит поток на куски по содержимому (FastCDC с нормализацией):
+// граница куска зависит только от байт рядом с ней, поэтому вставка в начало файла
+// меняет один-два куска, а не все следующие
+type Chunker struct {
+	r      io.Reader
+	min    int
+	avg    int
+	max    int
+	maskS  uint64
+	maskL  uint64
+	buf    []byte
+	n      int
+	offset int64
+	eof    bool
+}
+
+// New. Создает Chunker для потока r
+func New(r io.Reader, cnf ConfChunker) (*Chunker, error) {
+
+	if cnf.Min == 0 && cnf.Avg == 0 && cnf.Max == 0 {
+		cnf = ConfChunker{Min: MIN_SIZE, Avg: AVG_SIZE, Max: MAX_SIZE}
+	}
+
+	if cnf.Min <= 0 || cnf.Min >= cnf.Avg || cnf.Avg >= cnf.Max || cnf.Avg&(cnf.Avg-1) != 0 {
+		return nil, fmt.Errorf("[chunker.New()] sizes: %s, werr: %w;", cnf.ToString(), ERROR__BAD_SIZES__)
+	}
+
+	// до средней длины граница ищется по более строгой маске, после - по более мягкой,
+	// так длины кусков собираются ближе к средней
+	n := bits.TrailingZeros(uint(cnf.Avg))
+
+	return &Chunker{
+		r:     r,
+		min:   cnf.Min,
+		avg:   cnf.Avg,
+		max:   cnf.Max,
+		maskS: mask(n + 2),
+		maskL: mask(n - 2),
+		buf:   make([]byte, cnf.Max),
+	}, nil
+}
+
+// Next. Следующий кусок и его смещение в потоке. В конце потока возвращает io.EOF
+func (c *Chunker) Next() (int64, []byte, error) {
+
+	for !c.eof && c.n < c.max {
+		read, err := c.r.Read(c.buf[c.n:])
+		c.n += read
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("[chunker.Next()] (r.Read) offset: %d, err: %w;", c.offset+int64(c.n), err)
+		}
+	}
+
+	if c.n == 0 {
+		return 0, nil, io.EOF
+	}
+
+	size := c.cut(c.buf[:c.n])
+	offset := c.offset
+
+	// кусок копируется, чтобы сдвинуть буфер под следующее чтение
+	chunk := make([]byte, size)
+	copy(chunk, c.buf[:size])
+	copy(c.buf, c.buf[size:c.n])
+	c.n -= size
+	c.offset += int64(size)
+
+	return offset, chunk, nil
+}
+
+// cut. Длина следующего куска в data
+func (c *Chunker) cut(data []byte) int {
+
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// mask. n старших бит: младшие биты gear hash зависят только от последних байт
+func mask(n int) uint64 {
+
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// Hash. Хеш куска, по нему сервер узнает, есть ли у него такой кусок. Всегда sha256, какой бы ни был алгоритм хеша файла
+func Hash(data []byte) string {
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Manifest. Хеш файла алгоритмом hasher (как ut.GetHash), размер и манифест кусков. Файл читается один раз
+func Manifest(log *logrus.Logger, hasher ut.Hasher, path string, cnf ConfChunker) (string, int64, []pc.Chunk, error) {
+
+	log.Debug(fmt.Sprintf("[chunker.Manifest()] path: %s, algo: %s;", path, hasher.Name()))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf(
+			"[chunker.Manifest()] (os.Open) fileName: %s, err: %v, werr: %w;",
+			path, err, er.ERROR__GET_METADATA__,
+		)
+	}
+	defer f.Close()
+
+	h := hasher.New()
+	c, err := New(io.TeeReader(f, h), cnf)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	// у пустого файла манифест nil, как и после json с omitempty
+	var chunks []pc.Chunk
+	var size int64
+	for {
+		_, data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, nil, fmt.Errorf(
+				"[chunker.Manifest()] (c.Next) fileName: %s, err: %v, werr: %w;",
+				path, err, er.ERROR__GET_METADATA__,
+			)
+		}
+		chunks = append(chunks, pc.Chunk{Hash: Hash(data), Size: int64(len(data))})
+		size += int64(len(data))
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	log.Debug(fmt.Sprintf("[chunker.Manifest()] file: %s, hash: %s, size: %d, chunks: %d;", path, hash, size, len(chunks)))
+
+	return hash, size, chunks, nil
+}
@@ -0,0 +1,146 @@
+package chunker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+)
+
+const PATH = "TestDir"
+
+var SMALL = ConfChunker{Min: 2 << 10, Avg: 8 << 10, Max: 32 << 10}
+
+func split(data []byte) [][]byte {
+
+	c, err := New(bytes.NewReader(data), SMALL)
+	if err != nil {
+		panic(err)
+	}
+
+	chunks := [][]byte{}
+	var next int64
+	for {
+		offset, chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			panic(err)
+		}
+		if offset != next {
+			panic("offsets are not contiguous")
+		}
+		next += int64(len(chunk))
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := split(data)
+
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		panic("chunks do not add up to data")
+	}
+	for i, c := range chunks {
+		if len(c) > SMALL.Max || (len(c) < SMALL.Min && i != len(chunks)-1) {
+			t.Fatalf("chunk: %d, size: %d", i, len(c))
+		}
+	}
+	if n := len(chunks); n < len(data)/SMALL.Max || n > len(data)/SMALL.Min {
+		t.Fatalf("chunks: %d", n)
+	}
+
+	// вставка в начало меняет только первые куски, остальные совпадают
+	shifted := split(append([]byte("inserted"), data...))
+
+	before := map[string]bool{}
+	for _, c := range chunks {
+		before[Hash(c)] = true
+	}
+	same := 0
+	for _, c := range shifted {
+		if before[Hash(c)] {
+			same++
+		}
+	}
+	if same < len(chunks)-2 {
+		t.Fatalf("same: %d of %d", same, len(chunks))
+	}
+}
+
+func TestBadSizes(t *testing.T) {
+
+	for _, cnf := range []ConfChunker{{Min: 8, Avg: 4, Max: 16}, {Min: 1, Avg: 6, Max: 16}, {Min: 1, Avg: 4, Max: 4}} {
+		if _, err := New(bytes.NewReader(nil), cnf); !errors.Is(err, ERROR__BAD_SIZES__) {
+			t.Fatalf("cnf: %s, err: %v", cnf.ToString(), err)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	data := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	file := filepath.Join(PATH, "file.bin")
+	if err := os.WriteFile(file, data, 0666); err != nil {
+		panic(err)
+	}
+
+	logger := logrus.New()
+
+	hash, size, chunks, err := Manifest(logger, ut.Hasher{}, file, SMALL)
+	if err != nil {
+		panic(err)
+	}
+	if hash != Hash(data) || size != int64(len(data)) {
+		t.Fatalf("hash: %s, size: %d", hash, size)
+	}
+
+	var total int64
+	for i, c := range split(data) {
+		if chunks[i].Hash != Hash(c) {
+			t.Fatalf("chunk: %d", i)
+		}
+		total += chunks[i].Size
+	}
+	if total != size {
+		t.Fatalf("total: %d, size: %d", total, size)
+	}
+
+	// другой алгоритм меняет только хеш файла, куски остаются sha256
+	blake3, _ := ut.NewHasher(ut.HASH_BLAKE3)
+	other, _, same, err := Manifest(logger, blake3, file, SMALL)
+	if err != nil {
+		panic(err)
+	}
+	if other == hash || !reflect.DeepEqual(same, chunks) {
+		t.Fatalf("hash: %s, chunks: %d", other, len(same))
+	}
+
+	empty := filepath.Join(PATH, "empty")
+	if err := os.WriteFile(empty, nil, 0666); err != nil {
+		panic(err)
+	}
+	if _, size, chunks, err := Manifest(logger, ut.Hasher{}, empty, SMALL); err != nil || size != 0 || chunks != nil {
+		t.Fatalf("size: %d, chunks: %v, err: %v", size, chunks, err)
+	}
+}
@@ -0,0 +1,150 @@
+package echo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TTL. Окно по умолчанию, в течение которого ждем события, вызванные самим клиентом
+const TTL = 5 * time.Second
+
+// expected. Ожидаемое изменение: маска событий, хеш нового содержимого ("" - любой) и срок
+type expected struct {
+	op       fsnotify.Op
+	hash     string
+	deadline time.Time
+}
+
+// Registry. Реестр ожидаемых изменений: saver записывает сюда то, что сейчас сделает с файлами,
+// а watcher не отправляет на сервер такие события обратно. Методы можно вызывать у nil реестра
+type Registry struct {
+	mx    sync.Mutex
+	ttl   time.Duration
+	items map[string][]expected
+}
+
+// New. Создает реестр, ttl <= 0 - значение по умолчанию
+func New(ttl time.Duration) *Registry {
+
+	if ttl <= 0 {
+		ttl = TTL
+	}
+
+	return &Registry{
+		ttl:   ttl,
+		items: make(map[string][]expected),
+	}
+}
+
+// Expect. Ожидать по пути path одно событие из маски op. Если hash не пустой,
+// подавляется только событие, после которого у файла именно такой хеш.
+// Запись (fsnotify.Write) подавляется только по совпавшему хешу: пустой хеш не скроет изменение пользователя
+func (r *Registry) Expect(path string, op fsnotify.Op, hash string) {
+
+	if r == nil {
+		return
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.items[path] = append(r.items[path], expected{op: op, hash: hash, deadline: time.Now().Add(r.ttl)})
+}
+
+// Withdraw. Отменяет ожидание, записанное Expect с теми же аргументами: изменение не случилось,
+// и событие пользователя по этому пути не должно подавляться
+func (r *Registry) Withdraw(path string, op fsnotify.Op, hash string) {
+
+	if r == nil {
+		return
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	items := r.items[path]
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i].op == op && items[i].hash == hash {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+
+	if len(items) == 0 {
+		delete(r.items, path)
+	} else {
+		r.items[path] = items
+	}
+}
+
+// Suppress. Проверяет, ожидалось ли событие, и вычеркивает совпавшее ожидание.
+// Если операция saver дала лишнее событие, на сервер уйдет состояние, которое у него уже есть
+func (r *Registry) Suppress(path string, op fsnotify.Op, hash string) bool {
+
+	if r == nil {
+		return false
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	now := time.Now()
+	found := false
+	left := r.items[path][:0]
+	for _, e := range r.items[path] {
+		if now.After(e.deadline) {
+			continue
+		}
+		if !found && match(e, op, hash) {
+			found = true
+			continue
+		}
+		left = append(left, e)
+	}
+
+	if len(left) == 0 {
+		delete(r.items, path)
+	} else {
+		r.items[path] = left
+	}
+
+	return found
+}
+
+// match. Подходит ли событие под ожидание
+func match(e expected, op fsnotify.Op, hash string) bool {
+
+	if op&e.op == 0 {
+		return false
+	}
+
+	if e.hash == "" {
+		return !op.Has(fsnotify.Write)
+	}
+
+	return e.hash == hash
+}
+
+// Len. Сколько изменений сейчас ожидается
+func (r *Registry) Len() int {
+
+	if r == nil {
+		return 0
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, items := range r.items {
+		for _, e := range items {
+			if !now.After(e.deadline) {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,50 @@
+package echo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSuppress(t *testing.T) {
+
+	r := New(time.Minute)
+
+	// ожидание вычеркивается после первого совпадения
+	r.Expect("a.txt", fsnotify.Create|fsnotify.Write, "h1")
+	if !r.Suppress("a.txt", fsnotify.Create, "h1") {
+		panic("expected event is not suppressed")
+	}
+	if r.Suppress("a.txt", fsnotify.Write, "h1") {
+		panic("expectation is not consumed")
+	}
+
+	// запись с другим содержимым - изменение пользователя
+	r.Expect("a.txt", fsnotify.Create|fsnotify.Write, "h1")
+	if r.Suppress("a.txt", fsnotify.Write, "h2") {
+		panic("write with other hash is suppressed")
+	}
+
+	// без хеша запись не подавляется, остальные события - да
+	r.Expect("b.txt", fsnotify.Remove|fsnotify.Write, "")
+	if r.Suppress("b.txt", fsnotify.Write, "h3") {
+		panic("write is suppressed without hash")
+	}
+	if !r.Suppress("b.txt", fsnotify.Remove, "") {
+		panic("remove is not suppressed")
+	}
+
+	r.Withdraw("a.txt", fsnotify.Create|fsnotify.Write, "h1")
+	if r.Len() != 0 {
+		t.Fatalf("len: %d", r.Len())
+	}
+
+	// просроченное ожидание ничего не подавляет
+	short := New(time.Millisecond)
+	short.Expect("c.txt", fsnotify.Remove, "")
+	time.Sleep(5 * time.Millisecond)
+	if short.Suppress("c.txt", fsnotify.Remove, "") {
+		panic("expired expectation suppressed event")
+	}
+}
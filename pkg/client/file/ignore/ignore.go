@@ -0,0 +1,289 @@
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	er "github.com/preegnees/gobox/pkg/client/errors"
+)
+
+// FILE. Имя файла с правилами. Может лежать в любой папке, правила действуют на эту папку и ниже
+const FILE = ".goboxignore"
+
+// PREFIX. Служебные файлы клиента (временные файлы saver, очередь) игнорируются всегда
+const PREFIX = "__gobox__"
+
+// ConfIgnore. Конфигурация правил игнорирования. Dir - корень синхронизируемой папки
+type ConfIgnore struct {
+	Log *logrus.Logger
+	Dir string
+}
+
+func (c *ConfIgnore) ToString() string {
+
+	return fmt.Sprintf("levelLog: %s, dir: %s", c.Log.Level, c.Dir)
+}
+
+// rule. Одна строка файла правил.
+// base - папка файла правил относительно корня (через "/", "" для корня),
+// segs - шаблон, разбитый по "/", относительно base
+type rule struct {
+	base    string
+	segs    []string
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher. Правила игнорирования в стиле gitignore.
+// Файлы правил читаются лениво и кешируются по папкам, Reload сбрасывает кеш.
+// Не потокобезопасен: каждый компонент держит свой Matcher
+type Matcher struct {
+	log   *logrus.Logger
+	dir   string
+	rules map[string][]rule
+}
+
+// New. Создает Matcher для папки cnf.Dir
+func New(cnf ConfIgnore) (*Matcher, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[ignore.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[ignore.New()] struct cnf: %v;", cnf.ToString()))
+
+	return &Matcher{
+		log:   cnf.Log,
+		dir:   cnf.Dir,
+		rules: make(map[string][]rule),
+	}, nil
+}
+
+// Reload. Забывает прочитанные правила папки dir (например, после изменения ее файла правил)
+func (m *Matcher) Reload(dir string) {
+
+	rel, ok := m.rel(dir)
+	if !ok {
+		return
+	}
+
+	m.log.Debug(fmt.Sprintf("[ignore.Reload()] dir: %s;", rel))
+
+	delete(m.rules, rel)
+}
+
+// IsRulesFile. Является ли путь файлом правил
+func IsRulesFile(p string) bool {
+
+	return filepath.Base(p) == FILE
+}
+
+// Match. Нужно ли игнорировать путь p (абсолютный или относительно рабочей папки, как у fsnotify).
+// Если проигнорирована одна из родительских папок, путь игнорируется, как и в git.
+// Ошибка чтения файла правил не мешает работе: такой файл пропускается
+func (m *Matcher) Match(p string, isDir bool) bool {
+
+	rel, ok := m.rel(p)
+	if !ok || rel == "" {
+		return false
+	}
+
+	segs := strings.Split(rel, "/")
+
+	for i := range segs {
+		if strings.HasPrefix(segs[i], PREFIX) {
+			m.log.Debug(fmt.Sprintf("[ignore.Match()] path: %s has prefix: %s;", rel, PREFIX))
+			return true
+		}
+	}
+
+	for i := 1; i <= len(segs); i++ {
+		// все, кроме последнего, - родительские папки
+		dir := i < len(segs) || isDir
+		if m.match(segs[:i], dir) {
+			m.log.Debug(fmt.Sprintf("[ignore.Match()] path: %s ignored by: %s;", rel, strings.Join(segs[:i], "/")))
+			return true
+		}
+	}
+
+	return false
+}
+
+// match. Применяет правила всех папок от корня до родителя пути, побеждает последнее подошедшее
+func (m *Matcher) match(segs []string, isDir bool) bool {
+
+	ignored := false
+	for i := 0; i < len(segs); i++ {
+		base := strings.Join(segs[:i], "/")
+		for _, r := range m.load(base) {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if matchSegs(r.segs, segs[i:]) {
+				ignored = !r.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// load. Возвращает правила папки base (относительно корня), читая файл правил при первом обращении
+func (m *Matcher) load(base string) []rule {
+
+	if rules, ok := m.rules[base]; ok {
+		return rules
+	}
+
+	file := filepath.Join(m.dir, filepath.FromSlash(base), FILE)
+	rules, err := parse(file, base)
+	if err != nil {
+		m.log.Error(err)
+	}
+
+	m.rules[base] = rules
+
+	return rules
+}
+
+// rel. Путь относительно корня через "/". false, если путь вне корня
+func (m *Matcher) rel(p string) (string, bool) {
+
+	rel, err := filepath.Rel(m.dir, p)
+	if err != nil {
+		return "", false
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		return "", true
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// parse. Читает файл правил. Отсутствие файла - не ошибка
+func parse(file string, base string) ([]rule, error) {
+
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf(
+			"[ignore.parse()] (os.Open) path: %s, err: %v, werr: %w;",
+			file, err, er.ERROR__READ_IGNORE_FILE__,
+		)
+	}
+	defer f.Close()
+
+	rules := []rule{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if r, ok := parseLine(sc.Text(), base); ok {
+			rules = append(rules, r)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return rules, fmt.Errorf(
+			"[ignore.parse()] (sc.Scan) path: %s, err: %v, werr: %w;",
+			file, err, er.ERROR__READ_IGNORE_FILE__,
+		)
+	}
+
+	return rules, nil
+}
+
+// parseLine. Разбирает одну строку. false для пустых строк и комментариев
+func parseLine(line string, base string) (rule, bool) {
+
+	line = strings.TrimSuffix(line, "\r")
+	line = trimSpaces(line)
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false
+	}
+
+	r := rule{base: base}
+
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return rule{}, false
+	}
+
+	// шаблон со "/" в начале или середине привязан к папке файла правил,
+	// без него - совпадает с именем на любой глубине
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+
+	r.segs = strings.Split(line, "/")
+
+	return r, true
+}
+
+// trimSpaces. Убирает пробелы в конце строки, кроме экранированных "\ "
+func trimSpaces(line string) string {
+
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+
+	return line
+}
+
+// matchSegs. Сопоставляет шаблон и путь по частям. "**" - любое число папок,
+// "**" в конце шаблона - все внутри папки, но не сама папка
+func matchSegs(pat []string, name []string) bool {
+
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+
+	if pat[0] == "**" {
+		if len(pat) == 1 {
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchSegs(pat[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if ok, err := path.Match(pat[0], name[0]); err != nil || !ok {
+		return false
+	}
+
+	return matchSegs(pat[1:], name[1:])
+}
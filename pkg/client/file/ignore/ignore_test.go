@@ -0,0 +1,131 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const PATH = "TestDir"
+
+func write(path string, data string) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+		panic(err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	write(filepath.Join(PATH, FILE), `
+# комментарий
+node_modules/
+/build
+*.swp
+*~
+logs/**
+!logs/keep.log
+docs/**/draft.md
+\#hash
+trailing\ 
+`)
+	write(filepath.Join(PATH, "sub", FILE), `
+*.log
+!important.log
+/local
+`)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	m, err := New(ConfIgnore{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	cases := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"templates/index.html", false, false},
+		{"tmp", true, false},
+		{"TEMP.txt", false, false},
+		{"__gobox__queue", false, true},
+		{"a/__gobox__file.txt", false, true},
+		{FILE, false, false},
+
+		{"node_modules", true, true},
+		{"a/b/node_modules", true, true},
+		{"a/b/node_modules/pkg/index.js", false, true},
+		{"node_modules", false, false},
+
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"src/build", true, false},
+
+		{"main.go.swp", false, true},
+		{"src/.main.go.swp", false, true},
+		{"notes.txt~", false, true},
+
+		{"logs", true, false},
+		{"logs/a.log", false, true},
+		{"logs/keep.log", false, false},
+
+		{"docs/draft.md", false, true},
+		{"docs/a/b/draft.md", false, true},
+		{"draft.md", false, false},
+
+		{"#hash", false, true},
+		{"trailing ", false, true},
+
+		{"sub/app.log", false, true},
+		{"sub/deep/app.log", false, true},
+		{"sub/important.log", false, false},
+		{"app.log", false, false},
+		{"sub/local", false, true},
+		{"sub/deep/local", false, false},
+	}
+
+	for _, c := range cases {
+		if got := m.Match(filepath.Join(PATH, filepath.FromSlash(c.path)), c.isDir); got != c.want {
+			t.Errorf("path: %s, isDir: %v, got: %v, want: %v", c.path, c.isDir, got, c.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	write(filepath.Join(PATH, "file.txt"), "")
+
+	logger := logrus.New()
+
+	m, err := New(ConfIgnore{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	file := filepath.Join(PATH, "file.txt")
+	if m.Match(file, false) {
+		panic("ignored without rules")
+	}
+
+	write(filepath.Join(PATH, FILE), "*.txt\n")
+	if m.Match(file, false) {
+		panic("rules must be cached until Reload")
+	}
+
+	m.Reload(PATH)
+	if !m.Match(file, false) {
+		panic("not ignored after Reload")
+	}
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	er "github.com/preegnees/gobox/pkg/client/errors"
+)
+
+// Пути в Info (Path, OldPath) всегда относительно папки синхронизации, через "/" и в форме Unicode NFC:
+// на разных машинах папка лежит в разных местах, а macOS отдает имена в NFD
+
+// Normalize. Приводит относительный путь к виду для Info. Пустой путь, корень,
+// абсолютный путь и выход за корень через ".." - ошибка
+func Normalize(rel string) (string, error) {
+
+	if rel == "" {
+		return "", fmt.Errorf("[protocol.Normalize()] path is empty, werr: %w;", er.ERROR__INVALID_PATH__)
+	}
+
+	if path.IsAbs(rel) || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return "", fmt.Errorf("[protocol.Normalize()] path: %s is absolute, werr: %w;", rel, er.ERROR__INVALID_PATH__)
+	}
+
+	clean := path.Clean(norm.NFC.String(rel))
+
+	if clean == "." {
+		return "", fmt.Errorf("[protocol.Normalize()] path: %s is root, werr: %w;", rel, er.ERROR__INVALID_PATH__)
+	}
+
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("[protocol.Normalize()] path: %s escapes root, werr: %w;", rel, er.ERROR__INVALID_PATH__)
+	}
+
+	return clean, nil
+}
+
+// ToRel. Локальный путь (как у fsnotify) -> путь для Info относительно root
+func ToRel(root string, local string) (string, error) {
+
+	rel, err := filepath.Rel(root, local)
+	if err != nil {
+		return "", fmt.Errorf(
+			"[protocol.ToRel()] (filepath.Rel) root: %s, path: %s, err: %v, werr: %w;",
+			root, local, err, er.ERROR__INVALID_PATH__,
+		)
+	}
+
+	return Normalize(filepath.ToSlash(rel))
+}
+
+// ToLocal. Путь из Info -> локальный путь внутри root
+func ToLocal(root string, rel string) (string, error) {
+
+	clean, err := Normalize(rel)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
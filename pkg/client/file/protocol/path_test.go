@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	er "github.com/preegnees/gobox/pkg/client/errors"
+)
+
+func TestNormalize(t *testing.T) {
+
+	cases := map[string]string{
+		"file.txt":     "file.txt",
+		"a/b/../c.txt": "a/c.txt",
+		"./a//b/":      "a/b",
+		// NFD (macOS) -> NFC
+		"cafe\u0301/no\u0308": "caf\u00e9/n\u00f6",
+	}
+
+	for in, want := range cases {
+		got, err := Normalize(in)
+		if err != nil {
+			t.Fatalf("path: %q, err: %v", in, err)
+		}
+		if got != want {
+			t.Fatalf("path: %q, got: %q, want: %q", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"", ".", "..", "../a", "a/../../b", "/etc/passwd"} {
+		if _, err := Normalize(in); !errors.Is(err, er.ERROR__INVALID_PATH__) {
+			t.Fatalf("path: %q, err: %v", in, err)
+		}
+	}
+}
+
+func TestToRelToLocal(t *testing.T) {
+
+	root := filepath.Join("home", "user", "box")
+	local := filepath.Join(root, "folder", "file.txt")
+
+	rel, err := ToRel(root, local)
+	if err != nil {
+		panic(err)
+	}
+	if rel != "folder/file.txt" {
+		t.Fatalf("rel: %s", rel)
+	}
+
+	back, err := ToLocal(root, rel)
+	if err != nil {
+		panic(err)
+	}
+	if back != local {
+		t.Fatalf("local: %s", back)
+	}
+
+	if _, err := ToRel(root, filepath.Join("home", "user", "other.txt")); !errors.Is(err, er.ERROR__INVALID_PATH__) {
+		t.Fatalf("path outside root, err: %v", err)
+	}
+	if _, err := ToLocal(root, "../other.txt"); !errors.Is(err, er.ERROR__INVALID_PATH__) {
+		t.Fatalf("path outside root, err: %v", err)
+	}
+}
@@ -9,19 +9,34 @@ import (
 // UPLOAD_CODE. Код, который соответсвует о том, что информация будет о файле или папки
 const UPLOAD_CODE = 100
 
-// Info. Информация, которая отправляется на сервер при просмотре файловой директории
+// Info. Информация, которая отправляется на сервер при просмотре файловой директории.
+// OldPath заполняется только для перемещения (Action = fsnotify.Rename).
+// Size и Chunks (манифест) заполняются для содержимого файла: по манифесту сервер
+// просит только те куски, которых у него нет.
+// HashAlgo - алгоритм, которым посчитан Hash (ut.HASH_*), пустой у записей старых версий - это sha256.
+// Хеши кусков в манифесте всегда sha256: по ним сервер хранит куски
 type Info struct {
 	Action   fsnotify.Op
+	OldPath  string
 	Path     string
 	ModTime  int64
 	Hash     string
 	IsFolder bool
+	HashAlgo string  `json:",omitempty"`
+	Size     int64   `json:",omitempty"`
+	Chunks   []Chunk `json:",omitempty"`
 }
 
-// ToString. Info struct в строку
+// Chunk. Кусок файла в манифесте. Смещение куска - сумма размеров предыдущих
+type Chunk struct {
+	Hash string
+	Size int64
+}
+
+// ToString. Info struct в строку, от манифеста только количество кусков
 func (i *Info) ToString() string {
 	return fmt.Sprintf(
-		"Action: %d; Path: %s; ModTime: %d; Hash: %s; IsFolder: %v;",
-		i.Action, i.Path, i.ModTime, i.Hash, i.IsFolder,
+		"Action: %d; OldPath: %s; Path: %s; ModTime: %d; Hash: %s; HashAlgo: %s; IsFolder: %v; Size: %d; Chunks: %d;",
+		i.Action, i.OldPath, i.Path, i.ModTime, i.Hash, i.HashAlgo, i.IsFolder, i.Size, len(i.Chunks),
 	)
 }
@@ -0,0 +1,138 @@
+package saver
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+// Delta. Как Resume, но новая версия файла (info с манифестом) сначала собирается из старой, которая уже лежит на диске.
+// Старая версия остается под своим именем до Commit, блоки читаются прямо из нее. Она режется тем же chunker, что и у отправителя, - это сигнатуры ее блоков.
+// Блоки, которые есть в манифесте, копируются во временный файл на свои новые места и считаются полученными,
+// поэтому у сервера нужно запросить только отличающиеся интервалы
+func (s *saver) Delta(rel string, info pc.Info) ([]Range, error) {
+
+	path, err := s.local(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.Lock()
+
+	tmp := s.getPath(path)
+
+	// начатую загрузку той же версии продолжает Resume, старая версия ей не нужна
+	if p, err := loadProgress(tmp); err == nil && p.Hash == info.Hash && p.Size == info.Size {
+		defer s.mx.Unlock()
+		missing, err := s.resume(path, info.Size, info.Hash, info.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		s.progress[tmp].HashAlgo = info.HashAlgo
+		return missing, nil
+	}
+
+	if _, err := s.resume(path, info.Size, info.Hash, info.ModTime); err != nil {
+		s.mx.Unlock()
+		return nil, err
+	}
+
+	p := s.progress[tmp]
+	p.HashAlgo = info.HashAlgo
+
+	dst, err := s.acquire(tmp)
+	s.mx.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("[saver.Delta()] path: %s, err: %w;", path, err)
+	}
+
+	// чтение старой версии - долгая часть, она идет без мьютекса, чтобы не останавливать другие загрузки
+	seeded, err := s.seed(path, tmp, dst, info.Chunks)
+	if err != nil {
+		// без старой версии файл просто загрузится целиком
+		s.log.Warn(fmt.Sprintf("[saver.Delta()] path: %s, err: %v;", path, err))
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// файл закрыли (Close, Commit), пока копировались блоки: его прогресс уже забыт
+	if _, ok := s.active[tmp]; !ok || s.progress[tmp] != p {
+		return nil, fmt.Errorf("[saver.Delta()] path: %s, file is closed while seeding;", path)
+	}
+	s.release(tmp)
+
+	for _, r := range seeded {
+		p.add(r)
+	}
+	s.received[tmp] = p.received()
+
+	if err := s.persist(tmp, p); err != nil {
+		return nil, err
+	}
+
+	missing := p.missing()
+
+	s.log.Debug(fmt.Sprintf(
+		"[saver.Delta()] path: %s, size: %d, reused: %d, missing ranges: %d;",
+		path, info.Size, p.received(), len(missing),
+	))
+
+	return missing, nil
+}
+
+// seed. Копирует из старой версии base во временный файл tmp (dst уже захвачен acquire) блоки, которые есть в манифесте chunks,
+// и возвращает интервалы, которые они заняли. Если старой версии нет, ничего не копируется. Вызывается без s.mx
+func (s *saver) seed(base string, tmp string, dst *os.File, chunks []pc.Chunk) ([]Range, error) {
+
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	// где в новой версии стоит каждый блок
+	offsets := make(map[string][]int64, len(chunks))
+	var offset int64
+	for _, c := range chunks {
+		offsets[c.Hash] = append(offsets[c.Hash], offset)
+		offset += c.Size
+	}
+
+	src, err := os.Open(base)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[saver.seed()] (os.Open) path: %s, err: %w;", base, err)
+	}
+	defer src.Close()
+
+	c, err := chunker.New(src, chunker.ConfChunker{})
+	if err != nil {
+		return nil, err
+	}
+
+	var seeded []Range
+	for len(offsets) > 0 {
+		_, data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return seeded, fmt.Errorf("[saver.seed()] (c.Next) path: %s, err: %w;", base, err)
+		}
+
+		hash := chunker.Hash(data)
+		for _, at := range offsets[hash] {
+			if _, err := dst.WriteAt(data, at); err != nil {
+				return seeded, fmt.Errorf("[saver.seed()] (dst.WriteAt) path: %s, offset: %d, err: %w;", tmp, at, err)
+			}
+			seeded = append(seeded, Range{Start: at, End: at + int64(len(data))})
+		}
+		delete(offsets, hash)
+	}
+
+	return seeded, nil
+}
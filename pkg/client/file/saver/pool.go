@@ -0,0 +1,129 @@
+package saver
+
+import (
+	"fmt"
+	"os"
+)
+
+// MAX_OPEN. Сколько файлов saver держит открытыми одновременно по умолчанию
+const MAX_OPEN = 256
+
+// Пул открытых файлов. Все функции ниже вызываются под s.mx.
+// Файл из active может быть закрыт вытеснением (LRU) и тогда открывается заново при следующем обращении.
+// Файл, в который сейчас пишут (refs > 0), не вытесняется
+
+// put. Кладет открытый файл в пул
+func (s *saver) put(tmp string, f *os.File) {
+
+	if oldf, ok := s.storage[tmp]; ok && oldf != f {
+		oldf.Close()
+	}
+
+	s.storage[tmp] = f
+	s.active[tmp] = struct{}{}
+	s.touch(tmp)
+	s.evict()
+}
+
+// acquire. Возвращает открытый файл и запрещает его вытеснять до release
+func (s *saver) acquire(tmp string) (*os.File, error) {
+
+	if _, ok := s.active[tmp]; !ok {
+		return nil, fmt.Errorf("[saver.acquire()] path: %s, file is not open;", tmp)
+	}
+
+	f, ok := s.storage[tmp]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(tmp, os.O_RDWR, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("[saver.acquire()] (os.OpenFile) path: %s, err: %w;", tmp, err)
+		}
+		s.log.Debug(fmt.Sprintf("[saver.acquire()] reopen path: %s;", tmp))
+		s.storage[tmp] = f
+	}
+
+	s.refs[tmp]++
+	s.touch(tmp)
+	s.evict()
+
+	return f, nil
+}
+
+// release. Разрешает вытеснять файл
+func (s *saver) release(tmp string) {
+
+	if s.refs[tmp] <= 1 {
+		delete(s.refs, tmp)
+	} else {
+		s.refs[tmp]--
+	}
+	s.evict()
+}
+
+// touch. Помечает файл как использованный последним
+func (s *saver) touch(tmp string) {
+
+	if e, ok := s.elems[tmp]; ok {
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.elems[tmp] = s.lru.PushFront(tmp)
+}
+
+// evict. Закрывает давно не используемые файлы, пока их больше maxOpen
+func (s *saver) evict() {
+
+	for e := s.lru.Back(); e != nil && len(s.storage) > s.maxOpen; {
+		prev := e.Prev()
+		tmp := e.Value.(string)
+		if s.refs[tmp] == 0 {
+			if f, ok := s.storage[tmp]; ok {
+				f.Close()
+				delete(s.storage, tmp)
+			}
+			s.lru.Remove(e)
+			delete(s.elems, tmp)
+		}
+		e = prev
+	}
+}
+
+// forget. Убирает файл из пула, возвращает открытый дескриптор, если он был
+func (s *saver) forget(tmp string) (*os.File, bool) {
+
+	f, ok := s.storage[tmp]
+
+	delete(s.storage, tmp)
+	delete(s.active, tmp)
+	delete(s.refs, tmp)
+	delete(s.received, tmp)
+	delete(s.progress, tmp)
+	if e, ok := s.elems[tmp]; ok {
+		s.lru.Remove(e)
+		delete(s.elems, tmp)
+	}
+
+	return f, ok
+}
+
+// sync. Сбрасывает временный файл на диск. Вытесненный из пула файл открывается на время Sync:
+// после Close его данные могут оставаться только в кеше ОС
+func (s *saver) sync(tmp string) error {
+
+	f, ok := s.storage[tmp]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(tmp, os.O_RDWR, 0777)
+		if err != nil {
+			return fmt.Errorf("[saver.sync()] (os.OpenFile) path: %s, err: %w;", tmp, err)
+		}
+		defer f.Close()
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("[saver.sync()] (f.Sync) path: %s, err: %w;", tmp, err)
+	}
+
+	return nil
+}
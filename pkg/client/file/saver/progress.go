@@ -0,0 +1,150 @@
+package saver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// STATE_SUFFIX. Суффикс файла с прогрессом загрузки, лежит рядом с временным файлом
+const STATE_SUFFIX = ".state"
+
+// SAVE_EVERY. Прогресс сбрасывается на диск не реже, чем через столько байт
+const SAVE_EVERY = 4 << 20
+
+// Range. Полуинтервал байт [Start, End)
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// Download. Незавершенная загрузка: что ждем и каких байт не хватает
+type Download struct {
+	Path    string
+	Size    int64
+	Hash    string
+	ModTime int64
+	Missing []Range
+}
+
+// progress. Прогресс загрузки одного файла, хранится в tmp + STATE_SUFFIX
+type progress struct {
+	Size     int64
+	Hash     string
+	HashAlgo string `json:",omitempty"`
+	ModTime  int64
+	Ranges   []Range
+	unsaved  int64
+}
+
+// add. Добавляет полученный интервал и склеивает пересекающиеся
+func (p *progress) add(r Range) {
+
+	if r.End <= r.Start {
+		return
+	}
+
+	ranges := append(p.Ranges, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := ranges[:1]
+	for _, cur := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if cur.Start <= last.End {
+			if cur.End > last.End {
+				last.End = cur.End
+			}
+			continue
+		}
+		merged = append(merged, cur)
+	}
+
+	p.Ranges = merged
+	p.unsaved += r.End - r.Start
+}
+
+// received. Сколько уникальных байт получено
+func (p *progress) received() int64 {
+
+	var n int64
+	for _, r := range p.Ranges {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// missing. Интервалы, которых еще нет, в пределах размера файла
+func (p *progress) missing() []Range {
+
+	var res []Range
+	var pos int64
+	for _, r := range p.Ranges {
+		if r.Start > pos {
+			res = append(res, Range{Start: pos, End: min64(r.Start, p.Size)})
+		}
+		if r.End > pos {
+			pos = r.End
+		}
+		if pos >= p.Size {
+			break
+		}
+	}
+	if pos < p.Size {
+		res = append(res, Range{Start: pos, End: p.Size})
+	}
+	return res
+}
+
+// save. Атомарно записывает прогресс рядом с временным файлом
+func (p *progress) save(tmp string) error {
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("[saver.save()] (json.Marshal) path: %s, err: %w;", tmp, err)
+	}
+
+	state := tmp + STATE_SUFFIX
+	if err := os.WriteFile(state+".tmp", data, 0666); err != nil {
+		return fmt.Errorf("[saver.save()] (os.WriteFile) path: %s, err: %w;", state, err)
+	}
+	if err := os.Rename(state+".tmp", state); err != nil {
+		return fmt.Errorf("[saver.save()] (os.Rename) path: %s, err: %w;", state, err)
+	}
+
+	p.unsaved = 0
+	return nil
+}
+
+// persist. Сбрасывает временный файл на диск и только потом записывает прогресс:
+// иначе после сбоя питания прогресс отметит полученными байты, которых в файле нет. Вызывается под s.mx
+func (s *saver) persist(tmp string, p *progress) error {
+
+	if err := s.sync(tmp); err != nil {
+		return err
+	}
+
+	return p.save(tmp)
+}
+
+// loadProgress. Читает прогресс временного файла
+func loadProgress(tmp string) (*progress, error) {
+
+	data, err := os.ReadFile(tmp + STATE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &progress{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("[saver.loadProgress()] (json.Unmarshal) path: %s, err: %w;", tmp, err)
+	}
+	return p, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
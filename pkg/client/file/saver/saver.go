@@ -11,159 +11,632 @@ package saver
 */
 
 import (
+	"container/list"
 	"context"
-	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/options"
+	er "github.com/preegnees/gobox/pkg/client/errors"
+	"github.com/preegnees/gobox/pkg/client/file/echo"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
 )
 
-// не забыить, что нужно при каждом обращении файала писать полный путь (в клиент приходят относительные пути) 
+// Все пути в методах ISaver - пути из pc.Info: относительно папки синхронизации (Dir), через "/".
+// Внутри они сразу переводятся в локальные (см. local)
 
 const PREFFIX = "__gobox__"
 
+// Данный идентификатор привязан к данному пакету, и если произойдет ошибка то можно перезапустить сервис (пакет)
+const IDENTIFIER = 3
+
 var _ ISaver = (*saver)(nil)
 
 type ISaver interface {
 	Open(string) error
 	Close(string) error
-	Write(pc.Info) error
+	CloseAll() error
+	Write(options.Options) error
+	Received(string) int64
+	Commit(string, string, int64) error
+	Resume(string, int64, string, int64) ([]Range, error)
+	Delta(string, pc.Info) ([]Range, error)
+	Downloads() ([]Download, error)
 	CreateFolder(string) error
+	Remove(string) error
+	RemoveFolder(string, bool) error
+	Rename(string, string) error
 }
 
+// ConfSaver. Dir - папка синхронизации, в ней ищутся незавершенные загрузки.
+// MaxOpen - сколько файлов можно держать открытыми одновременно.
+// Echo - реестр, через который watcher узнает об изменениях, сделанных saver.
+// Hasher - алгоритм хеша файлов у watcher, по умолчанию sha256
 type ConfSaver struct {
-	Ctx    context.Context
-	Cancel context.CancelFunc
-	Log    *logrus.Logger
+	Ctx     context.Context
+	Cancel  context.CancelFunc
+	Log     *logrus.Logger
+	Dir     string
+	MaxOpen int
+	Echo    *echo.Registry
+	Hasher  ut.Hasher
 }
 
+// saver. Ключи всех карт - пути с префиксом PREFFIX (временные файлы).
+// Методы можно вызывать из разных горутин, запись в файлы идет без общей блокировки
 type saver struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	log     *logrus.Logger
-	storage map[string]*os.File
+	ctx      context.Context
+	cancel   context.CancelFunc
+	log      *logrus.Logger
+	dir      string
+	maxOpen  int
+	echo     *echo.Registry
+	hasher   ut.Hasher
+	mx       sync.Mutex
+	storage  map[string]*os.File
+	active   map[string]struct{}
+	refs     map[string]int
+	lru      *list.List
+	elems    map[string]*list.Element
+	received map[string]int64
+	progress map[string]*progress
 }
 
 func New(cnf ConfSaver) *saver {
 
+	if cnf.MaxOpen <= 0 {
+		cnf.MaxOpen = MAX_OPEN
+	}
+
 	return &saver{
-		ctx:     cnf.Ctx,
-		cancel:  cnf.Cancel,
-		log:     cnf.Log,
-		storage: make(map[string]*os.File),
+		ctx:      cnf.Ctx,
+		cancel:   cnf.Cancel,
+		log:      cnf.Log,
+		dir:      cnf.Dir,
+		maxOpen:  cnf.MaxOpen,
+		echo:     cnf.Echo,
+		hasher:   cnf.Hasher,
+		storage:  make(map[string]*os.File),
+		active:   make(map[string]struct{}),
+		refs:     make(map[string]int),
+		lru:      list.New(),
+		elems:    make(map[string]*list.Element),
+		received: make(map[string]int64),
+		progress: make(map[string]*progress),
 	}
 }
 
-func (s *saver) CreateFolder(path string) error {
+func (s *saver) CreateFolder(rel string) error {
+
+	path, err := s.local(rel)
+	if err != nil {
+		return err
+	}
 
+	// папка уже есть, события не будет
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	s.echo.Expect(path, fsnotify.Create, "")
 	if err := os.MkdirAll(path, 0777); err != nil {
+		s.echo.Withdraw(path, fsnotify.Create, "")
 		return err
 	}
 	return nil
 }
 
-func (s *saver) Open(path string) error {
-
-	path, err := s.rename(path)
+// Open. Открывает файл на запись под временным именем с префиксом PREFFIX.
+// Временный файл всегда создается пустым, файл под настоящим именем не трогается до Commit
+func (s *saver) Open(rel string) error {
 
-	f, err := os.OpenFile(path, os.O_RDWR, 0777)
+	path, err := s.local(rel)
 	if err != nil {
 		return err
 	}
 
-	oldf, ok := s.storage[path]
-	if ok {
-		oldf.Close()
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.open(path)
+}
+
+func (s *saver) open(path string) error {
+
+	s.log.Debug(fmt.Sprintf("[saver.Open()] path: %s;", path))
+
+	tmp := s.getPath(path)
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return fmt.Errorf("[saver.Open()] (os.OpenFile) path: %s, err: %w;", tmp, err)
 	}
 
-	s.storage[path] = f
+	s.put(tmp, f)
+	s.received[tmp] = 0
+
+	// загрузка начинается заново, старый прогресс не нужен
+	delete(s.progress, tmp)
+	os.Remove(tmp + STATE_SUFFIX)
 
 	return nil
 }
 
-func (s *saver) Close(path string) error {
+// Resume. Открывает загрузку файла размера size с хешем hash.
+// Если от прошлого запуска остался временный файл с тем же хешем, загрузка продолжается.
+// Возвращает интервалы, которые нужно запросить у сервера
+func (s *saver) Resume(rel string, size int64, hash string, modTime int64) ([]Range, error) {
 
-	f, ok := s.storage[path]
-	if !ok {
-		return errors.New("")
+	path, err := s.local(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.resume(path, size, hash, modTime)
+}
+
+func (s *saver) resume(path string, size int64, hash string, modTime int64) ([]Range, error) {
+
+	s.log.Debug(fmt.Sprintf("[saver.Resume()] path: %s, size: %d, hash: %s;", path, size, hash))
+
+	tmp := s.getPath(path)
+
+	p, err := loadProgress(tmp)
+	_, statErr := os.Stat(tmp)
+
+	if err == nil && statErr == nil && p.Hash == hash && p.Size == size {
+		f, err := os.OpenFile(tmp, os.O_RDWR, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("[saver.Resume()] (os.OpenFile) path: %s, err: %w;", tmp, err)
+		}
+		s.put(tmp, f)
+		s.log.Debug(fmt.Sprintf("[saver.Resume()] path: %s, continue from received: %d;", path, p.received()))
+	} else {
+		if err := s.open(path); err != nil {
+			return nil, err
+		}
+		if err := os.Truncate(tmp, size); err != nil {
+			return nil, fmt.Errorf("[saver.Resume()] (os.Truncate) path: %s, err: %w;", tmp, err)
+		}
+		p = &progress{Size: size, Hash: hash}
+	}
+
+	p.ModTime = modTime
+	s.progress[tmp] = p
+	s.received[tmp] = p.received()
+
+	if err := p.save(tmp); err != nil {
+		return nil, err
+	}
+
+	return p.missing(), nil
+}
+
+// Downloads. Находит в папке синхронизации незавершенные загрузки и открывает их заново
+func (s *saver) Downloads() ([]Download, error) {
+
+	if s.dir == "" {
+		return nil, fmt.Errorf("[saver.Downloads()] dir is empty;")
+	}
+
+	var states []string
+	err := filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.IsDir() && strings.HasPrefix(name, PREFFIX) && strings.HasSuffix(name, STATE_SUFFIX) {
+			states = append(states, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[saver.Downloads()] (filepath.WalkDir) dir: %s, err: %w;", s.dir, err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	res := make([]Download, 0, len(states))
+	for _, state := range states {
+		tmp := strings.TrimSuffix(state, STATE_SUFFIX)
+		p, err := loadProgress(tmp)
+		if err != nil {
+			s.log.Warn(fmt.Sprintf("[saver.Downloads()] skip state: %s, err: %v;", state, err))
+			continue
+		}
+
+		path := s.getPath(tmp)
+		rel, err := pc.ToRel(s.dir, path)
+		if err != nil {
+			s.log.Warn(fmt.Sprintf("[saver.Downloads()] skip state: %s, err: %v;", state, err))
+			continue
+		}
+
+		missing, err := s.resume(path, p.Size, p.Hash, p.ModTime)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, Download{
+			Path:    rel,
+			Size:    p.Size,
+			Hash:    p.Hash,
+			ModTime: p.ModTime,
+			Missing: missing,
+		})
+	}
+
+	return res, nil
+}
+
+// Close. Закрывает файл и забывает о нем. Прогресс остается на диске, загрузку можно продолжить через Resume
+func (s *saver) Close(rel string) error {
+
+	path, err := s.local(rel)
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	tmp := s.getPath(path)
+
+	if _, ok := s.active[tmp]; !ok {
+		return fmt.Errorf("[saver.Close()] path: %s, file is not open;", path)
+	}
+
+	var errr error
+	if p, ok := s.progress[tmp]; ok {
+		errr = s.persist(tmp, p)
+	}
+
+	if f, ok := s.forget(tmp); ok {
+		if err := f.Close(); err != nil {
+			errr = err
+		}
+	}
+	return errr
+}
+
+// CloseAll. Закрывает все открытые файлы, нужен при остановке или перезапуске пакета
+func (s *saver) CloseAll() error {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var errr error
+	for tmp := range s.active {
+		if p, ok := s.progress[tmp]; ok {
+			if err := s.persist(tmp, p); err != nil {
+				errr = err
+			}
+		}
+		if f, ok := s.forget(tmp); ok {
+			if err := f.Close(); err != nil {
+				errr = err
+			}
+		}
+	}
+	return errr
+}
+
+// Write. Записывает кусок файла во временный файл по смещению CurrentOffset.
+// Путь в opt.FilePath без префикса, Buffer - данные куска, Index - номер куска
+func (s *saver) Write(opt options.Options) error {
+
+	path, err := s.local(opt.FilePath)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.getPath(path)
+
+	offset := opt.CurrentOffset
+	if offset < 0 {
+		return fmt.Errorf("[saver.Write()] path: %s, bad offset: %d;", opt.FilePath, offset)
+	}
+
+	s.mx.Lock()
+	f, err := s.acquire(tmp)
+	s.mx.Unlock()
+	if err != nil {
+		return fmt.Errorf("[saver.Write()] path: %s, err: %w;", opt.FilePath, err)
+	}
+
+	s.log.Debug(fmt.Sprintf(
+		"[saver.Write()] path: %s, index: %d, offset: %d, len: %d;",
+		opt.FilePath, opt.Index, offset, len(opt.Buffer),
+	))
+
+	n, werr := f.WriteAt(opt.Buffer, offset)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// файл закрыли (Close, Commit), пока шла запись: его счетчики уже забыты
+	if _, ok := s.active[tmp]; !ok {
+		return fmt.Errorf("[saver.Write()] path: %s, offset: %d, file is closed while writing, err: %v;", opt.FilePath, offset, werr)
+	}
+	defer s.release(tmp)
+
+	s.received[tmp] += int64(n)
+
+	if p, ok := s.progress[tmp]; ok {
+		p.add(Range{Start: offset, End: offset + int64(n)})
+		s.received[tmp] = p.received()
+		if p.unsaved >= SAVE_EVERY {
+			if err := s.persist(tmp, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	if werr != nil {
+		return fmt.Errorf("[saver.Write()] (f.WriteAt) path: %s, offset: %d, err: %w;", opt.FilePath, offset, werr)
 	}
-	f.Close()
+
 	return nil
 }
 
-func (s *saver) Write(info pc.Info) error {
+// Received. Сколько байт записано в файл с момента Open (для Resume - сколько уникальных байт уже есть)
+func (s *saver) Received(rel string) int64 {
+
+	path, err := s.local(rel)
+	if err != nil {
+		return 0
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.received[s.getPath(path)]
+}
+
+// Commit. Завершает загрузку: сбрасывает временный файл на диск, сверяет хеш,
+// ставит время модификации и атомарно переименовывает его в path.
+// Хеш сверяется алгоритмом из Info, с которым открыта загрузка (Delta), иначе алгоритмом saver.
+// При несовпадении хеша удаляется только временный файл, прежняя версия под именем path остается
+func (s *saver) Commit(rel string, expectedHash string, modTime int64) error {
+
+	s.log.Debug(fmt.Sprintf("[saver.Commit()] path: %s, hash: %s, modTime: %d;", rel, expectedHash, modTime))
 
-	// тут нужно добавить смещенеи файла 
-	f, ok := s.storage[info.Path]
+	path, err := s.local(rel)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.getPath(path)
+
+	s.mx.Lock()
+	if _, ok := s.active[tmp]; !ok {
+		s.mx.Unlock()
+		return fmt.Errorf("[saver.Commit()] path: %s, file is not open;", path)
+	}
+	if s.refs[tmp] > 0 {
+		s.mx.Unlock()
+		return fmt.Errorf("[saver.Commit()] path: %s, file is being written;", path)
+	}
+	hasher := s.hasher
+	if p, ok := s.progress[tmp]; ok && p.HashAlgo != "" {
+		hasher, err = ut.NewHasher(p.HashAlgo)
+	}
+	f, ok := s.forget(tmp)
+	s.mx.Unlock()
+
+	os.Remove(tmp + STATE_SUFFIX)
+
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("[saver.Commit()] path: %s, err: %w;", path, err)
+	}
+
+	// дескриптор вытеснен из пула: после Close данные могут оставаться только в кеше ОС,
+	// поэтому файл открывается заново ради Sync
 	if !ok {
-		return errors.New("")
+		s.log.Debug(fmt.Sprintf("[saver.Commit()] reopen path: %s;", tmp))
+		if f, err = os.OpenFile(tmp, os.O_RDWR, 0777); err != nil {
+			return fmt.Errorf("[saver.Commit()] (os.OpenFile) path: %s, err: %w;", tmp, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("[saver.Commit()] (f.Sync) path: %s, err: %w;", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("[saver.Commit()] (f.Close) path: %s, err: %w;", path, err)
+	}
+
+	hash, err := ut.GetHash(s.log, hasher, tmp)
+	if err != nil {
+		return err
+	}
+
+	if hash != expectedHash {
+		if err := os.Remove(tmp); err != nil {
+			s.log.Warn(fmt.Sprintf("[saver.Commit()] (os.Remove) path: %s, err: %v;", tmp, err))
+		}
+		return fmt.Errorf(
+			"[saver.Commit()] path: %s, expected: %s, got: %s, werr: %w;",
+			path, expectedHash, hash, er.ERROR__HASH_MISMATCH__,
+		)
+	}
+
+	if err := s.changeModTime(tmp, modTime); err != nil {
+		return fmt.Errorf("[saver.Commit()] (s.changeModTime) path: %s, err: %w;", path, err)
+	}
+
+	// watcher считает хеш своим алгоритмом, эхо должно совпасть с ним
+	echoHash := expectedHash
+	if hasher.Name() != s.hasher.Name() {
+		if echoHash, err = ut.GetHash(s.log, s.hasher, tmp); err != nil {
+			return err
+		}
+	}
+
+	s.echo.Expect(path, fsnotify.Create|fsnotify.Write|fsnotify.Chmod, echoHash)
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("[saver.Commit()] (os.Rename) path: %s, err: %w;", path, err)
 	}
 
-	n, err := f.WriteAt() // сюда нужно писать пейлоад
 	return nil
 }
 
-func (s *saver) changeModTime(path string, modTime int64) error {
+// Remove. Удаляет файл по команде с сервера. Незавершенная загрузка этого файла отменяется
+func (s *saver) Remove(rel string) error {
+
+	s.log.Debug(fmt.Sprintf("[saver.Remove()] path: %s;", rel))
+
+	path, err := s.local(rel)
+	if err != nil {
+		return err
+	}
+
+	s.discard(path)
+
+	s.echo.Expect(path, fsnotify.Remove, "")
+	if err := os.Remove(path); err != nil {
+		// файл не удален, события не будет
+		s.echo.Withdraw(path, fsnotify.Remove, "")
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("[saver.Remove()] (os.Remove) path: %s, err: %w;", path, err)
+		}
+	}
 
-	err := os.Chtimes(path, time.UnixMicro(modTime), time.UnixMicro(modTime))
-    if err != nil {
-        return err
-    }
 	return nil
 }
 
-func (s *saver) resize(path string, newSize int64) error {
+// RemoveFolder. Удаляет папку по команде с сервера, recursive - вместе с содержимым
+func (s *saver) RemoveFolder(rel string, recursive bool) error {
 
-	stat, err := os.Stat(path)
+	s.log.Debug(fmt.Sprintf("[saver.RemoveFolder()] path: %s, recursive: %v;", rel, recursive))
+
+	path, err := s.local(rel)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	size := stat.Size()
-	if size == newSize {
+	if !recursive {
+		s.echo.Expect(path, fsnotify.Remove, "")
+		if err := os.Remove(path); err != nil {
+			s.echo.Withdraw(path, fsnotify.Remove, "")
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("[saver.RemoveFolder()] (os.Remove) path: %s, err: %w;", path, err)
+			}
+		}
 		return nil
 	}
-	if newSize > size {
-		diff := newSize - size
-		data := make([]byte, diff)
-		for i := range data {
-			data[i] = byte(1)
-		}
-		file, ok := s.storage[path]
-		if !ok {
-			return errors.New("")
-		}
-		_, err := file.Write(data)
+
+	var paths []string
+	err = filepath.WalkDir(path, func(cur string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		paths = append(paths, cur)
 		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[saver.RemoveFolder()] (filepath.WalkDir) path: %s, err: %w;", path, err)
 	}
-	if size > newSize {
-		_, ok := s.storage[path]
-		if !ok {
-			return errors.New("")
+
+	for _, cur := range paths {
+		if !strings.HasPrefix(filepath.Base(cur), PREFFIX) {
+			s.discard(cur)
+			s.echo.Expect(cur, fsnotify.Remove, "")
 		}
-		if err := os.Truncate(path, newSize); err != nil {
-			return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		// RemoveAll мог удалить часть папки: ожидания снимаются только с того, что осталось
+		for _, cur := range paths {
+			if _, err := os.Lstat(cur); err == nil && !strings.HasPrefix(filepath.Base(cur), PREFFIX) {
+				s.echo.Withdraw(cur, fsnotify.Remove, "")
+			}
 		}
-		return nil
+		return fmt.Errorf("[saver.RemoveFolder()] (os.RemoveAll) path: %s, err: %w;", path, err)
 	}
 
 	return nil
 }
 
-func (s *saver) rename(path string) (string, error) {
+// Rename. Переименовывает (перемещает) файл или папку по команде с сервера
+func (s *saver) Rename(oldRel string, newRel string) error {
+
+	s.log.Debug(fmt.Sprintf("[saver.Rename()] old: %s, new: %s;", oldRel, newRel))
 
-	newPath := s.getPath(path)
-	if err := os.Rename(path, newPath); err != nil {
-		return "", err
+	oldPath, err := s.local(oldRel)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := s.local(newRel)
+	if err != nil {
+		return err
 	}
-	return newPath, nil
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0777); err != nil {
+		return fmt.Errorf("[saver.Rename()] (os.MkdirAll) path: %s, err: %w;", newPath, err)
+	}
+
+	s.echo.Expect(oldPath, fsnotify.Rename|fsnotify.Remove, "")
+	s.echo.Expect(newPath, fsnotify.Create, "")
+	if err := os.Rename(oldPath, newPath); err != nil {
+		s.echo.Withdraw(oldPath, fsnotify.Rename|fsnotify.Remove, "")
+		s.echo.Withdraw(newPath, fsnotify.Create, "")
+		return fmt.Errorf("[saver.Rename()] (os.Rename) old: %s, new: %s, err: %w;", oldPath, newPath, err)
+	}
+
+	return nil
+}
+
+// local. Путь из pc.Info -> локальный путь внутри папки синхронизации. Выход за ее пределы - ошибка
+func (s *saver) local(rel string) (string, error) {
+
+	path, err := pc.ToLocal(s.dir, rel)
+	if err != nil {
+		return "", fmt.Errorf("[saver.local()] path: %s, err: %w;", rel, err)
+	}
+
+	return path, nil
+}
+
+// discard. Отменяет незавершенную загрузку файла: закрывает и удаляет временный файл и прогресс
+func (s *saver) discard(path string) {
+
+	tmp := s.getPath(path)
+
+	s.mx.Lock()
+	if f, ok := s.forget(tmp); ok {
+		f.Close()
+	}
+	s.mx.Unlock()
+
+	os.Remove(tmp + STATE_SUFFIX)
+	os.Remove(tmp)
+}
+
+func (s *saver) changeModTime(path string, modTime int64) error {
+
+	err := os.Chtimes(path, time.UnixMicro(modTime), time.UnixMicro(modTime))
+    if err != nil {
+        return err
+    }
+	return nil
 }
 
 func (s *saver) getPath(path string) string {
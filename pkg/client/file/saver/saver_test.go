@@ -1,17 +1,35 @@
 package saver
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/options"
+	er "github.com/preegnees/gobox/pkg/client/errors"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	"github.com/preegnees/gobox/pkg/client/file/echo"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
 )
 
 var TEST_FILE = "TEST_FILE.txt"
 
 func TestGetPath(t *testing.T) {
 	s := saver{}
-	mainPath := "hello\\world\\newFolder\\new.txt"
-	want := "hello\\world\\newFolder\\" + PREFFIX + "new.txt"
+	mainPath := filepath.Join("hello", "world", "newFolder", "new.txt")
+	want := filepath.Join("hello", "world", "newFolder", PREFFIX+"new.txt")
 	newPath := s.getPath(mainPath)
 	t.Log(newPath)
 	if newPath != want {
@@ -25,7 +43,7 @@ func TestGetPath(t *testing.T) {
 	}
 }
 
-func TestResizeFile(t *testing.T) {
+func TestChangeTime(t *testing.T) {
 
 	f, err := os.Create(TEST_FILE)
 	if err != nil {
@@ -46,83 +64,563 @@ func TestResizeFile(t *testing.T) {
 	defer file.Close()
 	s.storage[TEST_FILE] = file
 
-	startSize := int64(1024*50)
-	data := make([]byte, startSize)
-	file.Write(data)
+	newTime := time.Now().UnixMicro()
+
+	if err := s.changeModTime(TEST_FILE, newTime); err != nil {
+		panic(err)
+	}
 
 	stat, err := os.Stat(TEST_FILE)
 	if err != nil {
 		panic(err)
 	}
 
-	if startSize != stat.Size() {
-		panic("startSize != stat.Size()")
+	if newTime != stat.ModTime().UnixMicro() {
+		panic("newTime != stat.ModTime().UnixMicro()")
 	}
+}
+
+func TestWrite(t *testing.T) {
+
+	defer os.Remove(PREFFIX + TEST_FILE)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	s := New(ConfSaver{Log: logger})
 
-	newSize1 := int64(1024*50 + 1024*100)
-	if err := s.resize(TEST_FILE, newSize1); err != nil {
+	if err := s.Open(TEST_FILE); err != nil {
 		panic(err)
 	}
+	defer s.CloseAll()
 
-	stat, err = os.Stat(TEST_FILE)
+	// куски могут приходить не по порядку
+	chunks := []options.Options{
+		{FilePath: TEST_FILE, CurrentOffset: 6, Index: 1, Buffer: []byte("world")},
+		{FilePath: TEST_FILE, CurrentOffset: 0, Index: 0, Buffer: []byte("hello ")},
+	}
+	for _, c := range chunks {
+		if err := s.Write(c); err != nil {
+			panic(err)
+		}
+	}
+
+	if s.Received(TEST_FILE) != 11 {
+		t.Fatalf("received: %d", s.Received(TEST_FILE))
+	}
+
+	data, err := os.ReadFile(PREFFIX + TEST_FILE)
 	if err != nil {
 		panic(err)
 	}
+	if string(data) != "hello world" {
+		t.Fatalf("data: %s", data)
+	}
+
+	if err := s.Write(options.Options{FilePath: "other.txt", CurrentOffset: 0}); err == nil {
+		panic("write to not opened file")
+	}
+}
 
-	if stat.Size() != newSize1 {
-		panic("stat.Size() != newSize1")
+func TestCommit(t *testing.T) {
+
+	defer os.Remove(TEST_FILE)
+
+	if err := os.WriteFile(TEST_FILE, []byte("old version"), 0666); err != nil {
+		panic(err)
 	}
 
-	newSize2 := int64(1024*50 - 1024*30)
-	if err := s.resize(TEST_FILE, newSize2); err != nil {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	s := New(ConfSaver{Log: logger})
+
+	if err := s.Open(TEST_FILE); err != nil {
 		panic(err)
 	}
 
-	stat, err = os.Stat(TEST_FILE)
+	// пока идет загрузка, под настоящим именем лежит старая версия
+	if got, err := os.ReadFile(TEST_FILE); err != nil || string(got) != "old version" {
+		panic("old version is not kept during download")
+	}
+
+	data := []byte("new")
+	if err := s.Write(options.Options{FilePath: TEST_FILE, CurrentOffset: 0, Buffer: data}); err != nil {
+		panic(err)
+	}
+
+	sum := sha256.Sum256(data)
+	modTime := time.Now().Add(-time.Hour).UnixMicro()
+	if err := s.Commit(TEST_FILE, hex.EncodeToString(sum[:]), modTime); err != nil {
+		panic(err)
+	}
+
+	got, err := os.ReadFile(TEST_FILE)
 	if err != nil {
 		panic(err)
 	}
+	if string(got) != "new" {
+		t.Fatalf("data: %s", got)
+	}
 
-	t.Log(stat.Size())
+	stat, err := os.Stat(TEST_FILE)
+	if err != nil {
+		panic(err)
+	}
+	if stat.ModTime().UnixMicro() != modTime {
+		panic("modTime is not applied")
+	}
 
-	if stat.Size() != newSize2 {
-		panic("stat.Size() != newSize1")
+	if _, err := os.Stat(PREFFIX + TEST_FILE); !os.IsNotExist(err) {
+		panic("temp file is left")
 	}
 }
 
-func TestChangeTime(t *testing.T) {
+func TestCommitHashMismatch(t *testing.T) {
 
-	f, err := os.Create(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	if err := os.WriteFile(TEST_FILE, []byte("old version"), 0666); err != nil {
+		panic(err)
+	}
+
+	logger := logrus.New()
+	s := New(ConfSaver{Log: logger})
+
+	if err := s.Open(TEST_FILE); err != nil {
+		panic(err)
+	}
+	if err := s.Write(options.Options{FilePath: TEST_FILE, CurrentOffset: 0, Buffer: []byte("broken")}); err != nil {
+		panic(err)
+	}
+
+	err := s.Commit(TEST_FILE, "wrong", time.Now().UnixMicro())
+	if !errors.Is(err, er.ERROR__HASH_MISMATCH__) {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := os.Stat(PREFFIX + TEST_FILE); !os.IsNotExist(err) {
+		panic("temp file is not discarded")
+	}
+	// старая версия пользователя не пострадала
+	got, err := os.ReadFile(TEST_FILE)
 	if err != nil {
 		panic(err)
 	}
-	f.Close()
+	if string(got) != "old version" {
+		t.Fatalf("data: %s", got)
+	}
+}
+
+func TestResume(t *testing.T) {
+
+	const dir = "TestDir"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rel := TEST_FILE
+	path := filepath.Join(dir, rel)
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	modTime := time.Now().UnixMicro()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	s := New(ConfSaver{Log: logger, Dir: dir})
+	missing, err := s.Resume(rel, int64(len(data)), hash, modTime)
+	if err != nil {
+		panic(err)
+	}
+	if len(missing) != 1 || missing[0] != (Range{0, 11}) {
+		t.Fatalf("missing: %v", missing)
+	}
+
+	if err := s.Write(options.Options{FilePath: rel, CurrentOffset: 0, Buffer: []byte("hello")}); err != nil {
+		panic(err)
+	}
+	if err := s.Write(options.Options{FilePath: rel, CurrentOffset: 8, Buffer: []byte("rld")}); err != nil {
+		panic(err)
+	}
+
+	// клиент остановился посреди загрузки
+	if err := s.CloseAll(); err != nil {
+		panic(err)
+	}
+
+	s = New(ConfSaver{Log: logger, Dir: dir})
+	downloads, err := s.Downloads()
+	if err != nil {
+		panic(err)
+	}
+	if len(downloads) != 1 {
+		t.Fatalf("downloads: %v", downloads)
+	}
+
+	d := downloads[0]
+	if d.Path != rel || d.Hash != hash || d.ModTime != modTime {
+		t.Fatalf("download: %v", d)
+	}
+	if len(d.Missing) != 1 || d.Missing[0] != (Range{5, 8}) {
+		t.Fatalf("missing: %v", d.Missing)
+	}
+	if s.Received(rel) != 8 {
+		t.Fatalf("received: %d", s.Received(rel))
+	}
+
+	for _, r := range d.Missing {
+		opt := options.Options{
+			FilePath:      rel,
+			CurrentOffset: r.Start,
+			Buffer:        data[r.Start:r.End],
+		}
+		if err := s.Write(opt); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := s.Commit(rel, d.Hash, d.ModTime); err != nil {
+		panic(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("data: %s", got)
+	}
+
+	if downloads, _ := s.Downloads(); len(downloads) != 0 {
+		t.Fatalf("downloads after commit: %v", downloads)
+	}
+}
+
+func TestConcurrentWritesWithPool(t *testing.T) {
+
+	const dir = "TestDir"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	s := New(ConfSaver{Log: logger, Dir: dir, MaxOpen: 2})
+
+	const files = 6
+	const chunks = 20
+
+	paths := make([]string, files)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("file%d.txt", i)
+		if err := s.Open(paths[i]); err != nil {
+			panic(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		for c := 0; c < chunks; c++ {
+			wg.Add(1)
+			go func(path string, c int) {
+				defer wg.Done()
+				opt := options.Options{
+					FilePath:      path,
+					CurrentOffset: int64(c),
+					Index:         uint16(c),
+					Buffer:        []byte{byte('a' + c)},
+				}
+				if err := s.Write(opt); err != nil {
+					t.Error(err)
+				}
+			}(path, c)
+		}
+	}
+	wg.Wait()
+
+	s.mx.Lock()
+	open := len(s.storage)
+	s.mx.Unlock()
+	if open > 2 {
+		t.Fatalf("open files: %d", open)
+	}
+
+	for _, path := range paths {
+		if s.Received(path) != chunks {
+			t.Fatalf("path: %s, received: %d", path, s.Received(path))
+		}
+		if err := s.Close(path); err != nil {
+			panic(err)
+		}
+		data, err := os.ReadFile(s.getPath(filepath.Join(dir, path)))
+		if err != nil {
+			panic(err)
+		}
+		if string(data) != "abcdefghijklmnopqrst" {
+			t.Fatalf("path: %s, data: %s", path, data)
+		}
+	}
+
+	if len(s.storage) != 0 || len(s.active) != 0 || s.lru.Len() != 0 {
+		t.Fatalf("entries left after Close: %d, %d, %d", len(s.storage), len(s.active), s.lru.Len())
+	}
+}
+
+func TestConcurrentCommitWithPool(t *testing.T) {
+
+	const dir = "TestDir"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// в пуле один дескриптор: к Commit одна из загрузок всегда вытеснена
+	s := New(ConfSaver{Log: logrus.New(), Dir: dir, MaxOpen: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := fmt.Sprintf("file%d.txt", i)
+			data := bytes.Repeat([]byte{byte('a' + i)}, 64)
+
+			if err := s.Open(path); err != nil {
+				t.Error(err)
+				return
+			}
+			for off := 0; off < len(data); off += 8 {
+				if err := s.Write(options.Options{FilePath: path, CurrentOffset: int64(off), Buffer: data[off : off+8]}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			sum := sha256.Sum256(data)
+			if err := s.Commit(path, hex.EncodeToString(sum[:]), time.Now().UnixMicro()); err != nil {
+				t.Error(err)
+				return
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, path))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("path: %s, data: %s, err: %v", path, got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(s.storage) != 0 || len(s.active) != 0 {
+		t.Fatalf("entries left after Commit: %d, %d", len(s.storage), len(s.active))
+	}
+}
+
+func TestRemoveAndRename(t *testing.T) {
+
+	const dir = "TestDir"
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		filepath.Join(dir, "file.txt"),
+		filepath.Join(dir, "folder", "a.txt"),
+		filepath.Join(dir, "folder", "sub", "b.txt"),
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0777); err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(f, []byte(f), 0666); err != nil {
+			panic(err)
+		}
+	}
+
+	registry := echo.New(time.Minute)
+	s := New(ConfSaver{Log: logrus.New(), Dir: dir, Echo: registry})
+
+	moved := filepath.Join(dir, "moved", "file.txt")
+	if err := s.Rename("file.txt", "moved/file.txt"); err != nil {
+		panic(err)
+	}
+	if _, err := os.Stat(moved); err != nil {
+		panic(err)
+	}
+	if !registry.Suppress(files[0], fsnotify.Rename, "") || !registry.Suppress(moved, fsnotify.Create, "") {
+		panic("rename echo is not registered")
+	}
+
+	if err := s.Remove("moved/file.txt"); err != nil {
+		panic(err)
+	}
+	if _, err := os.Stat(moved); !os.IsNotExist(err) {
+		panic("file is not removed")
+	}
+	if !registry.Suppress(moved, fsnotify.Remove, "") {
+		panic("remove echo is not registered")
+	}
+
+	// неудачная операция не оставляет ожиданий, иначе следующее изменение пользователя было бы подавлено
+	expected := registry.Len()
+	if err := s.Rename("missing.txt", "other.txt"); err == nil {
+		panic("missing file renamed")
+	}
+	if err := s.Remove("missing.txt"); err != nil {
+		panic(err)
+	}
+
+	folder := filepath.Join(dir, "folder")
+	if err := s.RemoveFolder("folder", false); err == nil {
+		panic("not empty folder removed without recursive")
+	}
+	if registry.Len() != expected {
+		t.Fatalf("echo left after failed operations: %d", registry.Len()-expected)
+	}
+	if err := s.RemoveFolder("folder", true); err != nil {
+		panic(err)
+	}
+	if _, err := os.Stat(folder); !os.IsNotExist(err) {
+		panic("folder is not removed")
+	}
+	for _, f := range files[1:] {
+		if !registry.Suppress(f, fsnotify.Remove, "") {
+			t.Fatalf("remove echo is not registered: %s", f)
+		}
+	}
+	if registry.Suppress(files[1], fsnotify.Create, "") {
+		panic("create is suppressed after remove")
+	}
+}
+
+func TestCommitEcho(t *testing.T) {
 
 	defer os.Remove(TEST_FILE)
 
-	s := saver{
-		storage: make(map[string]*os.File),
+	if err := os.WriteFile(TEST_FILE, []byte("old"), 0666); err != nil {
+		panic(err)
 	}
 
-	file, err := os.OpenFile(TEST_FILE, os.O_RDWR, 0777)
+	registry := echo.New(time.Minute)
+	s := New(ConfSaver{Log: logrus.New(), Echo: registry})
+
+	if err := s.Open(TEST_FILE); err != nil {
+		panic(err)
+	}
+
+	data := []byte("new")
+	if err := s.Write(options.Options{FilePath: TEST_FILE, CurrentOffset: 0, Buffer: data}); err != nil {
+		panic(err)
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if err := s.Commit(TEST_FILE, hash, time.Now().UnixMicro()); err != nil {
+		panic(err)
+	}
+
+	if !registry.Suppress(TEST_FILE, fsnotify.Create, hash) {
+		panic("commit is not registered")
+	}
+	if registry.Suppress(TEST_FILE, fsnotify.Write, "other content") {
+		panic("change with other hash is suppressed")
+	}
+}
+
+func TestEscapeRoot(t *testing.T) {
+
+	const dir = "TestDir"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(ConfSaver{Log: logrus.New(), Dir: dir})
+
+	for _, path := range []string{"../outside.txt", "a/../../outside.txt", "/etc/passwd", ""} {
+		if err := s.Open(path); !errors.Is(err, er.ERROR__INVALID_PATH__) {
+			t.Fatalf("path: %s, err: %v", path, err)
+		}
+		if err := s.Rename(TEST_FILE, path); !errors.Is(err, er.ERROR__INVALID_PATH__) {
+			t.Fatalf("path: %s, err: %v", path, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "..", PREFFIX+"outside.txt")); !os.IsNotExist(err) {
+		panic("file is created outside of dir")
+	}
+}
+
+func TestDelta(t *testing.T) {
+
+	const dir = "TestDir"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rel := TEST_FILE
+	path := filepath.Join(dir, rel)
+
+	old := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(old)
+	if err := os.WriteFile(path, old, 0666); err != nil {
+		panic(err)
+	}
+
+	// новая версия: вставка в начало и дописанный хвост, как у журнала
+	data := append(append([]byte("inserted header"), old...), make([]byte, 100<<10)...)
+	next := filepath.Join(dir, "next")
+	if err := os.WriteFile(next, data, 0666); err != nil {
+		panic(err)
+	}
+	// отправитель хеширует файлы xxh3, у saver алгоритм по умолчанию: хеш сверяется алгоритмом из Info
+	xxh3, _ := ut.NewHasher(ut.HASH_XXH3)
+	hash, size, chunks, err := chunker.Manifest(logrus.New(), xxh3, next, chunker.ConfChunker{})
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
-	s.storage[TEST_FILE] = file
+	os.Remove(next)
 
-	newTime := time.Now().UnixMicro()
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
 
-	if err := s.changeModTime(TEST_FILE, newTime); err != nil {
+	s := New(ConfSaver{Log: logger, Dir: dir})
+	info := pc.Info{Path: rel, Hash: hash, HashAlgo: ut.HASH_XXH3, Size: size, Chunks: chunks, ModTime: time.Now().UnixMicro()}
+	missing, err := s.Delta(rel, info)
+	if err != nil {
 		panic(err)
 	}
 
-	stat, err := os.Stat(TEST_FILE)
+	var download int64
+	for _, r := range missing {
+		download += r.End - r.Start
+		opt := options.Options{FilePath: rel, CurrentOffset: r.Start, Buffer: data[r.Start:r.End]}
+		if err := s.Write(opt); err != nil {
+			panic(err)
+		}
+	}
+	if download == 0 || download > size/2 {
+		t.Fatalf("download: %d of %d", download, size)
+	}
+
+	// до Commit пользователь видит старую версию на своем месте
+	got, err := os.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
+	if !bytes.Equal(got, old) {
+		panic("old version is changed before commit")
+	}
 
-	if newTime != stat.ModTime().UnixMicro() {
-		panic("newTime != stat.ModTime().UnixMicro()")
+	if err := s.Commit(rel, hash, info.ModTime); err != nil {
+		panic(err)
+	}
+
+	got, err = os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(got, data) {
+		panic("data mismatch")
 	}
 }
@@ -6,11 +6,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/sirupsen/logrus"
 
 	cl "github.com/preegnees/gobox/pkg/client/client"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	"github.com/preegnees/gobox/pkg/client/file/ignore"
 	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
 	ut "github.com/preegnees/gobox/pkg/client/file/utils"
 	er "github.com/preegnees/gobox/pkg/client/errors"
@@ -25,19 +26,20 @@ type IUploader interface {
 	Upload()
 }
 
-// ConfUploader. конфигурация для загрузчика
+// ConfUploader. конфигурация для загрузчика. Hasher - алгоритм хеша файлов, по умолчанию sha256
 type ConfUploader struct {
 	Ctx    context.Context
 	Log    *logrus.Logger
 	Dir    string
 	Client cl.IClient
+	Hasher ut.Hasher
 }
 
 func (c *ConfUploader) ToString() string {
 
 	return fmt.Sprintf(
-		"context: %v, levelLog: %s, dir: %s",
-		c.Ctx, c.Log.Level, c.Dir,
+		"context: %v, levelLog: %s, dir: %s, hasher: %s",
+		c.Ctx, c.Log.Level, c.Dir, c.Hasher.Name(),
 	)
 }
 
@@ -48,6 +50,8 @@ type Uploader struct {
 	log    *logrus.Logger
 	dir    string
 	client cl.IClient
+	hasher ut.Hasher
+	ignore *ignore.Matcher
 }
 
 func (u *Uploader) ToString() string {
@@ -80,6 +84,11 @@ func New(cnf ConfUploader) (*Uploader, error) {
 		return nil, fmt.Errorf("[uploader.New()] path: %s is not dir", cnf.Dir)
 	}
 
+	ign, err := ignore.New(ignore.ConfIgnore{Log: cnf.Log, Dir: cnf.Dir})
+	if err != nil {
+		return nil, fmt.Errorf("[uploader.New()] (ignore.New) err: %w;", err)
+	}
+
 	ctx, cancel := context.WithCancel(cnf.Ctx)
 
 	cnf.Log.Debug("[uploader.New()] uploader creating;")
@@ -90,6 +99,8 @@ func New(cnf ConfUploader) (*Uploader, error) {
 		log:    cnf.Log,
 		dir:    cnf.Dir,
 		client: cnf.Client,
+		hasher: cnf.Hasher,
+		ignore: ign,
 	}, nil
 }
 
@@ -128,31 +139,42 @@ func (u *Uploader) upload(path string) error {
 
 			u.log.Debug(fmt.Sprintf("[uploader.upload()] current path: %s;", curPath))
 
-			pass := false
-			for _, val := range ut.IGNORE_STRS {
-				if strings.Contains(curPath, val) {
-					u.log.Debug(fmt.Sprintf("[uploader.upload()] name: %s include substr: %s;", curPath, val))
-					pass = true
-				}
-			}
-
-			if pass {
+			// в проигнорированную папку не заходим
+			if u.ignore.Match(curPath, file.IsDir()) {
 				continue
 			}
 
 			modTime, err := ut.GetModTime(u.log, curPath)
-			hash, err := ut.GetHash(u.log, curPath)
 			isFolder, err := ut.IsFolder(u.log, curPath)
+
+			// у файла вместе с хешем считается манифест кусков, файл читается один раз
+			var hash string
+			var size int64
+			var chunks []pc.Chunk
+			if isFolder {
+				hash, err = ut.GetHash(u.log, u.hasher, curPath)
+			} else {
+				hash, size, chunks, err = chunker.Manifest(u.log, u.hasher, curPath, chunker.ConfChunker{})
+			}
 			if err != nil {
 				u.client.SendError(IDENTIFIER, u.cancel, err)
 			}
 
+			rel, err := pc.ToRel(u.dir, curPath)
+			if err != nil {
+				u.client.SendError(IDENTIFIER, u.cancel, err)
+				continue
+			}
+
 			info := pc.Info{
 				Action:   pc.UPLOAD_CODE,
-				Path:     curPath,
+				Path:     rel,
 				ModTime:  modTime,
 				Hash:     hash,
+				HashAlgo: u.hasher.Name(),
 				IsFolder: isFolder,
+				Size:     size,
+				Chunks:   chunks,
 			}
 
 			u.client.SendDeviation(info)
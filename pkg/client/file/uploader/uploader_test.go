@@ -13,7 +13,7 @@ import (
 
 	cl "github.com/preegnees/gobox/pkg/client/client"
 	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
-	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/client/file/ignore"
 )
 
 const PATH = "TestDir"
@@ -94,7 +94,7 @@ func TestUploadFilesIfDirExistsAndIntoMoreAnythigFilesAndFolders(t *testing.T) {
 		{filepath.Join(PATH, "test", "file1.exe"): true},
 		{filepath.Join(PATH, "test"): false},
 		{filepath.Join(PATH, "f2.html"): true},
-		{filepath.Join(PATH, fmt.Sprintf("file%s", ut.IGNORE_STRS[0])): true},
+		{filepath.Join(PATH, ignore.PREFIX+"file"): true},
 	}
 
 	if err := createFile(files); err != nil {
@@ -222,6 +222,74 @@ func TestUploadCheckDoneCtx(t *testing.T) {
 	}
 }
 
+func TestUploadIgnoreRules(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(PATH); err != nil {
+			panic("removeAll")
+		}
+	}()
+
+	files := []map[string]bool{
+		{filepath.Join(PATH, "templates", "index.html"): true},
+		{filepath.Join(PATH, "node_modules", "pkg", "index.js"): true},
+		{filepath.Join(PATH, "build", "app.bin"): true},
+		{filepath.Join(PATH, "main.go.swp"): true},
+	}
+
+	if err := createFile(files); err != nil {
+		panic(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(PATH, ignore.FILE), []byte("node_modules/\n/build\n*.swp\n"), 0666); err != nil {
+		panic(err)
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	got := map[string]bool{}
+
+	interErr := func(id int, cancel context.CancelFunc, err error) {
+		t.Log(fmt.Sprintf("id: %d, err: %v", id, err))
+	}
+
+	interDev := func(info pc.Info) {
+		t.Log(fmt.Sprintf("info: %s", info.ToString()))
+		got[info.Path] = true
+	}
+
+	uploader, err := New(ConfUploader{
+		Log: logger,
+		Dir: PATH,
+		Ctx: context.Background(),
+		Client: &cli{
+			intersepterErr: interErr,
+			intersepterDev: interDev,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	uploader.Upload()
+
+	want := []string{ignore.FILE, "templates", "templates/index.html"}
+
+	if len(got) != len(want) {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Fatalf("not uploaded: %s, got: %v", w, got)
+		}
+	}
+}
+
 func createFile(fileNames []map[string]bool) error {
 	for _, f := range fileNames {
 
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+)
+
+// Алгоритмы хеширования файлов. Имя алгоритма записывается в pc.Info.HashAlgo рядом с хешем
+const (
+	HASH_SHA256 = "sha256"
+	HASH_BLAKE3 = "blake3"
+	HASH_XXH3   = "xxh3"
+)
+
+var ERROR__UNKNOWN_HASH__ = errors.New("err unknown hash algorithm")
+
+// hashers. Конструкторы хешей по имени алгоритма
+var hashers = map[string]func() hash.Hash{
+	HASH_SHA256: sha256.New,
+	HASH_BLAKE3: func() hash.Hash { return blake3.New(32, nil) },
+	HASH_XXH3:   func() hash.Hash { return xxh3.New() },
+}
+
+// Hasher. Алгоритм хеширования файлов. Нулевое значение - sha256, как до появления выбора алгоритма.
+// xxh3 не криптографический и нужен только для быстрого обнаружения изменений
+type Hasher struct {
+	name string
+}
+
+// NewHasher. Hasher по имени алгоритма, пустое имя - sha256 (записи старых версий без HashAlgo)
+func NewHasher(name string) (Hasher, error) {
+
+	if name == "" {
+		return Hasher{}, nil
+	}
+
+	if _, ok := hashers[name]; !ok {
+		return Hasher{}, fmt.Errorf("[utils.NewHasher()] name: %s, werr: %w;", name, ERROR__UNKNOWN_HASH__)
+	}
+
+	return Hasher{name: name}, nil
+}
+
+// Hashers. Алгоритмы, которые понимает эта сборка, первый - по умолчанию
+func Hashers() []string {
+	return []string{HASH_SHA256, HASH_BLAKE3, HASH_XXH3}
+}
+
+// Name. Имя алгоритма
+func (h Hasher) Name() string {
+
+	if h.name == "" {
+		return HASH_SHA256
+	}
+
+	return h.name
+}
+
+// New. Новый хеш этого алгоритма
+func (h Hasher) New() hash.Hash {
+	return hashers[h.Name()]()
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const PATH = "TestDir"
+
+func TestGetHash(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	file := filepath.Join(PATH, "file.txt")
+	if err := os.WriteFile(file, []byte("hello world"), 0666); err != nil {
+		panic(err)
+	}
+
+	// известные значения для "hello world"
+	want := map[string]string{
+		HASH_SHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		HASH_BLAKE3: "d74981efa70a0c880b8d8c1985d075dbcbf679b99a5f9914e5aaf96b831a9e24",
+		HASH_XXH3:   "d447b1ea40e6988b",
+	}
+
+	logger := logrus.New()
+	for _, name := range Hashers() {
+		h, err := NewHasher(name)
+		if err != nil {
+			panic(err)
+		}
+		hash, err := GetHash(logger, h, file)
+		if err != nil || hash != want[name] {
+			t.Fatalf("algo: %s, hash: %s, err: %v", name, hash, err)
+		}
+	}
+
+	// нулевой Hasher - sha256, как у записей без алгоритма
+	if hash, err := GetHash(logger, Hasher{}, file); err != nil || hash != want[HASH_SHA256] {
+		t.Fatalf("hash: %s, err: %v", hash, err)
+	}
+
+	if _, err := NewHasher("md5"); !errors.Is(err, ERROR__UNKNOWN_HASH__) {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -12,10 +11,6 @@ import (
 	er "github.com/preegnees/gobox/pkg/client/errors"
 )
 
-var (
-	IGNORE_STRS = []string{"~", "__gobox__", "tmp", "temp", "TEMP", "TMP"}
-)
-
 // GetModTime. Получение времения последней модификации
 func GetModTime(log *logrus.Logger, path string) (int64, error) {
 
@@ -55,10 +50,10 @@ func IsFolder(log *logrus.Logger, path string) (bool, error) {
 	return isFolder, nil
 }
 
-// GetHash. Возвращает хеш файла или папки
-func GetHash(log *logrus.Logger, path string) (string, error) {
+// GetHash. Возвращает хеш файла или папки алгоритмом hasher в hex
+func GetHash(log *logrus.Logger, hasher Hasher, path string) (string, error) {
 
-	log.Debug(fmt.Sprintf("[utils.GetHash()] path: %s;", path))
+	log.Debug(fmt.Sprintf("[utils.GetHash()] path: %s, algo: %s;", path, hasher.Name()))
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -75,7 +70,7 @@ func GetHash(log *logrus.Logger, path string) (string, error) {
 	}
 
 	if isFolder {
-		h := sha256.New()
+		h := hasher.New()
 
 		_, err = h.Write([]byte(path))
 		if err != nil {
@@ -92,7 +87,7 @@ func GetHash(log *logrus.Logger, path string) (string, error) {
 		return hash, nil
 	}
 
-	h := sha256.New()
+	h := hasher.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", fmt.Errorf(
 			"[utils.GetHash()] (io.Copy) fileName: %s, err: %v, werr: %w;",
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DEBOUNCE. Окно по умолчанию, за которое серия событий одного файла схлопывается в одно
+const DEBOUNCE = 300 * time.Millisecond
+
+// MAX_WAIT. Дольше серия не откладывается, даже если файл пишется без перерыва (например лог)
+const MAX_WAIT = 5 * time.Second
+
+// burst. Серия событий Create/Write/Chmod одного пути. op - итоговое событие, которое будет отправлено,
+// start - первое событие серии
+type burst struct {
+	op       fsnotify.Op
+	start    time.Time
+	deadline time.Time
+}
+
+// delay. Откладывает событие: пока по пути идут события, отправка сдвигается на debounce,
+// но не дальше maxWait от начала серии
+func (w *Watcher) delay(event fsnotify.Event) {
+
+	b, ok := w.bursts[event.Name]
+	if !ok {
+		// одиночный Chmod не отправляется, как и раньше
+		if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+			return
+		}
+		b = &burst{op: fsnotify.Write, start: time.Now()}
+		if event.Has(fsnotify.Create) {
+			b.op = fsnotify.Create
+		}
+		w.bursts[event.Name] = b
+	}
+
+	b.deadline = time.Now().Add(w.debounce)
+	if limit := b.start.Add(w.maxWait); limit.Before(b.deadline) {
+		b.deadline = limit
+	}
+}
+
+// cancelBurst. Путь исчез: забываем его серию. Возвращает true, если файл был создан внутри серии,
+// то есть сервер о нем еще не знает и удаление отправлять не нужно
+func (w *Watcher) cancelBurst(path string) bool {
+
+	b, ok := w.bursts[path]
+	if !ok {
+		return false
+	}
+	delete(w.bursts, path)
+
+	w.log.Debug(fmt.Sprintf("[watcher.cancelBurst()] path: %s, created in burst: %v;", path, b.op == fsnotify.Create))
+
+	return b.op == fsnotify.Create
+}
+
+// flushBursts. Отправляет серии, по которым событий не было дольше debounce или которые длятся maxWait,
+// с итоговым состоянием файла
+func (w *Watcher) flushBursts(now time.Time) {
+
+	for path, b := range w.bursts {
+		if now.Before(b.deadline) {
+			continue
+		}
+		delete(w.bursts, path)
+
+		if _, err := os.Stat(path); err != nil {
+			w.log.Debug(fmt.Sprintf("[watcher.flushBursts()] path: %s is gone, skip;", path))
+			continue
+		}
+
+		if err := w.sendChange(fsnotify.Event{Name: path, Op: b.op}); err != nil {
+			w.client.SendError(IDENTIFIER, w.cancel, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+)
+
+// MOVE_WINDOW. Сколько по умолчанию ждем Create после Rename/Remove, чтобы распознать перемещение
+const MOVE_WINDOW = 500 * time.Millisecond
+
+// meta. Что watcher знает о файле или папке. hash может быть пустым, тогда сравниваются размер и время
+type meta struct {
+	hash     string
+	size     int64
+	modTime  int64
+	isFolder bool
+}
+
+// gone. Путь, который исчез (Rename/Remove), но еще может оказаться перемещением
+type gone struct {
+	path     string
+	meta     meta
+	children []string
+	deadline time.Time
+}
+
+// remember. Запоминает метаданные пути
+func (w *Watcher) remember(path string, fi os.FileInfo, hash string) {
+
+	w.known[path] = meta{
+		hash:     hash,
+		size:     fi.Size(),
+		modTime:  fi.ModTime().UTC().UnixMicro(),
+		isFolder: fi.IsDir(),
+	}
+}
+
+// children. Имена и метаданные известных потомков папки (относительно папки)
+func (w *Watcher) children(path string) []string {
+
+	prefix := path + string(filepath.Separator)
+	res := []string{}
+	for p, m := range w.known {
+		if strings.HasPrefix(p, prefix) {
+			res = append(res, fmt.Sprintf("%s:%v:%d", strings.TrimPrefix(p, prefix), m.isFolder, m.size))
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// stash. Путь исчез: откладываем отправку удаления на moveWindow
+func (w *Watcher) stash(path string) {
+
+	for _, g := range w.gone {
+		if g.path == path {
+			return
+		}
+	}
+
+	m, ok := w.known[path]
+	if !ok {
+		// о пути ничего не известно: на сервер он не отправлялся (или уже перемещен),
+		// например повторное событие папки, которая сама была перемещена
+		w.log.Debug(fmt.Sprintf("[watcher.stash()] path: %s, unknown, skip;", path))
+		return
+	}
+
+	g := gone{path: path, meta: m, deadline: time.Now().Add(w.moveWindow)}
+	if m.isFolder {
+		g.children = w.children(path)
+	}
+
+	w.log.Debug(fmt.Sprintf("[watcher.stash()] path: %s, known: %v;", path, ok))
+
+	w.gone = append(w.gone, g)
+}
+
+// pair. Ищет среди исчезнувших путей тот, что появился как path
+func (w *Watcher) pair(path string) (gone, bool) {
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return gone{}, false
+	}
+
+	hash := ""
+	for i, g := range w.gone {
+		if g.path == path || g.meta.isFolder != fi.IsDir() || (g.meta == meta{}) {
+			continue
+		}
+
+		match := false
+		switch {
+		case fi.IsDir():
+			match = equal(g.children, w.scan(path))
+		case g.meta.hash != "":
+			if hash == "" {
+				if hash, err = ut.GetHash(w.log, w.hasher, path); err != nil {
+					return gone{}, false
+				}
+			}
+			match = hash == g.meta.hash
+		default:
+			match = g.meta.size == fi.Size() && g.meta.modTime == fi.ModTime().UTC().UnixMicro()
+		}
+
+		if match {
+			w.gone = append(w.gone[:i], w.gone[i+1:]...)
+			return g, true
+		}
+	}
+
+	return gone{}, false
+}
+
+// scan. Потомки папки на диске в том же виде, что и children
+func (w *Watcher) scan(path string) []string {
+
+	res := []string{}
+	filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == path {
+			return nil
+		}
+		rel, _ := filepath.Rel(path, p)
+		res = append(res, fmt.Sprintf("%s:%v:%d", rel, fi.IsDir(), fi.Size()))
+		return nil
+	})
+	sort.Strings(res)
+	return res
+}
+
+// flushGone. Исчезнувшие пути, для которых не нашлось пары, отправляются как удаленные
+func (w *Watcher) flushGone(now time.Time) {
+
+	left := w.gone[:0]
+	for _, g := range w.gone {
+		if now.Before(g.deadline) {
+			left = append(left, g)
+			continue
+		}
+
+		w.log.Debug(fmt.Sprintf("[watcher.flushGone()] removed: %s;", g.path))
+
+		if err := w.sendChange(fsnotify.Event{Name: g.path, Op: fsnotify.Remove}); err != nil {
+			w.client.SendError(IDENTIFIER, w.cancel, err)
+		}
+		w.forget(g.path)
+		w.unwatch(g.path)
+	}
+	w.gone = left
+}
+
+// sendMove. Отправляет одно событие перемещения вместо удаления и создания
+func (w *Watcher) sendMove(g gone, path string) error {
+
+	w.log.Debug(fmt.Sprintf("[watcher.sendMove()] old: %s, new: %s;", g.path, path))
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("[watcher.sendMove()] (os.Stat) path: %s, err: %w;", path, err)
+	}
+
+	hash := g.meta.hash
+	if hash == "" || fi.IsDir() {
+		if hash, err = ut.GetHash(w.log, w.hasher, path); err != nil {
+			return err
+		}
+	}
+
+	// старые пути потомков переезжают вместе с папкой
+	w.forget(g.path)
+	w.unwatch(g.path)
+	w.remember(path, fi, hash)
+	if fi.IsDir() {
+		w.add(path)
+		if err := w.onStart(path); err != nil {
+			return err
+		}
+	}
+
+	// ожидание старого пути снимается вместе с новым, иначе до конца TTL оно проглотит
+	// настоящее удаление или перемещение файла, созданного там заново
+	w.echo.Suppress(g.path, fsnotify.Rename|fsnotify.Remove, "")
+	if w.echo.Suppress(path, fsnotify.Create, hash) {
+		w.log.Debug(fmt.Sprintf("[watcher.sendMove()] suppress echo, path: %s;", path))
+		return nil
+	}
+
+	oldRel, err := pc.ToRel(w.dir, g.path)
+	if err != nil {
+		return err
+	}
+
+	rel, err := pc.ToRel(w.dir, path)
+	if err != nil {
+		return err
+	}
+
+	info := pc.Info{
+		Action:   fsnotify.Rename,
+		OldPath:  oldRel,
+		Path:     rel,
+		ModTime:  fi.ModTime().UTC().UnixMicro(),
+		Hash:     hash,
+		HashAlgo: w.hasher.Name(),
+		IsFolder: fi.IsDir(),
+	}
+
+	w.client.SendDeviation(info)
+
+	w.log.Debug(fmt.Sprintf("[watcher.sendMove()] sent info: %s;", info.ToString()))
+
+	return nil
+}
+
+// forget. Забывает путь и всех его потомков
+func (w *Watcher) forget(path string) {
+
+	prefix := path + string(filepath.Separator)
+	for p := range w.known {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(w.known, p)
+		}
+	}
+}
+
+// unwatch. Перестает наблюдать за папкой и ее подпапками, если они наблюдались
+func (w *Watcher) unwatch(path string) {
+
+	prefix := path + string(filepath.Separator)
+	for _, p := range w.watcher.WatchList() {
+		if p == path || strings.HasPrefix(p, prefix) {
+			// удаленную папку fsnotify может уже не наблюдать, поэтому ошибка не важна
+			if err := w.watcher.Remove(p); err != nil {
+				w.log.Debug(fmt.Sprintf("[watcher.unwatch()] (watcher.Remove) path: %s, err: %v;", p, err))
+			}
+		}
+	}
+}
+
+func equal(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -6,13 +6,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 
 	cl "github.com/preegnees/gobox/pkg/client/client"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	"github.com/preegnees/gobox/pkg/client/file/echo"
+	"github.com/preegnees/gobox/pkg/client/file/ignore"
 	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
 	ut "github.com/preegnees/gobox/pkg/client/file/utils"
 	er "github.com/preegnees/gobox/pkg/client/errors"
@@ -29,19 +31,29 @@ type IWatcher interface {
 	Watch()
 }
 
-// ConfWatcher. Конфигурация для мониторинга
+// ConfWatcher. Конфигурация для мониторинга.
+// Echo - реестр изменений, которые сделал сам клиент (saver), их не нужно отправлять на сервер.
+// MoveWindow - сколько ждать Create после Rename/Remove, чтобы отправить одно перемещение.
+// Debounce - за какое время без новых событий серия Create/Write/Chmod файла схлопывается в одно событие.
+// MaxWait - через сколько после начала серии событие отправляется, даже если файл все еще пишется.
+// Hasher - алгоритм хеша файлов, по умолчанию sha256
 type ConfWatcher struct {
-	Ctx    context.Context
-	Log    *logrus.Logger
-	Dir    string
-	Client cl.IClient
+	Ctx        context.Context
+	Log        *logrus.Logger
+	Dir        string
+	Client     cl.IClient
+	Echo       *echo.Registry
+	MoveWindow time.Duration
+	Debounce   time.Duration
+	MaxWait    time.Duration
+	Hasher     ut.Hasher
 }
 
 func (c *ConfWatcher) ToString() string {
 
 	return fmt.Sprintf(
-		"context: %v, levelLog: %s, dir: %s",
-		c.Ctx, c.Log.Level, c.Dir,
+		"context: %v, levelLog: %s, dir: %s, hasher: %s",
+		c.Ctx, c.Log.Level, c.Dir, c.Hasher.Name(),
 	)
 }
 
@@ -53,6 +65,16 @@ type Watcher struct {
 	watcher *fsnotify.Watcher
 	dir     string
 	client  cl.IClient
+	echo    *echo.Registry
+	hasher  ut.Hasher
+	ignore  *ignore.Matcher
+	// known, gone и bursts используются только из горутины Watch
+	known      map[string]meta
+	gone       []gone
+	bursts     map[string]*burst
+	moveWindow time.Duration
+	debounce   time.Duration
+	maxWait    time.Duration
 }
 
 func (w *Watcher) ToString() string {
@@ -90,6 +112,27 @@ func New(cnf ConfWatcher) (*Watcher, error) {
 		return nil, fmt.Errorf("[watcher.New()] path: %s is not dir", cnf.Dir)
 	}
 
+	if cnf.MoveWindow <= 0 {
+		cnf.MoveWindow = MOVE_WINDOW
+	}
+
+	if cnf.Debounce <= 0 {
+		cnf.Debounce = DEBOUNCE
+	}
+
+	if cnf.MaxWait <= 0 {
+		cnf.MaxWait = MAX_WAIT
+	}
+
+	if cnf.MaxWait < cnf.Debounce {
+		cnf.MaxWait = cnf.Debounce
+	}
+
+	ign, err := ignore.New(ignore.ConfIgnore{Log: cnf.Log, Dir: cnf.Dir})
+	if err != nil {
+		return nil, fmt.Errorf("[watcher.New()] (ignore.New) err: %w;", err)
+	}
+
 	ctxwrap, cancel := context.WithCancel(cnf.Ctx)
 
 	cnf.Log.Debug("[watcher.New()] watcher creating;")
@@ -101,6 +144,14 @@ func New(cnf ConfWatcher) (*Watcher, error) {
 		log:     cnf.Log,
 		dir:     cnf.Dir,
 		client:  cnf.Client,
+		echo:    cnf.Echo,
+		hasher:  cnf.Hasher,
+		ignore:  ign,
+		known:      make(map[string]meta),
+		bursts:     make(map[string]*burst),
+		moveWindow: cnf.MoveWindow,
+		debounce:   cnf.Debounce,
+		maxWait:    cnf.MaxWait,
 	}, nil
 }
 
@@ -138,12 +189,23 @@ func (w *Watcher) Watch() {
 		}
 	}()
 
+	period := w.moveWindow
+	if w.debounce < period {
+		period = w.debounce
+	}
+	tick := time.NewTicker(period / 2)
+	defer tick.Stop()
+
 	for {
 		select {
 		case <-w.ctx.Done():
 
 			w.log.Debug(fmt.Sprintf("[watcher.Watch()] context done;"))
 			return
+		case now := <-tick.C:
+
+			w.flushBursts(now)
+			w.flushGone(now)
 		case err, ok := <-w.watcher.Errors:
 
 			if !ok {
@@ -173,15 +235,18 @@ func (w *Watcher) Watch() {
 
 			w.log.Debug(fmt.Sprintf("[watcher.Watch()] action %d, event: %s;", event.Op, event.Name))
 
-			pass := false
-			for _, val := range ut.IGNORE_STRS {
-				if strings.Contains(event.Name, val) {
-					w.log.Debug(fmt.Sprintf("[watcher.Watch()] name: %s include substr: %s;", event.Name, val))
-					pass = true
-				}
+			// fsnotify присылает события без имени для папок, которые сами были перемещены,
+			// события самой папки синхронизации на сервер не отправляются
+			if event.Name == "" || filepath.Clean(event.Name) == filepath.Clean(w.dir) {
+				continue
 			}
 
-			if pass {
+			// правила могли измениться, при следующей проверке они будут перечитаны
+			if ignore.IsRulesFile(event.Name) {
+				w.ignore.Reload(filepath.Dir(event.Name))
+			}
+
+			if w.ignored(event.Name) {
 				continue
 			}
 
@@ -196,30 +261,37 @@ func (w *Watcher) Watch() {
 				// Это нужно, чтобы не было уведолмления о записи от вышележащих папок
 				// Например: folder1/folder2/file.txt, при изменении file.txt сроботают также folder1 && 2
 				if !isFolder {
-					if err := w.sendChange(event); err != nil {
-						w.client.SendError(IDENTIFIER, w.cancel, err)
-					}
+					w.delay(event)
 				}
 			}
 
-			if event.Has(fsnotify.Remove) {
-				w.log.Debug(fmt.Sprintf("[watcher.Watch()] remove file: %s;", event.Name))
+			if event.Has(fsnotify.Chmod) {
+				w.delay(event)
+			}
 
-				if err := w.sendChange(event); err != nil {
-					w.client.SendError(IDENTIFIER, w.cancel, err)
-				}
+			// Удаление отправляется не сразу: если путь вскоре появится в другом месте, это перемещение
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				w.log.Debug(fmt.Sprintf("[watcher.Watch()] remove or rename file: %s;", event.Name))
 
-				w.remove(event.Name)
+				// Create и Remove внутри одной серии взаимно уничтожаются
+				if !w.cancelBurst(event.Name) {
+					w.stash(event.Name)
+				}
 			}
 
 			// Тут может быть задержка, из-за возможных ошибок в u.IsFolder (см.)
 			if event.Has(fsnotify.Create) {
 				w.log.Debug(fmt.Sprintf("[watcher.Watch()] create file: %s;", event.Name))
 
-				if err := w.sendChange(event); err != nil {
-					w.client.SendError(IDENTIFIER, w.cancel, err)
+				if g, ok := w.pair(event.Name); ok {
+					if err := w.sendMove(g, event.Name); err != nil {
+						w.client.SendError(IDENTIFIER, w.cancel, err)
+					}
+					continue
 				}
 
+				w.delay(event)
+
 				isFolder, err := ut.IsFolder(w.log, event.Name)
 				if err != nil {
 					w.client.SendError(IDENTIFIER, w.cancel, err)
@@ -272,6 +344,14 @@ func (w *Watcher) onStart(path string) error {
 			return err
 		}
 
+		if w.ignore.Match(curPath, isFolder) {
+			continue
+		}
+
+		if _, ok := w.known[curPath]; !ok {
+			w.remember(curPath, v, "")
+		}
+
 		if isFolder {
 			w.add(curPath)
 			if err := w.onStart(curPath); err != nil {
@@ -285,6 +365,19 @@ func (w *Watcher) onStart(path string) error {
 	return nil
 }
 
+// ignored. Подходит ли путь под правила игнорирования. Для исчезнувшего пути тип берется из known
+func (w *Watcher) ignored(path string) bool {
+
+	isFolder := false
+	if fi, err := os.Stat(path); err == nil {
+		isFolder = fi.IsDir()
+	} else if m, ok := w.known[path]; ok {
+		isFolder = m.isFolder
+	}
+
+	return w.ignore.Match(path, isFolder)
+}
+
 // sendChange. отправляет в канал изменения фаловой системы
 func (w *Watcher) sendChange(event fsnotify.Event) error {
 
@@ -293,12 +386,18 @@ func (w *Watcher) sendChange(event fsnotify.Event) error {
 	var modTime int64 = 0
 	var hash string = ""
 	var isFolder bool = false
+	var size int64 = 0
+	var chunks []pc.Chunk
 	var err error
 
 	if !event.Op.Has(fsnotify.Remove) {
 		modTime, err = ut.GetModTime(w.log, event.Name)
-		hash, err = ut.GetHash(w.log, event.Name)
 		isFolder, err = ut.IsFolder(w.log, event.Name)
+		if isFolder {
+			hash, err = ut.GetHash(w.log, w.hasher, event.Name)
+		} else {
+			hash, size, chunks, err = chunker.Manifest(w.log, w.hasher, event.Name, chunker.ConfChunker{})
+		}
 	} else {
 		modTime = 0
 		hash = ""
@@ -309,12 +408,32 @@ func (w *Watcher) sendChange(event fsnotify.Event) error {
 		return err
 	}
 
+	if !event.Op.Has(fsnotify.Remove) {
+		if fi, err := os.Stat(event.Name); err == nil {
+			w.remember(event.Name, fi, hash)
+		}
+	}
+
+	// событие вызвано изменением с сервера (saver), обратно его не отправляем
+	if w.echo.Suppress(event.Name, event.Op, hash) {
+		w.log.Debug(fmt.Sprintf("[watcher.sendChange()] suppress echo, action: %d, path: %s;", event.Op, event.Name))
+		return nil
+	}
+
+	rel, err := pc.ToRel(w.dir, event.Name)
+	if err != nil {
+		return err
+	}
+
 	newEvent := pc.Info{
 		Action:   event.Op,
-		Path:     event.Name,
+		Path:     rel,
 		ModTime:  modTime,
 		Hash:     hash,
+		HashAlgo: w.hasher.Name(),
 		IsFolder: isFolder,
+		Size:     size,
+		Chunks:   chunks,
 	}
 
 	w.client.SendDeviation(newEvent)
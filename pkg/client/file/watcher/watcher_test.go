@@ -9,9 +9,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
 	cl "github.com/preegnees/gobox/pkg/client/client"
+	"github.com/preegnees/gobox/pkg/client/file/echo"
 	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
-	"github.com/sirupsen/logrus"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
 )
 
 const PATH = "TestDir"
@@ -109,10 +113,10 @@ func TestCreateFile(t *testing.T) {
 
 	interDev := func(info pc.Info) {
 		t.Log(fmt.Sprintf("info: %s", info.ToString()))
-		if info.Path == fileName1 {
+		if info.Path == rel(fileName1) {
 			fileOK = true
 		}
-		if info.Path == folderName1 {
+		if info.Path == rel(folderName1) {
 			folderOK = true
 		}
 		if fileOK && folderOK {
@@ -175,3 +179,383 @@ func TestCreateFile(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestSuppressEcho(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	remote := filepath.Join(PATH, "remote.txt")
+	local := filepath.Join(PATH, "local.txt")
+	marker := filepath.Join(PATH, "marker.txt")
+	moved := filepath.Join(PATH, "moved.txt")
+	target := filepath.Join(PATH, "target.txt")
+	for _, f := range []string{remote, moved} {
+		if err := os.WriteFile(f, []byte(f), 0666); err != nil {
+			panic(err)
+		}
+	}
+
+	var ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+
+	var mx sync.Mutex
+	var got []pc.Info
+
+	interErr := func(id int, cancel context.CancelFunc, err error) {
+		t.Log(fmt.Sprintf("id: %d, err: %v", id, err))
+	}
+
+	interDev := func(info pc.Info) {
+		t.Log(fmt.Sprintf("info: %s", info.ToString()))
+		mx.Lock()
+		got = append(got, info)
+		mx.Unlock()
+		if info.Path == rel(marker) {
+			cancel()
+		}
+	}
+
+	registry := echo.New(time.Second)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	dw, err := New(ConfWatcher{
+		Ctx:    ctx,
+		Log:    logger,
+		Dir:    PATH,
+		Client: &cli{intersepterErr: interErr, intersepterDev: interDev},
+		Echo:   registry,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		dw.Watch()
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// удаление пришло с сервера
+	registry.Expect(remote, fsnotify.Remove, "")
+	if err := os.Remove(remote); err != nil {
+		panic(err)
+	}
+
+	// перемещение пришло с сервера (как делает saver.Rename)
+	registry.Expect(moved, fsnotify.Rename|fsnotify.Remove, "")
+	registry.Expect(target, fsnotify.Create, "")
+	if err := os.Rename(moved, target); err != nil {
+		panic(err)
+	}
+
+	// с сервера ждали другое содержимое, значит файл изменил пользователь
+	registry.Expect(local, fsnotify.Create|fsnotify.Write, "hash from server")
+	if err := os.WriteFile(local, []byte("local"), 0666); err != nil {
+		panic(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	// а этот файл создал пользователь
+	if err := os.WriteFile(marker, nil, 0666); err != nil {
+		panic(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("marker event not received")
+	}
+
+	// перемещение распознано, и ожидания обоих путей сняты
+	if registry.Suppress(moved, fsnotify.Remove, "") {
+		t.Fatal("expectation of old path is left")
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	localSent := false
+	for _, info := range got {
+		if info.Path == rel(remote) || info.Path == rel(target) {
+			t.Fatalf("echo event sent: %s", info.ToString())
+		}
+		if info.Path == rel(local) {
+			localSent = true
+		}
+	}
+	if !localSent {
+		t.Fatal("local change is suppressed")
+	}
+}
+
+func TestMove(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	file := filepath.Join(PATH, "file.txt")
+	folder := filepath.Join(PATH, "project")
+	removed := filepath.Join(PATH, "removed.txt")
+	if err := os.MkdirAll(filepath.Join(folder, "src"), 0777); err != nil {
+		panic(err)
+	}
+	for _, f := range []string{file, removed, filepath.Join(folder, "src", "main.go")} {
+		if err := os.WriteFile(f, []byte(f), 0666); err != nil {
+			panic(err)
+		}
+	}
+
+	movedFile := filepath.Join(PATH, "renamed.txt")
+	movedFolder := filepath.Join(PATH, "archive")
+	if err := os.MkdirAll(movedFolder, 0777); err != nil {
+		panic(err)
+	}
+	movedFolder = filepath.Join(movedFolder, "project")
+
+	var ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+
+	infos := make(chan pc.Info, 16)
+
+	interErr := func(id int, cancel context.CancelFunc, err error) {
+		t.Log(fmt.Sprintf("id: %d, err: %v", id, err))
+	}
+
+	interDev := func(info pc.Info) {
+		t.Log(fmt.Sprintf("info: %s", info.ToString()))
+		infos <- info
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	dw, err := New(ConfWatcher{
+		Ctx:        ctx,
+		Log:        logger,
+		Dir:        PATH,
+		Client:     &cli{intersepterErr: interErr, intersepterDev: interDev},
+		MoveWindow: time.Second,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	go dw.Watch()
+	time.Sleep(200 * time.Millisecond)
+
+	if err := os.Rename(file, movedFile); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(folder, movedFolder); err != nil {
+		panic(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		panic(err)
+	}
+
+	want := map[string]pc.Info{
+		rel(movedFile):   {Action: fsnotify.Rename, OldPath: rel(file), Path: rel(movedFile)},
+		rel(movedFolder): {Action: fsnotify.Rename, OldPath: rel(folder), Path: rel(movedFolder), IsFolder: true},
+		rel(removed):     {Action: fsnotify.Remove, Path: rel(removed)},
+	}
+
+	timeout := time.After(3 * time.Second)
+	for len(want) > 0 {
+		select {
+		case info := <-infos:
+			w, ok := want[info.Path]
+			if !ok {
+				t.Fatalf("unexpected info: %s", info.ToString())
+			}
+			if info.Action != w.Action || info.OldPath != w.OldPath || info.IsFolder != w.IsFolder {
+				t.Fatalf("info: %s, want: %s", info.ToString(), w.ToString())
+			}
+			delete(want, info.Path)
+		case <-timeout:
+			t.Fatalf("not received: %v", want)
+		}
+	}
+
+	// изменения внутри перемещенной папки тоже видны
+	inner := filepath.Join(movedFolder, "src", "new.go")
+	if err := os.WriteFile(inner, nil, 0666); err != nil {
+		panic(err)
+	}
+	select {
+	case info := <-infos:
+		if info.Path != rel(inner) {
+			t.Fatalf("unexpected info: %s", info.ToString())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("event inside moved folder is not received")
+	}
+}
+
+func TestDebounce(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	file := filepath.Join(PATH, "file.txt")
+	swap := filepath.Join(PATH, "file.swp")
+	marker := filepath.Join(PATH, "marker.txt")
+
+	var ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+
+	infos := make(chan pc.Info, 64)
+
+	interErr := func(id int, cancel context.CancelFunc, err error) {
+		t.Log(fmt.Sprintf("id: %d, err: %v", id, err))
+	}
+
+	interDev := func(info pc.Info) {
+		t.Log(fmt.Sprintf("info: %s", info.ToString()))
+		infos <- info
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	dw, err := New(ConfWatcher{
+		Ctx:      ctx,
+		Log:      logger,
+		Dir:      PATH,
+		Client:   &cli{intersepterErr: interErr, intersepterDev: interDev},
+		Debounce: 200 * time.Millisecond,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	go dw.Watch()
+	time.Sleep(200 * time.Millisecond)
+
+	// редактор пишет файл кусками
+	f, err := os.Create(file)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		f.Write([]byte(fmt.Sprintf("line %d\n", i)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Close()
+
+	// временный файл живет меньше окна
+	if err := os.WriteFile(swap, []byte("swap"), 0666); err != nil {
+		panic(err)
+	}
+	if err := os.Remove(swap); err != nil {
+		panic(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if err := os.WriteFile(marker, nil, 0666); err != nil {
+		panic(err)
+	}
+
+	var got []pc.Info
+	timeout := time.After(3 * time.Second)
+	for done := false; !done; {
+		select {
+		case info := <-infos:
+			got = append(got, info)
+			done = info.Path == rel(marker)
+		case <-timeout:
+			t.Fatalf("marker is not received, got: %v", got)
+		}
+	}
+
+	if len(got) != 2 || got[0].Path != rel(file) || got[0].Action != fsnotify.Create {
+		t.Fatalf("got: %v", got)
+	}
+
+	hash, err := ut.GetHash(logger, ut.Hasher{}, file)
+	if err != nil {
+		panic(err)
+	}
+	if got[0].Hash != hash {
+		panic("event does not carry final state")
+	}
+}
+
+func TestDebounceMaxWait(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	file := filepath.Join(PATH, "app.log")
+
+	var ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+
+	infos := make(chan pc.Info, 64)
+
+	interErr := func(id int, cancel context.CancelFunc, err error) {
+		t.Log(fmt.Sprintf("id: %d, err: %v", id, err))
+	}
+
+	interDev := func(info pc.Info) {
+		infos <- info
+	}
+
+	dw, err := New(ConfWatcher{
+		Ctx:      ctx,
+		Log:      logrus.New(),
+		Dir:      PATH,
+		Client:   &cli{intersepterErr: interErr, intersepterDev: interDev},
+		Debounce: 200 * time.Millisecond,
+		MaxWait:  500 * time.Millisecond,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	go dw.Watch()
+	time.Sleep(200 * time.Millisecond)
+
+	// файл пишется чаще, чем раз в debounce, и паузы не бывает
+	f, err := os.Create(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		f.Write([]byte("line\n"))
+		time.Sleep(50 * time.Millisecond)
+
+		select {
+		case info := <-infos:
+			if info.Path != rel(file) {
+				t.Fatalf("info: %s", info.ToString())
+			}
+			return
+		default:
+		}
+	}
+
+	t.Fatal("file written without pause is never sent")
+}
+
+// rel. Путь, который watcher кладет в pc.Info
+func rel(path string) string {
+
+	rel, err := pc.ToRel(PATH, path)
+	if err != nil {
+		panic(err)
+	}
+	return rel
+}
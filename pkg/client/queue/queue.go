@@ -0,0 +1,357 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+// Имена файлов журнала. Префикс __gobox__ нужен, чтобы watcher и uploader их игнорировали
+const (
+	FILE      = "__gobox__queue"
+	HEAD_FILE = "__gobox__queue.head"
+)
+
+// COMPACT. Сколько отправленных событий копится в начале журнала, прежде чем он переписывается без них
+const COMPACT = 1024
+
+// HEADER. Первая строка журнала "#<поколение>". Поколение растет при каждом compact и записывается в HEAD_FILE
+// вместе с head, поэтому после аварии между заменой журнала и записью head видно, что head относится к старому журналу.
+// Журнал без заголовка - поколение 0
+const HEADER = "#"
+
+// ConfQueue. Конфигурация очереди
+type ConfQueue struct {
+	Log *logrus.Logger
+	Dir string
+}
+
+func (c *ConfQueue) ToString() string {
+
+	return fmt.Sprintf("levelLog: %s, dir: %s", c.Log.Level, c.Dir)
+}
+
+// Queue. Очередь неотправленных событий, которая переживает перезапуск клиента.
+// События дописываются в журнал, а поколение журнала и номер первого неотправленного события хранятся в HEAD_FILE
+type Queue struct {
+	mx    sync.Mutex
+	log   *logrus.Logger
+	dir   string
+	file  *os.File
+	items []pc.Info
+	head  int
+	gen   int
+}
+
+// New. Открывает очередь в папке синхронизации и загружает неотправленные события
+func New(cnf ConfQueue) (*Queue, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[queue.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[queue.New()] struct cnf: %v;", cnf.ToString()))
+
+	q := &Queue{
+		log: cnf.Log,
+		dir: cnf.Dir,
+	}
+
+	broken, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(cnf.Dir, FILE), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("[queue.New()] (os.OpenFile) dir: %s, err: %w;", cnf.Dir, err)
+	}
+	q.file = file
+
+	// без испорченных записей номера событий в памяти и в журнале снова совпадают
+	if broken {
+		if err := q.compact(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[queue.New()] backlog: %d;", q.len()))
+
+	return q, nil
+}
+
+// Push. Добавляет событие в конец очереди и сбрасывает его на диск
+func (q *Queue) Push(info pc.Info) error {
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("[queue.Push()] (json.Marshal) path: %s, err: %w;", info.Path, err)
+	}
+
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("[queue.Push()] (file.Write) path: %s, err: %w;", info.Path, err)
+	}
+
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("[queue.Push()] (file.Sync) path: %s, err: %w;", info.Path, err)
+	}
+
+	q.items = append(q.items, info)
+
+	return nil
+}
+
+// Peek. Первое неотправленное событие
+func (q *Queue) Peek() (pc.Info, bool) {
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	if q.head >= len(q.items) {
+		return pc.Info{}, false
+	}
+	return q.items[q.head], true
+}
+
+// Pop. Отмечает первое событие отправленным. Когда очередь пустеет, журнал обрезается,
+// а когда отправленных событий набирается COMPACT - переписывается без них
+func (q *Queue) Pop() error {
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	if q.head >= len(q.items) {
+		return nil
+	}
+	q.head++
+
+	if q.head == len(q.items) {
+		if err := q.file.Truncate(0); err != nil {
+			return fmt.Errorf("[queue.Pop()] (file.Truncate) err: %w;", err)
+		}
+		// поколение журнала сохраняется, иначе head в HEAD_FILE отнесется к другому журналу
+		if _, err := q.file.Write(header(q.gen)); err != nil {
+			return fmt.Errorf("[queue.Pop()] (file.Write) header, err: %w;", err)
+		}
+		q.items = q.items[:0]
+		q.head = 0
+	}
+
+	if q.head >= COMPACT {
+		return q.compact()
+	}
+
+	return saveHead(q.dir, q.gen, q.head)
+}
+
+// Len. Количество неотправленных событий
+func (q *Queue) Len() int {
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	return q.len()
+}
+
+// Close. Закрывает журнал
+func (q *Queue) Close() error {
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	return q.file.Close()
+}
+
+func (q *Queue) len() int {
+	return len(q.items) - q.head
+}
+
+// header. Заголовок журнала поколения gen, у поколения 0 заголовка нет
+func header(gen int) []byte {
+
+	if gen == 0 {
+		return nil
+	}
+	return []byte(HEADER + strconv.Itoa(gen) + "\n")
+}
+
+// saveHead. Атомарно записывает поколение журнала и номер первого неотправленного события в нем
+func saveHead(dir string, gen int, head int) error {
+
+	path := filepath.Join(dir, HEAD_FILE)
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", gen, head)), 0666); err != nil {
+		return fmt.Errorf("[queue.saveHead()] (os.WriteFile) err: %w;", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("[queue.saveHead()] (os.Rename) err: %w;", err)
+	}
+	return nil
+}
+
+// compact. Переписывает журнал без отправленных событий под новым поколением.
+// Сначала заменяется журнал, потом записывается head, и только потом меняется состояние в памяти.
+// После аварии между заменой журнала и записью head поколения не совпадут, и load отправит журнал целиком
+func (q *Queue) compact() error {
+
+	path := filepath.Join(q.dir, FILE)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("[queue.compact()] (os.OpenFile) err: %w;", err)
+	}
+
+	gen := q.gen + 1
+
+	w := bufio.NewWriter(f)
+	w.Write(header(gen))
+	for _, info := range q.items[q.head:] {
+		data, err := json.Marshal(info)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("[queue.compact()] (json.Marshal) path: %s, err: %w;", info.Path, err)
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("[queue.compact()] (w.Flush) err: %w;", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("[queue.compact()] (f.Sync) err: %w;", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("[queue.compact()] (os.Rename) err: %w;", err)
+	}
+
+	// старый дескриптор указывает на замененный журнал, Push в него потерял бы события
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("[queue.compact()] (os.OpenFile) err: %w;", err)
+	}
+
+	// без нового head на диске load все равно разберется по поколению
+	if err := saveHead(q.dir, gen, 0); err != nil {
+		q.log.Warn(err)
+	}
+
+	q.file.Close()
+	q.file = file
+	q.items = append([]pc.Info(nil), q.items[q.head:]...)
+	q.head = 0
+	q.gen = gen
+
+	q.log.Debug(fmt.Sprintf("[queue.compact()] gen: %d, backlog: %d;", q.gen, q.len()))
+
+	return nil
+}
+
+// load. Читает журнал, его поколение и номер первого неотправленного события.
+// Испорченная запись тоже занимает номер в журнале, поэтому учитывается в head. broken - были ли такие записи
+func (q *Queue) load() (bool, error) {
+
+	gen, head := 0, 0
+	data, err := os.ReadFile(filepath.Join(q.dir, HEAD_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("[queue.load()] (os.ReadFile) head, err: %w;", err)
+	}
+	if err == nil {
+		// старый HEAD_FILE - только номер, это поколение 0
+		fields := strings.Fields(string(data))
+		if len(fields) == 1 {
+			fields = []string{"0", fields[0]}
+		}
+		if len(fields) != 2 {
+			return false, fmt.Errorf("[queue.load()] head: %s, broken head file;", data)
+		}
+		if gen, err = strconv.Atoi(fields[0]); err == nil {
+			head, err = strconv.Atoi(fields[1])
+		}
+		if err != nil {
+			return false, fmt.Errorf("[queue.load()] (strconv.Atoi) head: %s, err: %w;", data, err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(q.dir, FILE))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[queue.load()] (os.Open) err: %w;", err)
+	}
+	defer f.Close()
+
+	// size - длина журнала до конца последней целой строки, records - номер следующей записи
+	var size int64
+	records, sent, broken := 0, 0, false
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				// недописанная строка остается после аварийной остановки. Ее отрезаем,
+				// иначе следующий Push допишется к ней и событие пропадет
+				q.log.Warn(fmt.Sprintf("[queue.load()] truncate torn record, size: %d;", size))
+				if err := os.Truncate(f.Name(), size); err != nil {
+					return false, fmt.Errorf("[queue.load()] (os.Truncate) err: %w;", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("[queue.load()] (r.ReadBytes) err: %w;", err)
+		}
+
+		if size == 0 && strings.HasPrefix(string(line), HEADER) {
+			size += int64(len(line))
+			if q.gen, err = strconv.Atoi(strings.TrimSpace(string(line[len(HEADER):]))); err != nil {
+				return false, fmt.Errorf("[queue.load()] (strconv.Atoi) header: %s, err: %w;", line, err)
+			}
+			continue
+		}
+		size += int64(len(line))
+
+		record := records
+		records++
+
+		var info pc.Info
+		if err := json.Unmarshal(line, &info); err != nil {
+			q.log.Warn(fmt.Sprintf("[queue.load()] skip broken record: %d, err: %v;", record, err))
+			broken = true
+			continue
+		}
+		q.items = append(q.items, info)
+		if record < head {
+			sent++
+		}
+	}
+
+	// журнал заменили (compact), а head записать не успели: отправляется весь новый журнал.
+	// Если журнал только обрезали (Pop), он пустой, и head тоже 0
+	if gen != q.gen {
+		q.log.Warn(fmt.Sprintf("[queue.load()] head gen: %d, journal gen: %d, resend journal;", gen, q.gen))
+		sent = 0
+	}
+	q.head = sent
+
+	return broken, nil
+}
@@ -0,0 +1,254 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+const PATH = "TestDir"
+
+func TestPersistOrder(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	q, err := New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := q.Push(pc.Info{Action: fsnotify.Write, Path: fmt.Sprintf("file%d", i)}); err != nil {
+			panic(err)
+		}
+	}
+	if err := q.Pop(); err != nil {
+		panic(err)
+	}
+	q.Close()
+
+	q, err = New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 2 {
+		t.Fatalf("len: %d", q.Len())
+	}
+
+	for i := 1; i < 3; i++ {
+		info, ok := q.Peek()
+		if !ok || info.Path != fmt.Sprintf("file%d", i) {
+			t.Fatalf("unexpected: %s", info.ToString())
+		}
+		if err := q.Pop(); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, ok := q.Peek(); ok {
+		panic("queue is not empty")
+	}
+
+	stat, err := os.Stat(q.file.Name())
+	if err != nil {
+		panic(err)
+	}
+	if stat.Size() != 0 {
+		panic("journal is not truncated")
+	}
+}
+
+func TestTornTail(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	logger := logrus.New()
+
+	q, err := New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	if err := q.Push(pc.Info{Action: fsnotify.Write, Path: "file0"}); err != nil {
+		panic(err)
+	}
+	// запись оборвалась посередине строки
+	if _, err := q.file.Write([]byte(`{"Path":"fi`)); err != nil {
+		panic(err)
+	}
+	q.Close()
+
+	q, err = New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	if err := q.Push(pc.Info{Action: fsnotify.Write, Path: "file1"}); err != nil {
+		panic(err)
+	}
+	q.Close()
+
+	q, err = New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 2 {
+		t.Fatalf("len: %d", q.Len())
+	}
+	for i := 0; i < 2; i++ {
+		info, ok := q.Peek()
+		if !ok || info.Path != fmt.Sprintf("file%d", i) {
+			t.Fatalf("unexpected: %s", info.ToString())
+		}
+		if err := q.Pop(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	logger := logrus.New()
+
+	q, err := New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	// очередь ни разу не пустеет, журнал все равно не должен расти бесконечно
+	for i := 0; i < COMPACT+2; i++ {
+		if err := q.Push(pc.Info{Action: fsnotify.Write, Path: fmt.Sprintf("file%d", i)}); err != nil {
+			panic(err)
+		}
+		if i == 0 {
+			continue
+		}
+		if err := q.Pop(); err != nil {
+			panic(err)
+		}
+	}
+
+	if q.head >= COMPACT {
+		t.Fatalf("journal is not compacted, head: %d", q.head)
+	}
+	q.Close()
+
+	q, err = New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 1 {
+		t.Fatalf("len: %d", q.Len())
+	}
+	info, ok := q.Peek()
+	if !ok || info.Path != fmt.Sprintf("file%d", COMPACT+1) {
+		t.Fatalf("unexpected: %s", info.ToString())
+	}
+}
+
+func TestCompactCrash(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	// журнал уже заменен compact, а head остался от старого журнала
+	journal := HEADER + "1\n" + `{"Path":"file0"}` + "\n" + `{"Path":"file1"}` + "\n"
+	if err := os.WriteFile(filepath.Join(PATH, FILE), []byte(journal), 0666); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(PATH, HEAD_FILE), []byte(fmt.Sprintf("0 %d", COMPACT-1)), 0666); err != nil {
+		panic(err)
+	}
+
+	q, err := New(ConfQueue{Log: logrus.New(), Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 2 {
+		t.Fatalf("len: %d", q.Len())
+	}
+	if info, ok := q.Peek(); !ok || info.Path != "file0" {
+		t.Fatalf("unexpected: %s", info.ToString())
+	}
+	if err := q.Pop(); err != nil {
+		panic(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(PATH, HEAD_FILE))
+	if err != nil {
+		panic(err)
+	}
+	if string(data) != "1 1" {
+		t.Fatalf("head: %s", data)
+	}
+}
+
+func TestBrokenRecord(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(PATH)
+
+	// испорченная запись уже отправлена: head считает и ее
+	journal := `{"Path":"file0"}` + "\n" + "{broken\n" + `{"Path":"file1"}` + "\n" + `{"Path":"file2"}` + "\n"
+	if err := os.WriteFile(filepath.Join(PATH, FILE), []byte(journal), 0666); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(PATH, HEAD_FILE), []byte("2"), 0666); err != nil {
+		panic(err)
+	}
+
+	logger := logrus.New()
+
+	q, err := New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("len: %d", q.Len())
+	}
+	if err := q.Pop(); err != nil {
+		panic(err)
+	}
+	q.Close()
+
+	// журнал переписан без испорченной записи, и head после перезапуска указывает туда же
+	q, err = New(ConfQueue{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+
+	if info, ok := q.Peek(); !ok || q.Len() != 1 || info.Path != "file2" {
+		t.Fatalf("len: %d, unexpected: %s", q.Len(), info.ToString())
+	}
+}
@@ -0,0 +1,553 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/wire"
+	cl "github.com/preegnees/gobox/pkg/client/client"
+	er "github.com/preegnees/gobox/pkg/client/errors"
+	"github.com/preegnees/gobox/pkg/client/file/echo"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	"github.com/preegnees/gobox/pkg/client/file/saver"
+	"github.com/preegnees/gobox/pkg/client/file/uploader"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/client/file/watcher"
+)
+
+// Значения по умолчанию для бюджета перезапусков
+const (
+	MAX_RESTARTS = 5
+	WINDOW       = time.Minute
+)
+
+// Проверка на соответсвие интерфейсу: пакеты отправляют ошибки и события через супервизор
+var _ cl.IClient = (*Supervisor)(nil)
+
+// ConfSupervisor. Конфигурация супервизора.
+// Пакет может перезапуститься не больше MaxRestarts раз за Window, иначе клиент останавливается.
+// Hasher - алгоритм хеша файлов для всех пакетов, по умолчанию sha256. Сервер может выбрать другой (см. SetHasher).
+// Fetcher - откуда докачиваются незавершенные загрузки saver, nil - загрузки не продолжаются.
+// Changes - изменения, которые сделали другие клиенты (cl.Client.Changes), nil - изменения не применяются
+type ConfSupervisor struct {
+	Ctx         context.Context
+	Log         *logrus.Logger
+	Dir         string
+	Client      cl.IClient
+	Fetcher     cl.IFetcher
+	Changes     <-chan pc.Info
+	MaxRestarts int
+	Window      time.Duration
+	Hasher      ut.Hasher
+}
+
+func (c *ConfSupervisor) ToString() string {
+
+	return fmt.Sprintf(
+		"context: %v, levelLog: %s, dir: %s, maxRestarts: %d, window: %v, hasher: %s",
+		c.Ctx, c.Log.Level, c.Dir, c.MaxRestarts, c.Window, c.Hasher.Name(),
+	)
+}
+
+// report. Ошибка, которую прислал пакет
+type report struct {
+	id     int
+	cancel context.CancelFunc
+	err    error
+}
+
+// component. Запущенный экземпляр пакета
+type component struct {
+	cancel     context.CancelFunc
+	done       chan struct{}
+	restarting bool
+	restarts   []time.Time
+	starts     int
+}
+
+// Supervisor. Владеет пакетами watcher, uploader и saver и перезапускает их по IDENTIFIER
+type Supervisor struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	log         *logrus.Logger
+	dir         string
+	client      cl.IClient
+	fetcher     cl.IFetcher
+	changes     <-chan pc.Info
+	maxRestarts int
+	window      time.Duration
+	hasher      ut.Hasher
+	next        ut.Hasher
+	reports     chan report
+	restarted   chan int
+	uploads     chan struct{}
+	rehash      chan struct{}
+	resumes     chan struct{}
+	resumed     chan struct{}
+	mx          sync.Mutex
+	components  map[int]*component
+	echo        *echo.Registry
+	saver       saver.ISaver
+	err         error
+}
+
+// New. Создает супервизор. Пакеты запускаются в Run
+func New(cnf ConfSupervisor) (*Supervisor, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[supervisor.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[supervisor.New()] struct cnf: %v;", cnf.ToString()))
+
+	if cnf.Client == nil {
+		return nil, fmt.Errorf("[supervisor.New()] client is nil;")
+	}
+
+	if cnf.MaxRestarts <= 0 {
+		cnf.MaxRestarts = MAX_RESTARTS
+	}
+
+	if cnf.Window <= 0 {
+		cnf.Window = WINDOW
+	}
+
+	ctx, cancel := context.WithCancel(cnf.Ctx)
+
+	return &Supervisor{
+		ctx:         ctx,
+		cancel:      cancel,
+		log:         cnf.Log,
+		dir:         cnf.Dir,
+		client:      cnf.Client,
+		fetcher:     cnf.Fetcher,
+		changes:     cnf.Changes,
+		maxRestarts: cnf.MaxRestarts,
+		window:      cnf.Window,
+		hasher:      cnf.Hasher,
+		reports:     make(chan report, 64),
+		restarted:   make(chan int, 3),
+		uploads:     make(chan struct{}, 1),
+		rehash:      make(chan struct{}, 1),
+		resumes:     make(chan struct{}, 1),
+		resumed:     make(chan struct{}),
+		echo:        echo.New(echo.TTL),
+		components: map[int]*component{
+			watcher.IDENTIFIER:  {},
+			uploader.IDENTIFIER: {},
+			saver.IDENTIFIER:    {},
+		},
+	}, nil
+}
+
+// SendError. Принимает ошибку пакета, отправляет отчет на сервер и перезапускает пакет
+func (s *Supervisor) SendError(id int, cancel context.CancelFunc, err error) {
+
+	s.client.SendError(id, cancel, err)
+
+	select {
+	case s.reports <- report{id: id, cancel: cancel, err: err}:
+	case <-s.ctx.Done():
+	}
+}
+
+// SendDeviation. Передает событие клиенту
+func (s *Supervisor) SendDeviation(info pc.Info) {
+	s.client.SendDeviation(info)
+}
+
+// Upload. Запускает новый проход uploader, например после переподключения к серверу
+func (s *Supervisor) Upload() {
+
+	select {
+	case s.uploads <- struct{}{}:
+	default:
+	}
+}
+
+// SetHasher. Меняет алгоритм хеша файлов на тот, который выбрал сервер (wire.Welcome.Hash).
+// Пакеты перезапускаются с новым алгоритмом, если он отличается от текущего
+func (s *Supervisor) SetHasher(h ut.Hasher) {
+
+	s.mx.Lock()
+	s.next = h
+	s.mx.Unlock()
+
+	select {
+	case s.rehash <- struct{}{}:
+	default:
+	}
+}
+
+// Resume. Докачивает загрузки saver, прерванные остановкой клиента или обрывом соединения.
+// Вызывается при старте и после переподключения к серверу
+func (s *Supervisor) Resume() {
+
+	select {
+	case s.resumes <- struct{}{}:
+	default:
+	}
+}
+
+// Saver. Текущий экземпляр saver
+func (s *Supervisor) Saver() saver.ISaver {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.saver
+}
+
+// Run. Запускает пакеты и следит за ними. Возвращает ошибку, если пришлось остановить клиент
+func (s *Supervisor) Run() error {
+
+	s.log.Debug("[supervisor.Run()] start;")
+
+	defer s.stop()
+
+	for _, id := range []int{saver.IDENTIFIER, watcher.IDENTIFIER, uploader.IDENTIFIER} {
+		if err := s.start(id); err != nil {
+			s.fail(err)
+		}
+	}
+
+	go s.resumer()
+	s.Resume()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.log.Debug("[supervisor.Run()] context done;")
+			return s.err
+		case r := <-s.reports:
+			s.handle(r)
+		case id := <-s.restarted:
+			s.components[id].restarting = false
+			if err := s.start(id); err != nil {
+				s.fail(err)
+			}
+		case <-s.uploads:
+			s.restart(uploader.IDENTIFIER, nil)
+		case <-s.rehash:
+			s.rehashed()
+		}
+	}
+}
+
+// rehashed. Перезапускает пакеты, если алгоритм хеша, заданный в SetHasher, отличается от текущего
+func (s *Supervisor) rehashed() {
+
+	s.mx.Lock()
+	h := s.next
+	s.mx.Unlock()
+
+	if h.Name() == s.hasher.Name() {
+		return
+	}
+
+	s.log.Info(fmt.Sprintf("[supervisor.rehashed()] hasher: %s -> %s;", s.hasher.Name(), h.Name()))
+
+	s.hasher = h
+	for _, id := range []int{saver.IDENTIFIER, watcher.IDENTIFIER, uploader.IDENTIFIER} {
+		s.restart(id, nil)
+	}
+}
+
+// handle. Решает, перезапустить пакет или остановить клиент
+func (s *Supervisor) handle(r report) {
+
+	s.log.Debug(fmt.Sprintf("[supervisor.handle()] identifier: %d, err: %v;", r.id, r.err))
+
+	if errors.Is(r.err, er.ERROR__WILL_CAUSE_A_STOP__) {
+		s.fail(fmt.Errorf("[supervisor.handle()] identifier: %d, err: %w;", r.id, r.err))
+		return
+	}
+
+	c, ok := s.components[r.id]
+	if !ok {
+		s.log.Warn(fmt.Sprintf("[supervisor.handle()] unknown identifier: %d;", r.id))
+		return
+	}
+
+	if c.restarting {
+		return
+	}
+
+	now := time.Now()
+	recent := c.restarts[:0]
+	for _, t := range c.restarts {
+		if now.Sub(t) < s.window {
+			recent = append(recent, t)
+		}
+	}
+	c.restarts = append(recent, now)
+
+	if len(c.restarts) > s.maxRestarts {
+		s.fail(fmt.Errorf(
+			"[supervisor.handle()] identifier: %d, restart budget %d per %v exhausted, last err: %v, werr: %w;",
+			r.id, s.maxRestarts, s.window, r.err, er.ERROR__WILL_CAUSE_A_STOP__,
+		))
+		return
+	}
+
+	s.log.Warn(fmt.Sprintf("[supervisor.handle()] restart identifier: %d, restarts: %d;", r.id, len(c.restarts)))
+
+	s.restart(r.id, r.cancel)
+}
+
+// restart. Отменяет пакет и запускает его заново, когда он завершится
+func (s *Supervisor) restart(id int, cancel context.CancelFunc) {
+
+	c := s.components[id]
+	if c.restarting {
+		return
+	}
+	c.restarting = true
+
+	if cancel != nil {
+		cancel()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	done := c.done
+	go func() {
+		if done != nil {
+			<-done
+		}
+		select {
+		case s.restarted <- id:
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+// start. Создает и запускает новый экземпляр пакета
+func (s *Supervisor) start(id int) error {
+
+	s.log.Debug(fmt.Sprintf("[supervisor.start()] identifier: %d;", id))
+
+	c := s.components[id]
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	c.cancel = cancel
+	c.done = done
+
+	s.mx.Lock()
+	c.starts++
+	s.mx.Unlock()
+
+	switch id {
+	case watcher.IDENTIFIER:
+		w, err := watcher.New(watcher.ConfWatcher{Ctx: ctx, Log: s.log, Dir: s.dir, Client: s, Echo: s.echo, Hasher: s.hasher})
+		if err != nil {
+			close(done)
+			return fmt.Errorf("[supervisor.start()] (watcher.New) err: %v, werr: %w;", err, er.ERROR__WILL_CAUSE_A_STOP__)
+		}
+		go func() {
+			defer close(done)
+			w.Watch()
+		}()
+	case uploader.IDENTIFIER:
+		u, err := uploader.New(uploader.ConfUploader{Ctx: ctx, Log: s.log, Dir: s.dir, Client: s, Hasher: s.hasher})
+		if err != nil {
+			close(done)
+			return fmt.Errorf("[supervisor.start()] (uploader.New) err: %v, werr: %w;", err, er.ERROR__WILL_CAUSE_A_STOP__)
+		}
+		go func() {
+			defer close(done)
+			u.Upload()
+		}()
+	case saver.IDENTIFIER:
+		sv := saver.New(saver.ConfSaver{Ctx: ctx, Cancel: cancel, Log: s.log, Dir: s.dir, Echo: s.echo, Hasher: s.hasher})
+
+		s.mx.Lock()
+		old := s.saver
+		s.saver = sv
+		s.mx.Unlock()
+
+		if old != nil {
+			if err := old.CloseAll(); err != nil {
+				s.log.Warn(fmt.Sprintf("[supervisor.start()] (saver.CloseAll) err: %v;", err))
+			}
+		}
+		close(done)
+	default:
+		cancel()
+		close(done)
+		return fmt.Errorf("[supervisor.start()] unknown identifier: %d;", id)
+	}
+
+	return nil
+}
+
+// resumer. Докачивает загрузки и применяет изменения с сервера по одному, пока не отменен контекст.
+// Одна горутина на все, чтобы изменение файла не применялось в то же время, что и его загрузка
+func (s *Supervisor) resumer() {
+
+	defer close(s.resumed)
+
+	changes := s.changes
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.resumes:
+			s.resume()
+		case info, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			if err := s.apply(info); err != nil {
+				s.log.Warn(err)
+			}
+		}
+	}
+}
+
+// apply. Повторяет у себя изменение, которое сделал другой клиент: удаление, перемещение, новую папку или новую версию файла.
+// Saver заранее сообщает watcher (echo), какие события вызовет, поэтому изменение не отправляется обратно на сервер
+func (s *Supervisor) apply(info pc.Info) error {
+
+	s.log.Debug(fmt.Sprintf("[supervisor.apply()] info: %s;", info.ToString()))
+
+	sv := s.Saver()
+	if sv == nil {
+		return fmt.Errorf("[supervisor.apply()] path: %s, saver is nil;", info.Path)
+	}
+
+	var err error
+	switch {
+	case info.Action.Has(fsnotify.Remove) && info.IsFolder:
+		err = sv.RemoveFolder(info.Path, true)
+	case info.Action.Has(fsnotify.Remove):
+		err = sv.Remove(info.Path)
+	case info.Action.Has(fsnotify.Rename):
+		err = sv.Rename(info.OldPath, info.Path)
+	case info.IsFolder:
+		err = sv.CreateFolder(info.Path)
+	default:
+		// новая версия файла: не докачанная сейчас загрузка продолжится в resume
+		err = s.Download(info)
+	}
+	if err != nil {
+		return fmt.Errorf("[supervisor.apply()] path: %s, err: %w;", info.Path, err)
+	}
+
+	return nil
+}
+
+// resume. Находит незавершенные загрузки saver, запрашивает у сервера недостающие интервалы и завершает загрузки.
+// Загрузка, которую не удалось докачать, закрывается с прогрессом на диске до следующей попытки
+func (s *Supervisor) resume() {
+
+	sv := s.Saver()
+	if s.fetcher == nil || sv == nil {
+		return
+	}
+
+	downloads, err := sv.Downloads()
+	if err != nil {
+		s.log.Warn(fmt.Sprintf("[supervisor.resume()] (saver.Downloads) err: %v;", err))
+		return
+	}
+
+	for _, d := range downloads {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		s.log.Debug(fmt.Sprintf("[supervisor.resume()] path: %s, missing ranges: %d;", d.Path, len(d.Missing)))
+
+		if err := s.download(sv, pc.Info{Path: d.Path, Hash: d.Hash, ModTime: d.ModTime}, d.Missing); err != nil {
+			s.log.Warn(err)
+			continue
+		}
+
+		s.log.Info(fmt.Sprintf("[supervisor.resume()] path: %s, download resumed and committed;", d.Path))
+	}
+}
+
+// Download. Загружает с сервера версию info (с манифестом) файла info.Path.
+// Блоки, которые уже есть в старой версии на диске, берутся из нее (saver.Delta), у сервера запрашиваются только остальные интервалы
+func (s *Supervisor) Download(info pc.Info) error {
+
+	sv := s.Saver()
+	if s.fetcher == nil || sv == nil {
+		return fmt.Errorf("[supervisor.Download()] path: %s, fetcher or saver is nil;", info.Path)
+	}
+
+	missing, err := sv.Delta(info.Path, info)
+	if err != nil {
+		return fmt.Errorf("[supervisor.Download()] (saver.Delta) path: %s, err: %w;", info.Path, err)
+	}
+
+	s.log.Debug(fmt.Sprintf("[supervisor.Download()] path: %s, size: %d, missing ranges: %d;", info.Path, info.Size, len(missing)))
+
+	return s.download(sv, info, missing)
+}
+
+// download. Запрашивает у сервера интервалы missing версии info.Hash и завершает загрузку.
+// Загрузка, которую не удалось докачать, закрывается с прогрессом на диске до следующей попытки (resume)
+func (s *Supervisor) download(sv saver.ISaver, info pc.Info, missing []saver.Range) error {
+
+	ranges := make([]wire.Range, 0, len(missing))
+	for _, r := range missing {
+		ranges = append(ranges, wire.Range{Start: r.Start, End: r.End})
+	}
+
+	if len(ranges) > 0 {
+		if err := s.fetcher.Fetch(pc.Info{Path: info.Path, Hash: info.Hash}, ranges, sv.Write); err != nil {
+			if err := sv.Close(info.Path); err != nil {
+				s.log.Warn(fmt.Sprintf("[supervisor.download()] (saver.Close) path: %s, err: %v;", info.Path, err))
+			}
+			return fmt.Errorf("[supervisor.download()] (fetcher.Fetch) path: %s, err: %w;", info.Path, err)
+		}
+	}
+
+	if err := sv.Commit(info.Path, info.Hash, info.ModTime); err != nil {
+		return fmt.Errorf("[supervisor.download()] (saver.Commit) path: %s, err: %w;", info.Path, err)
+	}
+
+	return nil
+}
+
+// fail. Останавливает клиент целиком
+func (s *Supervisor) fail(err error) {
+
+	s.log.Error(err)
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.cancel()
+}
+
+// stop. Дожидается завершения пакетов и закрывает файлы saver
+func (s *Supervisor) stop() {
+
+	s.cancel()
+
+	for _, c := range s.components {
+		if c.done != nil {
+			<-c.done
+		}
+	}
+	<-s.resumed
+
+	if sv := s.Saver(); sv != nil {
+		if err := sv.CloseAll(); err != nil {
+			s.log.Warn(fmt.Sprintf("[supervisor.stop()] (saver.CloseAll) err: %v;", err))
+		}
+	}
+
+	s.log.Debug("[supervisor.stop()] all components stopped;")
+}
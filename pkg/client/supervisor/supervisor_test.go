@@ -0,0 +1,501 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/options"
+	"github.com/preegnees/gobox/internal/wire"
+	cl "github.com/preegnees/gobox/pkg/client/client"
+	er "github.com/preegnees/gobox/pkg/client/errors"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	"github.com/preegnees/gobox/pkg/client/file/saver"
+	"github.com/preegnees/gobox/pkg/client/file/uploader"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/client/file/watcher"
+	"github.com/preegnees/gobox/pkg/server/devices"
+	"github.com/preegnees/gobox/pkg/server/server"
+	"github.com/preegnees/gobox/pkg/server/storage"
+)
+
+const PATH = "TestDir"
+
+var _ cl.IClient = (*cli)(nil)
+
+type cli struct {
+	mx   sync.Mutex
+	errs []error
+}
+
+func (c *cli) SendError(id int, cancel context.CancelFunc, err error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *cli) SendDeviation(info pc.Info) {}
+
+var _ cl.IFetcher = (*fetcher)(nil)
+
+// fetcher. Сервер, у которого лежит data
+type fetcher struct {
+	data []byte
+}
+
+func (f *fetcher) Fetch(info pc.Info, ranges []wire.Range, write func(options.Options) error) error {
+	for _, r := range ranges {
+		if err := write(options.Options{FilePath: info.Path, CurrentOffset: r.Start, Buffer: f.data[r.Start:r.End]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// starts. Сколько раз запускался пакет
+func (s *Supervisor) starts(id int) int {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.components[id].starts
+}
+
+func newSupervisor(t *testing.T, maxRestarts int, fetcher cl.IFetcher) (*Supervisor, chan error) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(PATH) })
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	t.Cleanup(cancel)
+
+	s, err := New(ConfSupervisor{
+		Ctx:         ctx,
+		Log:         logger,
+		Dir:         PATH,
+		Client:      &cli{},
+		Fetcher:     fetcher,
+		MaxRestarts: maxRestarts,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+
+	return s, done
+}
+
+func TestRestartWatcher(t *testing.T) {
+
+	s, done := newSupervisor(t, 5, nil)
+
+	s.SendError(watcher.IDENTIFIER, nil, errors.New("boom"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.starts(watcher.IDENTIFIER) < 2 {
+		select {
+		case err := <-done:
+			t.Fatalf("supervisor stopped: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher is not restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopOnFatalError(t *testing.T) {
+
+	s, done := newSupervisor(t, 5, nil)
+
+	s.SendError(watcher.IDENTIFIER, nil, fmt.Errorf("closed, werr: %w", er.ERROR__WILL_CAUSE_A_STOP__))
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, er.ERROR__WILL_CAUSE_A_STOP__) {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("supervisor is not stopped")
+	}
+}
+
+func TestRestartBudget(t *testing.T) {
+
+	s, done := newSupervisor(t, 1, nil)
+
+	for i := 0; i < 3; i++ {
+		s.SendError(watcher.IDENTIFIER, nil, errors.New("boom"))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, er.ERROR__WILL_CAUSE_A_STOP__) {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("supervisor is not stopped")
+	}
+}
+
+func TestSetHasher(t *testing.T) {
+
+	s, done := newSupervisor(t, 5, nil)
+
+	ids := []int{saver.IDENTIFIER, watcher.IDENTIFIER, uploader.IDENTIFIER}
+
+	// ждет, пока каждый пакет запустится n раз
+	wait := func(n int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for _, id := range ids {
+			for s.starts(id) < n {
+				if time.Now().After(deadline) {
+					t.Fatalf("identifier: %d, starts: %d, want: %d", id, s.starts(id), n)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	wait(1)
+
+	sha256, err := ut.NewHasher(ut.HASH_SHA256)
+	if err != nil {
+		panic(err)
+	}
+	s.SetHasher(sha256)
+	time.Sleep(100 * time.Millisecond)
+	for _, id := range ids {
+		if n := s.starts(id); n != 1 {
+			t.Fatalf("same hasher, identifier: %d, starts: %d", id, n)
+		}
+	}
+
+	blake3, err := ut.NewHasher(ut.HASH_BLAKE3)
+	if err != nil {
+		panic(err)
+	}
+	s.SetHasher(blake3)
+	wait(2)
+
+	s.cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	// прошлый запуск успел получить только начало файла
+	sv := saver.New(saver.ConfSaver{Log: logrus.New(), Dir: PATH})
+	if _, err := sv.Resume("file.txt", int64(len(data)), hash, time.Now().UnixMicro()); err != nil {
+		panic(err)
+	}
+	if err := sv.Write(options.Options{FilePath: "file.txt", Buffer: data[:6]}); err != nil {
+		panic(err)
+	}
+	if err := sv.CloseAll(); err != nil {
+		panic(err)
+	}
+
+	s, done := newSupervisor(t, 5, &fetcher{data: data})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := os.ReadFile(filepath.Join(PATH, "file.txt"))
+		if err == nil && string(got) == string(data) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("data: %q, err: %v", got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve. Запускает сервер с хранилищем в dir, возвращает хранилище, адрес сервера и токен устройства
+func serve(t *testing.T, ctx context.Context, logger *logrus.Logger, dir string) (*storage.Storage, string, string) {
+
+	st, err := storage.New(storage.ConfStorage{Log: logger, Dir: dir})
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	reg, err := devices.New(devices.ConfDevices{Log: logger, Dir: dir})
+	if err != nil {
+		panic(err)
+	}
+	_, token, err := reg.Add("laptop")
+	if err != nil {
+		panic(err)
+	}
+
+	srv, err := server.New(server.ConfServer{Ctx: ctx, Log: logger, Addr: "127.0.0.1:0", Devices: reg, Storage: st})
+	if err != nil {
+		panic(err)
+	}
+	go srv.Serve()
+
+	return st, srv.Addr().String(), token
+}
+
+var _ cl.IFetcher = (*recorder)(nil)
+
+// recorder. Запоминает, какие интервалы запрашивались у настоящего клиента
+type recorder struct {
+	cl.IFetcher
+	mx     sync.Mutex
+	ranges []wire.Range
+}
+
+func (r *recorder) Fetch(info pc.Info, ranges []wire.Range, write func(options.Options) error) error {
+	r.mx.Lock()
+	r.ranges = append(r.ranges, ranges...)
+	r.mx.Unlock()
+	return r.IFetcher.Fetch(info, ranges, write)
+}
+
+func TestDownloadDelta(t *testing.T) {
+
+	const STORAGE = "TestStorage"
+	if err := os.MkdirAll(STORAGE, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(STORAGE)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	// новая версия на сервере: к старой дописан хвост, как у журнала
+	old := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(old)
+	data := append(append([]byte{}, old...), make([]byte, 300<<10)...)
+
+	next := filepath.Join(STORAGE, "next")
+	if err := os.WriteFile(next, data, 0666); err != nil {
+		panic(err)
+	}
+	hasher, _ := ut.NewHasher(ut.HASH_SHA256)
+	hash, size, chunks, err := chunker.Manifest(logger, hasher, next, chunker.ConfChunker{})
+	if err != nil {
+		panic(err)
+	}
+	info := pc.Info{Action: fsnotify.Write, Path: "db.log", Hash: hash, HashAlgo: hasher.Name(), Size: size, Chunks: chunks, ModTime: time.Now().UnixMicro()}
+
+	st, addr, token := serve(t, ctx, logger, filepath.Join(STORAGE, "server"))
+	if err := st.Apply(info); err != nil {
+		panic(err)
+	}
+	var offset int64
+	for _, c := range chunks {
+		if err := st.PutChunk(info.Path, data[offset:offset+c.Size]); err != nil {
+			panic(err)
+		}
+		offset += c.Size
+	}
+
+	client, err := cl.New(cl.ConfClient{Ctx: ctx, Log: logger, Dir: STORAGE, Addr: addr, Token: token})
+	if err != nil {
+		panic(err)
+	}
+
+	// старая версия уже лежит у клиента
+	if err := os.MkdirAll(PATH, 0777); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(PATH, info.Path), old, 0666); err != nil {
+		panic(err)
+	}
+
+	rec := &recorder{IFetcher: client}
+	s, done := newSupervisor(t, 5, rec)
+
+	for s.Saver() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Download(info); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(PATH, info.Path))
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(got, data) {
+		panic("data mismatch")
+	}
+
+	// у сервера запрошен только отличающийся хвост
+	var download int64
+	for _, r := range rec.ranges {
+		download += r.End - r.Start
+	}
+	if download == 0 || download > size/2 {
+		t.Fatalf("download: %d of %d", download, size)
+	}
+
+	s.cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+
+	const STORAGE = "TestStorage"
+	defer os.RemoveAll(STORAGE)
+	defer os.RemoveAll(PATH)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	_, addr, token := serve(t, ctx, logger, filepath.Join(STORAGE, "server"))
+
+	for _, dir := range []string{filepath.Join(PATH, "build"), filepath.Join(STORAGE, "laptop"), filepath.Join(STORAGE, "phone")} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			panic(err)
+		}
+	}
+	for _, file := range []string{"a.txt", "build/out.bin"} {
+		if err := os.WriteFile(filepath.Join(PATH, file), []byte(file), 0666); err != nil {
+			panic(err)
+		}
+	}
+
+	// изменения делает другой клиент (phone), а laptop их повторяет у себя
+	laptop, err := cl.New(cl.ConfClient{Ctx: ctx, Log: logger, Dir: filepath.Join(STORAGE, "laptop"), Addr: addr, Token: token})
+	if err != nil {
+		panic(err)
+	}
+	phone, err := cl.New(cl.ConfClient{Ctx: ctx, Log: logger, Dir: filepath.Join(STORAGE, "phone"), Addr: addr, Token: token})
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := New(ConfSupervisor{Ctx: ctx, Log: logger, Dir: PATH, Client: laptop, Fetcher: laptop, Changes: laptop.Changes()})
+	if err != nil {
+		panic(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+
+	// новый файл phone, куски которого сервер попросит у него (TYPE_NEED)
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	local := filepath.Join(STORAGE, "phone", "docs", "new.bin")
+	if err := os.MkdirAll(filepath.Dir(local), 0777); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(local, data, 0666); err != nil {
+		panic(err)
+	}
+	hasher, _ := ut.NewHasher(ut.HASH_SHA256)
+	hash, size, chunks, err := chunker.Manifest(logger, hasher, local, chunker.ConfChunker{})
+	if err != nil {
+		panic(err)
+	}
+	file := pc.Info{Action: fsnotify.Create, Path: "docs/new.bin", Hash: hash, HashAlgo: hasher.Name(), Size: size, Chunks: chunks, ModTime: time.Now().UnixMicro()}
+	// та же версия под другим именем: все куски уже есть на сервере
+	copied := file
+	copied.Path = "docs/copy.bin"
+
+	for _, info := range []pc.Info{
+		{Action: pc.UPLOAD_CODE, Path: "a.txt", Hash: "h1"},
+		{Action: pc.UPLOAD_CODE, Path: "build", IsFolder: true},
+		{Action: pc.UPLOAD_CODE, Path: "build/out.bin", Hash: "h2"},
+		{Action: fsnotify.Create, Path: "docs", IsFolder: true},
+		{Action: fsnotify.Rename, OldPath: "a.txt", Path: "docs/a.txt"},
+		{Action: fsnotify.Remove, Path: "build"},
+		file,
+	} {
+		phone.SendDeviation(info)
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(PATH, path))
+		return err == nil
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !exists("docs/a.txt") || exists("a.txt") || exists("build") {
+		if time.Now().After(deadline) {
+			t.Fatalf("docs/a.txt: %v, a.txt: %v, build: %v", exists("docs/a.txt"), exists("a.txt"), exists("build"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// wait. Ждет, пока laptop загрузит файл path
+	wait := func(path string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, err := os.ReadFile(filepath.Join(PATH, path))
+			if err == nil && bytes.Equal(got, data) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("path: %s, len: %d, err: %v", path, len(got), err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	wait(file.Path)
+	phone.SendDeviation(copied)
+	wait(copied.Path)
+
+	s.cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,306 @@
+package blobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+)
+
+const (
+	// DIR. Папка хранилища кусков в корне хранилища сервера
+	DIR = "chunks"
+	// TMP_DIR. Куски дописываются здесь и переносятся на место целиком
+	TMP_DIR = "tmp"
+	// TRASH_DIR. Сюда Remove переносит кусок, прежде чем решить, удалять ли его
+	TRASH_DIR = "trash"
+	// HASH_LEN. Длина хеша куска (chunker.Hash) в hex
+	HASH_LEN = 64
+)
+
+var (
+	ERROR__BAD_HASH__  = errors.New("err invalid chunk hash")
+	ERROR__CORRUPTED__ = errors.New("err chunk content does not match hash")
+	ERROR__NOT_FOUND__ = errors.New("err chunk not found")
+)
+
+// ConfStore. Конфигурация хранилища кусков. Dir - корень хранилища сервера
+type ConfStore struct {
+	Log *logrus.Logger
+	Dir string
+}
+
+func (c *ConfStore) ToString() string {
+
+	return fmt.Sprintf("levelLog: %s, dir: %s", c.Log.Level, c.Dir)
+}
+
+// Store. Хранилище кусков по хешу содержимого (content-addressed): одинаковый кусок
+// лежит один раз, в каком бы файле, на каком бы устройстве и в какой бы версии он ни встретился.
+// Кусок лежит в <Dir>/chunks/<первые 2 символа хеша>/<хеш>.
+// Время изменения файла куска - время последнего использования, по нему gc не трогает свежие куски
+type Store struct {
+	log *logrus.Logger
+	dir string
+}
+
+// New. Создает хранилище кусков
+func New(cnf ConfStore) (*Store, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[blobs.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[blobs.New()] struct cnf: %v;", cnf.ToString()))
+
+	if cnf.Dir == "" {
+		return nil, fmt.Errorf("[blobs.New()] dir is empty;")
+	}
+
+	dir := filepath.Join(cnf.Dir, DIR)
+	for _, d := range []string{TMP_DIR, TRASH_DIR} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			return nil, fmt.Errorf("[blobs.New()] (os.MkdirAll) dir: %s, err: %w;", dir, err)
+		}
+	}
+
+	return &Store{log: cnf.Log, dir: dir}, nil
+}
+
+// Put. Сохраняет кусок. Содержимое сверяется с хешем, уже сохраненный кусок только отмечается как использованный
+func (s *Store) Put(hash string, data []byte) error {
+
+	s.log.Debug(fmt.Sprintf("[blobs.Put()] hash: %s, len: %d;", hash, len(data)))
+
+	if !Valid(hash) {
+		return fmt.Errorf("[blobs.Put()] hash: %q, werr: %w;", hash, ERROR__BAD_HASH__)
+	}
+
+	if chunker.Hash(data) != hash {
+		return fmt.Errorf("[blobs.Put()] hash: %s, werr: %w;", hash, ERROR__CORRUPTED__)
+	}
+
+	if s.Touch(hash) {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Join(s.dir, TMP_DIR), hash+".*")
+	if err != nil {
+		return fmt.Errorf("[blobs.Put()] (os.CreateTemp) hash: %s, err: %w;", hash, err)
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("[blobs.Put()] (f.Write) hash: %s, err: %w;", hash, err)
+	}
+
+	path := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("[blobs.Put()] (os.MkdirAll) hash: %s, err: %w;", hash, err)
+	}
+
+	// кусок появляется на месте только целиком
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("[blobs.Put()] (os.Rename) hash: %s, err: %w;", hash, err)
+	}
+
+	return nil
+}
+
+// Get. Читает кусок и сверяет его с хешем
+func (s *Store) Get(hash string) ([]byte, error) {
+
+	if !Valid(hash) {
+		return nil, fmt.Errorf("[blobs.Get()] hash: %q, werr: %w;", hash, ERROR__BAD_HASH__)
+	}
+
+	data, err := os.ReadFile(s.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("[blobs.Get()] hash: %s, werr: %w;", hash, ERROR__NOT_FOUND__)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[blobs.Get()] (os.ReadFile) hash: %s, err: %w;", hash, err)
+	}
+
+	if chunker.Hash(data) != hash {
+		return nil, fmt.Errorf("[blobs.Get()] hash: %s, werr: %w;", hash, ERROR__CORRUPTED__)
+	}
+
+	return data, nil
+}
+
+// Touch. Отмечает кусок как использованный сейчас. false, если куска нет.
+// Сервер вызывает Touch для каждого куска, который он не просит у клиента: пока gc держит
+// кусок в корзине, Touch не найдет его, и кусок будет запрошен заново
+func (s *Store) Touch(hash string) bool {
+
+	if !Valid(hash) {
+		return false
+	}
+
+	now := time.Now()
+	return os.Chtimes(s.path(hash), now, now) == nil
+}
+
+// Walk. Обходит все куски хранилища
+func (s *Store) Walk(fn func(hash string, size int64, modTime time.Time) error) error {
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != s.dir && (d.Name() == TMP_DIR || d.Name() == TRASH_DIR) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !Valid(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(d.Name(), info.Size(), info.ModTime())
+	})
+	if err != nil {
+		return fmt.Errorf("[blobs.Walk()] (filepath.WalkDir) dir: %s, err: %w;", s.dir, err)
+	}
+
+	return nil
+}
+
+// Remove. Удаляет кусок, если его не использовали дольше grace. Возвращает размер удаленного куска.
+// Кусок сначала переносится в корзину, и только потом проверяется время использования:
+// так Touch работающего сервера либо успевает до переноса (и кусок возвращается на место),
+// либо не находит кусок и сервер просит его у клиента заново
+func (s *Store) Remove(hash string, grace time.Duration) (int64, error) {
+
+	if !Valid(hash) {
+		return 0, fmt.Errorf("[blobs.Remove()] hash: %q, werr: %w;", hash, ERROR__BAD_HASH__)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return 0, fmt.Errorf("[blobs.Remove()] (rand.Read) err: %w;", err)
+	}
+
+	path := s.path(hash)
+	trash := filepath.Join(s.dir, TRASH_DIR, hash+"."+hex.EncodeToString(suffix))
+	if err := os.Rename(path, trash); errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("[blobs.Remove()] (os.Rename) hash: %s, err: %w;", hash, err)
+	}
+
+	info, err := os.Stat(trash)
+	if err != nil {
+		return 0, fmt.Errorf("[blobs.Remove()] (os.Stat) hash: %s, err: %w;", hash, err)
+	}
+
+	if time.Since(info.ModTime()) < grace {
+		s.log.Debug(fmt.Sprintf("[blobs.Remove()] hash: %s, recently used, kept;", hash))
+		return 0, s.restore(hash, trash)
+	}
+
+	if err := os.Remove(trash); err != nil {
+		return 0, fmt.Errorf("[blobs.Remove()] (os.Remove) hash: %s, err: %w;", hash, err)
+	}
+
+	return info.Size(), nil
+}
+
+// Recover. Возвращает на место куски, оставшиеся в корзине после прерванного gc,
+// и удаляет недописанные куски старше grace
+func (s *Store) Recover(grace time.Duration) error {
+
+	trash, err := os.ReadDir(filepath.Join(s.dir, TRASH_DIR))
+	if err != nil {
+		return fmt.Errorf("[blobs.Recover()] (os.ReadDir) dir: %s, err: %w;", s.dir, err)
+	}
+	for _, e := range trash {
+		hash := e.Name()
+		if len(hash) > HASH_LEN {
+			hash = hash[:HASH_LEN]
+		}
+		path := filepath.Join(s.dir, TRASH_DIR, e.Name())
+		if !Valid(hash) {
+			os.Remove(path)
+			continue
+		}
+		if err := s.restore(hash, path); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.ReadDir(filepath.Join(s.dir, TMP_DIR))
+	if err != nil {
+		return fmt.Errorf("[blobs.Recover()] (os.ReadDir) dir: %s, err: %w;", s.dir, err)
+	}
+	for _, e := range tmp {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) >= grace {
+			os.Remove(filepath.Join(s.dir, TMP_DIR, e.Name()))
+		}
+	}
+
+	return nil
+}
+
+// restore. Возвращает кусок из корзины. Если кусок уже успели загрузить заново, копия из корзины не нужна
+func (s *Store) restore(hash string, trash string) error {
+
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(trash)
+		return nil
+	}
+
+	if err := os.Rename(trash, path); err != nil {
+		return fmt.Errorf("[blobs.restore()] (os.Rename) hash: %s, err: %w;", hash, err)
+	}
+
+	return nil
+}
+
+// path. Путь к куску
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Valid. Хеш куска - HASH_LEN символов hex в нижнем регистре. Хеш приходит от клиента
+// и становится именем файла, поэтому другое содержимое не допускается
+func Valid(hash string) bool {
+
+	if len(hash) != HASH_LEN {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,126 @@
+package blobs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+)
+
+const PATH = "TestDir"
+
+func TestPutGet(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	s, err := New(ConfStore{Log: logrus.New(), Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	data := []byte("chunk")
+	hash := chunker.Hash(data)
+
+	if s.Touch(hash) {
+		panic("empty store has chunk")
+	}
+	if err := s.Put(hash, data); err != nil {
+		panic(err)
+	}
+	// повторный Put ничего не пишет
+	if err := s.Put(hash, data); err != nil {
+		panic(err)
+	}
+	if !s.Touch(hash) {
+		panic("chunk is not stored")
+	}
+
+	got, err := s.Get(hash)
+	if err != nil || string(got) != "chunk" {
+		t.Fatalf("data: %q, err: %v", got, err)
+	}
+
+	if err := s.Put(hash, []byte("other")); !errors.Is(err, ERROR__CORRUPTED__) {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.Put("../../escape", data); !errors.Is(err, ERROR__BAD_HASH__) {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := s.Get(chunker.Hash([]byte("missing"))); !errors.Is(err, ERROR__NOT_FOUND__) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// испорченный на диске кусок не отдается
+	if err := os.WriteFile(s.path(hash), []byte("broken"), 0666); err != nil {
+		panic(err)
+	}
+	if _, err := s.Get(hash); !errors.Is(err, ERROR__CORRUPTED__) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	s, err := New(ConfStore{Log: logrus.New(), Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	old, fresh := []byte("old"), []byte("fresh")
+	for _, data := range [][]byte{old, fresh} {
+		if err := s.Put(chunker.Hash(data), data); err != nil {
+			panic(err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(s.path(chunker.Hash(old)), past, past); err != nil {
+		panic(err)
+	}
+
+	count := 0
+	if err := s.Walk(func(hash string, size int64, modTime time.Time) error {
+		count++
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	if count != 2 {
+		t.Fatalf("count: %d", count)
+	}
+
+	freed, err := s.Remove(chunker.Hash(old), time.Hour)
+	if err != nil || freed != int64(len(old)) {
+		t.Fatalf("freed: %d, err: %v", freed, err)
+	}
+	if s.Touch(chunker.Hash(old)) {
+		panic("old chunk is not removed")
+	}
+
+	// недавно использованный кусок возвращается из корзины
+	freed, err = s.Remove(chunker.Hash(fresh), time.Hour)
+	if err != nil || freed != 0 {
+		t.Fatalf("freed: %d, err: %v", freed, err)
+	}
+	if !s.Touch(chunker.Hash(fresh)) {
+		panic("fresh chunk is removed")
+	}
+
+	// кусок, брошенный в корзине прерванным gc, возвращается на место
+	trash := filepath.Join(s.dir, TRASH_DIR, chunker.Hash(fresh)+".0")
+	if err := os.Rename(s.path(chunker.Hash(fresh)), trash); err != nil {
+		panic(err)
+	}
+	if err := s.Recover(time.Hour); err != nil {
+		panic(err)
+	}
+	if !s.Touch(chunker.Hash(fresh)) {
+		panic("chunk is not recovered")
+	}
+}
@@ -0,0 +1,396 @@
+package devices
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FILE. Файл реестра устройств в корне хранилища сервера
+	FILE = "devices.json"
+	// ID_SIZE и SECRET_SIZE. Размеры идентификатора устройства и секрета токена в байтах
+	ID_SIZE     = 8
+	SECRET_SIZE = 32
+	// SEPARATOR. Токен выглядит как <id>.<secret>: по id сервер находит запись, секрет сверяет с хешем
+	SEPARATOR = "."
+)
+
+var (
+	ERROR__BAD_TOKEN__      = errors.New("err invalid device token")
+	ERROR__REVOKED__        = errors.New("err device token is revoked")
+	ERROR__UNKNOWN_DEVICE__ = errors.New("err unknown device")
+)
+
+// ConfDevices. Конфигурация реестра устройств. Dir - корень хранилища сервера
+type ConfDevices struct {
+	Log *logrus.Logger
+	Dir string
+}
+
+func (c *ConfDevices) ToString() string {
+
+	return fmt.Sprintf("levelLog: %s, dir: %s", c.Log.Level, c.Dir)
+}
+
+// Device. Запись реестра. Сам токен не хранится, только sha256 его секрета.
+// Cert - закрепленный за устройством TLS сертификат (certs.Fingerprint), пустой - любой сертификат.
+// Revoked - время отзыва (unix), 0 - токен действует
+type Device struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	Cert    string `json:"cert,omitempty"`
+	Created int64  `json:"created"`
+	Revoked int64  `json:"revoked,omitempty"`
+}
+
+// ToString. Device struct в строку, без хеша
+func (d *Device) ToString() string {
+	return fmt.Sprintf("ID: %s; Name: %s; Cert: %s; Created: %d; Revoked: %d;", d.ID, d.Name, d.Cert, d.Created, d.Revoked)
+}
+
+// Registry. Реестр устройств, которым сервер выдал токены.
+// Команды gobox-server device меняют файл, пока сервер работает, поэтому
+// реестр перечитывает файл, если тот изменился с прошлого обращения
+type Registry struct {
+	log     *logrus.Logger
+	path    string
+	mx      sync.Mutex
+	devices map[string]Device
+	modTime time.Time
+	size    int64
+}
+
+// New. Создает реестр и читает файл, если он уже есть
+func New(cnf ConfDevices) (*Registry, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[devices.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[devices.New()] struct cnf: %v;", cnf.ToString()))
+
+	if cnf.Dir == "" {
+		return nil, fmt.Errorf("[devices.New()] dir is empty;")
+	}
+
+	if err := os.MkdirAll(cnf.Dir, 0777); err != nil {
+		return nil, fmt.Errorf("[devices.New()] (os.MkdirAll) dir: %s, err: %w;", cnf.Dir, err)
+	}
+
+	r := &Registry{
+		log:     cnf.Log,
+		path:    filepath.Join(cnf.Dir, FILE),
+		devices: make(map[string]Device),
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Add. Регистрирует устройство и возвращает его токен. Токен показывается один раз, восстановить его нельзя
+func (r *Registry) Add(name string) (Device, string, error) {
+
+	if name == "" {
+		return Device{}, "", fmt.Errorf("[devices.Add()] name is empty;")
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		return Device{}, "", err
+	}
+
+	rawID, err := random(ID_SIZE)
+	if err != nil {
+		return Device{}, "", err
+	}
+	id := hex.EncodeToString(rawID)
+
+	rawSecret, err := random(SECRET_SIZE)
+	if err != nil {
+		return Device{}, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(rawSecret)
+
+	d := Device{
+		ID:      id,
+		Name:    name,
+		Hash:    hash(secret),
+		Created: time.Now().Unix(),
+	}
+
+	r.devices[id] = d
+	if err := r.save(); err != nil {
+		delete(r.devices, id)
+		return Device{}, "", err
+	}
+
+	r.log.Debug(fmt.Sprintf("[devices.Add()] device: %s;", d.ToString()))
+
+	return d, id + SEPARATOR + secret, nil
+}
+
+// Revoke. Отзывает токен устройства по id или имени. Повторный отзыв не ошибка
+func (r *Registry) Revoke(idOrName string) (Device, error) {
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		return Device{}, err
+	}
+
+	d, err := r.find(idOrName)
+	if err != nil {
+		return Device{}, err
+	}
+
+	if d.Revoked != 0 {
+		return d, nil
+	}
+
+	d.Revoked = time.Now().Unix()
+	r.devices[d.ID] = d
+	if err := r.save(); err != nil {
+		d.Revoked = 0
+		r.devices[d.ID] = d
+		return Device{}, err
+	}
+
+	r.log.Debug(fmt.Sprintf("[devices.Revoke()] device: %s;", d.ToString()))
+
+	return d, nil
+}
+
+// Pin. Закрепляет за устройством сертификат с отпечатком fingerprint, пустой отпечаток снимает закрепление
+func (r *Registry) Pin(idOrName string, fingerprint string) (Device, error) {
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		return Device{}, err
+	}
+
+	d, err := r.find(idOrName)
+	if err != nil {
+		return Device{}, err
+	}
+
+	old := d
+	d.Cert = fingerprint
+	r.devices[d.ID] = d
+	if err := r.save(); err != nil {
+		r.devices[d.ID] = old
+		return Device{}, err
+	}
+
+	r.log.Debug(fmt.Sprintf("[devices.Pin()] device: %s;", d.ToString()))
+
+	return d, nil
+}
+
+// List. Все устройства по времени регистрации, включая отозванные
+func (r *Registry) List() ([]Device, error) {
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created != list[j].Created {
+			return list[i].Created < list[j].Created
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	return list, nil
+}
+
+// Check. Проверяет токен из Hello и возвращает устройство, которому он выдан
+func (r *Registry) Check(token string) (Device, error) {
+
+	id, secret, ok := strings.Cut(token, SEPARATOR)
+	if !ok || id == "" || secret == "" {
+		return Device{}, fmt.Errorf("[devices.Check()] malformed token, werr: %w;", ERROR__BAD_TOKEN__)
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		return Device{}, err
+	}
+
+	d, ok := r.devices[id]
+	// хеш считается и без записи, чтобы время ответа не выдавало, есть ли такой id
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(d.Hash)) != 1 || !ok {
+		return Device{}, fmt.Errorf("[devices.Check()] id: %s, werr: %w;", id, ERROR__BAD_TOKEN__)
+	}
+
+	if d.Revoked != 0 {
+		return Device{}, fmt.Errorf("[devices.Check()] device: %s, werr: %w;", d.ToString(), ERROR__REVOKED__)
+	}
+
+	return d, nil
+}
+
+// Active. Действует ли еще токен устройства id. Сервер проверяет это у открытых соединений
+func (r *Registry) Active(id string) bool {
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.load(); err != nil {
+		// файл реестра не читается: не разрываем соединения из-за сбоя диска
+		r.log.Error(err)
+	}
+
+	d, ok := r.devices[id]
+	return ok && d.Revoked == 0
+}
+
+// find. Запись по id или имени. Имя должно быть однозначным
+func (r *Registry) find(idOrName string) (Device, error) {
+
+	if d, ok := r.devices[idOrName]; ok {
+		return d, nil
+	}
+
+	found := []Device{}
+	for _, d := range r.devices {
+		if d.Name == idOrName {
+			found = append(found, d)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return Device{}, fmt.Errorf("[devices.find()] device: %s, werr: %w;", idOrName, ERROR__UNKNOWN_DEVICE__)
+	case 1:
+		return found[0], nil
+	default:
+		return Device{}, fmt.Errorf("[devices.find()] name: %s matches %d devices, use id;", idOrName, len(found))
+	}
+}
+
+// load. Перечитывает файл, если он изменился. Отсутствие файла - пустой реестр
+func (r *Registry) load() error {
+
+	info, err := os.Stat(r.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		r.devices = make(map[string]Device)
+		r.modTime, r.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[devices.load()] (os.Stat) path: %s, err: %w;", r.path, err)
+	}
+
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("[devices.load()] (os.ReadFile) path: %s, err: %w;", r.path, err)
+	}
+
+	list := []Device{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("[devices.load()] (json.Unmarshal) path: %s, err: %w;", r.path, err)
+	}
+
+	devices := make(map[string]Device, len(list))
+	for _, d := range list {
+		devices[d.ID] = d
+	}
+
+	r.devices = devices
+	r.modTime, r.size = info.ModTime(), info.Size()
+
+	r.log.Debug(fmt.Sprintf("[devices.load()] loaded %d devices;", len(devices)))
+
+	return nil
+}
+
+// save. Записывает реестр через временный файл, чтобы сервер не прочитал его наполовину
+func (r *Registry) save() error {
+
+	list := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[devices.save()] (json.MarshalIndent) err: %w;", err)
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("[devices.save()] (os.WriteFile) path: %s, err: %w;", tmp, err)
+	}
+
+	if err := os.Rename(tmp, r.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("[devices.save()] (os.Rename) path: %s, err: %w;", r.path, err)
+	}
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("[devices.save()] (os.Stat) path: %s, err: %w;", r.path, err)
+	}
+	r.modTime, r.size = info.ModTime(), info.Size()
+
+	return nil
+}
+
+// hash. sha256 секрета в hex. Секрет случайный и длинный, поэтому медленный KDF не нужен
+func hash(secret string) string {
+
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// random. n случайных байт
+func random(n int) ([]byte, error) {
+
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("[devices.random()] (rand.Read) err: %w;", err)
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,108 @@
+package devices
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const PATH = "TestDir"
+
+func newRegistry() *Registry {
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	r, err := New(ConfDevices{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+func TestAddCheckRevoke(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	r := newRegistry()
+
+	d, token, err := r.Add("laptop")
+	if err != nil {
+		panic(err)
+	}
+
+	got, err := r.Check(token)
+	if err != nil {
+		panic(err)
+	}
+	if got.ID != d.ID || got.Name != "laptop" {
+		t.Fatalf("got: %s, want: %s", got.ToString(), d.ToString())
+	}
+
+	// в файле только хеш
+	data, err := os.ReadFile(filepath.Join(PATH, FILE))
+	if err != nil {
+		panic(err)
+	}
+	_, secret, _ := strings.Cut(token, SEPARATOR)
+	if strings.Contains(string(data), secret) {
+		panic("token secret is stored in plain text")
+	}
+
+	for _, bad := range []string{"", token + "x", d.ID + SEPARATOR, SEPARATOR + secret, "nope" + SEPARATOR + secret} {
+		if _, err := r.Check(bad); !errors.Is(err, ERROR__BAD_TOKEN__) {
+			t.Fatalf("token: %q, err: %v", bad, err)
+		}
+	}
+
+	if _, err := r.Revoke("laptop"); err != nil {
+		panic(err)
+	}
+	if _, err := r.Check(token); !errors.Is(err, ERROR__REVOKED__) {
+		t.Fatalf("err: %v", err)
+	}
+	if r.Active(d.ID) {
+		panic("revoked device is active")
+	}
+
+	if _, err := r.Revoke("phone"); !errors.Is(err, ERROR__UNKNOWN_DEVICE__) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	server := newRegistry()
+	cli := newRegistry()
+
+	d, token, err := cli.Add("laptop")
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := server.Check(token); err != nil {
+		t.Fatalf("token added by another registry, err: %v", err)
+	}
+
+	if _, err := cli.Revoke(d.ID); err != nil {
+		panic(err)
+	}
+	if server.Active(d.ID) {
+		panic("revoke by another registry is not seen")
+	}
+
+	list, err := server.List()
+	if err != nil {
+		panic(err)
+	}
+	if len(list) != 1 || list[0].Revoked == 0 {
+		t.Fatalf("list: %v", list)
+	}
+}
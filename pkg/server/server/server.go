@@ -0,0 +1,624 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/certs"
+	"github.com/preegnees/gobox/internal/options"
+	"github.com/preegnees/gobox/internal/wire"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/server/devices"
+	"github.com/preegnees/gobox/pkg/server/storage"
+)
+
+// Проверка на соответсвие интерфейсу
+var _ IServer = (*Server)(nil)
+
+// IServer. интерфейс для взаимодействия с пакетом
+type IServer interface {
+	Serve() error
+	Addr() net.Addr
+}
+
+// ROOT. Идентификатор папки синхронизации по умолчанию
+const ROOT = "default"
+
+// HANDSHAKE_TIMEOUT. Время на TLS рукопожатие, чтобы молчащий клиент не держал горутину
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// REVOKE_CHECK. Как часто по умолчанию открытые соединения проверяются на отзыв токена
+const REVOKE_CHECK = 5 * time.Second
+
+// ConfServer. Конфигурация сервера.
+// Devices - реестр устройств: клиент подключается только с выданным ему токеном (gobox-server device add).
+// TLS - настройки TLS (certs.ServerConfig), nil - без шифрования.
+// Root - идентификатор папки синхронизации, которую обслуживает сервер.
+// Hashes и Compressions - поддерживаемые алгоритмы, по умолчанию все алгоритмы хеширования (wire.Hashes) и сжатия (wire.Compressions).
+// RevokeCheck - как часто открытые соединения проверяются на отзыв токена, по умолчанию REVOKE_CHECK
+type ConfServer struct {
+	Ctx          context.Context
+	Log          *logrus.Logger
+	Addr         string
+	TLS          *tls.Config
+	Devices      *devices.Registry
+	Root         string
+	Hashes       []string
+	Compressions []string
+	RevokeCheck  time.Duration
+	Storage      *storage.Storage
+}
+
+func (c *ConfServer) ToString() string {
+
+	return fmt.Sprintf(
+		"context: %v, levelLog: %s, addr: %s, tls: %v, root: %s, hashes: %v, compressions: %v, revokeCheck: %v",
+		c.Ctx, c.Log.Level, c.Addr, c.TLS != nil, c.Root, c.Hashes, c.Compressions, c.RevokeCheck,
+	)
+}
+
+// Server. Сервер, принимающий метаданные и файлы от клиентов
+type Server struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	log      *logrus.Logger
+	listener net.Listener
+	devices  *devices.Registry
+	root     string
+	hashes   []string
+	compress []string
+	revoke   time.Duration
+	storage  *storage.Storage
+	wg       sync.WaitGroup
+	mx       sync.Mutex
+	conns    map[*wire.Conn]struct{}
+	uploads  map[string]*upload
+}
+
+// upload. Новая версия файла, куски которой еще идут от клиента from.
+// Когда придут все куски need, версия рассылается остальным клиентам
+type upload struct {
+	from *wire.Conn
+	hash string
+	need map[string]struct{}
+}
+
+// New. Создает сервер и начинает слушать адрес
+func New(cnf ConfServer) (*Server, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[server.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[server.New()] struct cnf: %v;", cnf.ToString()))
+
+	if cnf.Storage == nil {
+		return nil, fmt.Errorf("[server.New()] storage is nil;")
+	}
+
+	if cnf.Devices == nil {
+		return nil, fmt.Errorf("[server.New()] devices is nil;")
+	}
+
+	if cnf.Root == "" {
+		cnf.Root = ROOT
+	}
+
+	if len(cnf.Hashes) == 0 {
+		cnf.Hashes = wire.Hashes()
+	}
+
+	if len(cnf.Compressions) == 0 {
+		cnf.Compressions = wire.Compressions()
+	}
+
+	if cnf.RevokeCheck <= 0 {
+		cnf.RevokeCheck = REVOKE_CHECK
+	}
+
+	listener, err := net.Listen("tcp", cnf.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("[server.New()] (net.Listen) addr: %s, err: %w;", cnf.Addr, err)
+	}
+
+	if cnf.TLS != nil {
+		listener = tls.NewListener(listener, cnf.TLS)
+	}
+
+	ctx, cancel := context.WithCancel(cnf.Ctx)
+
+	return &Server{
+		ctx:      ctx,
+		cancel:   cancel,
+		log:      cnf.Log,
+		listener: listener,
+		devices:  cnf.Devices,
+		root:     cnf.Root,
+		hashes:   cnf.Hashes,
+		compress: cnf.Compressions,
+		revoke:   cnf.RevokeCheck,
+		storage:  cnf.Storage,
+		conns:    make(map[*wire.Conn]struct{}),
+		uploads:  make(map[string]*upload),
+	}, nil
+}
+
+// Addr. Адрес, на котором слушает сервер
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve. Принимает соединения, пока не отменен контекст
+func (s *Server) Serve() error {
+
+	s.log.Info(fmt.Sprintf("[server.Serve()] listen: %s;", s.listener.Addr()))
+
+	go func() {
+		<-s.ctx.Done()
+		s.listener.Close()
+	}()
+
+	defer s.wg.Wait()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				s.log.Debug("[server.Serve()] context done;")
+				return nil
+			default:
+			}
+			s.cancel()
+			return fmt.Errorf("[server.Serve()] (listener.Accept) err: %w;", err)
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle. Обслуживает одного клиента: TLS рукопожатие, Hello, затем поток сообщений
+func (s *Server) handle(nc net.Conn) {
+
+	s.log.Debug(fmt.Sprintf("[server.handle()] new conn: %s;", nc.RemoteAddr()))
+
+	peer, err := s.handshake(nc)
+	if err != nil {
+		s.log.Warn(err)
+		nc.Close()
+		return
+	}
+
+	conn := wire.NewConn(nc)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	defer s.leave(conn)
+
+	hello, device, welcome, err := s.hello(conn, peer)
+	if err != nil {
+		s.log.Warn(err)
+		return
+	}
+	if err := conn.SetCompression(welcome.Compression); err != nil {
+		s.log.Error(err)
+		return
+	}
+
+	s.log.Info(fmt.Sprintf(
+		"[server.handle()] client: %s, device: %s, install: %s, welcome: %s;",
+		conn.RemoteAddr(), device.ToString(), hello.Device, welcome.ToString(),
+	))
+
+	// токен могут отозвать, пока клиент подключен и молчит
+	go s.watchRevoke(conn, device, done)
+
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			s.log.Debug(fmt.Sprintf("[server.handle()] conn: %s closed, err: %v;", conn.RemoteAddr(), err))
+			return
+		}
+
+		// токен могли отозвать, пока клиент подключен
+		if !s.devices.Active(device.ID) {
+			s.log.Warn(fmt.Sprintf("[server.handle()] device: %s revoked, err: %v;", device.ToString(), s.reject(conn, wire.REJECT_UNAUTHORIZED, "revoked")))
+			return
+		}
+
+		switch m.Type {
+		case wire.TYPE_INFO:
+			change, ok := s.change(m.Info)
+			prev, _ := s.storage.Get(m.Info.Path)
+			if err := s.storage.Apply(m.Info); err != nil {
+				s.log.Error(err)
+				continue
+			}
+			if ok {
+				s.push(conn, change)
+			}
+			need := s.storage.Need(m.Info.Path)
+			s.content(conn, m.Info.Path, prev, need)
+			// кусков нового содержимого нет в хранилище: просим у клиента только их
+			if len(need) > 0 {
+				s.log.Debug(fmt.Sprintf("[server.handle()] device: %s, path: %s, need: %d chunks;", device.Name, m.Info.Path, len(need)))
+				if err := conn.Send(&wire.Message{Type: wire.TYPE_NEED, Info: pc.Info{Path: m.Info.Path}, Hashes: need}); err != nil {
+					s.log.Debug(fmt.Sprintf("[server.handle()] conn: %s closed, err: %v;", conn.RemoteAddr(), err))
+					return
+				}
+			}
+		case wire.TYPE_CHUNK:
+			if err := s.chunk(m.Chunk); err != nil {
+				s.log.Error(err)
+			}
+		case wire.TYPE_GET:
+			go s.get(conn, m)
+		case wire.TYPE_ERROR:
+			s.log.Warn(fmt.Sprintf("[server.handle()] device: %s, identifier: %d, err: %s;", device.Name, m.Ident, m.Text))
+		default:
+			s.log.Warn(fmt.Sprintf("[server.handle()] client: %s, unknown type: %d;", conn.RemoteAddr(), m.Type))
+		}
+	}
+}
+
+// join. Добавляет соединение в рассылку изменений
+func (s *Server) join(conn *wire.Conn) {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.conns[conn] = struct{}{}
+}
+
+// leave. Убирает соединение из рассылки изменений. Версии, которые оно не догрузило, уже не разошлются:
+// клиент пришлет их заново после переподключения
+func (s *Server) leave(conn *wire.Conn) {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	delete(s.conns, conn)
+	for path, u := range s.uploads {
+		if u.from == conn {
+			delete(s.uploads, path)
+		}
+	}
+}
+
+// change. Изменение, которое нужно разослать остальным клиентам: удаление, перемещение или новая папка.
+// Вызывается до Apply: удаляемая или перемещаемая запись еще в индексе, из нее берется, папка это или файл
+func (s *Server) change(info pc.Info) (pc.Info, bool) {
+
+	path, err := pc.Normalize(info.Path)
+	if err != nil {
+		return pc.Info{}, false
+	}
+
+	// UPLOAD_CODE = 100 содержит бит fsnotify.Remove, поэтому его нужно проверять первым
+	switch {
+	case info.Action != pc.UPLOAD_CODE && info.Action.Has(fsnotify.Remove):
+		prev, ok := s.storage.Get(path)
+		return pc.Info{Action: fsnotify.Remove, Path: path, IsFolder: prev.IsFolder}, ok
+	case info.Action == fsnotify.Rename && info.OldPath != "":
+		prev, ok := s.storage.Get(info.OldPath)
+		return pc.Info{Action: fsnotify.Rename, OldPath: prev.Path, Path: path, IsFolder: prev.IsFolder}, ok
+	case info.IsFolder:
+		_, ok := s.storage.Get(path)
+		return pc.Info{Action: fsnotify.Create, Path: path, IsFolder: true}, !ok
+	}
+
+	return pc.Info{}, false
+}
+
+// content. Рассылает остальным клиентам новую версию файла (с манифестом), как только все ее куски есть на сервере.
+// prev - запись path до Apply, need - куски, которых пока нет. Пока кусков не хватает, версия ждет их в uploads (см. chunk)
+func (s *Server) content(from *wire.Conn, path string, prev pc.Info, need []string) {
+
+	info, ok := s.storage.Get(path)
+	if !ok || info.IsFolder || (info.Chunks == nil && !empty(info)) {
+		return
+	}
+	if prev.Path != "" && prev.Hash == info.Hash && prev.HashAlgo == info.HashAlgo {
+		return
+	}
+
+	s.mx.Lock()
+	delete(s.uploads, info.Path)
+	others := len(s.conns) > 1
+	if others && len(need) > 0 {
+		u := &upload{from: from, hash: info.Hash, need: make(map[string]struct{}, len(need))}
+		for _, h := range need {
+			u.need[h] = struct{}{}
+		}
+		s.uploads[info.Path] = u
+	}
+	s.mx.Unlock()
+
+	if others && len(need) == 0 {
+		s.push(from, version(info))
+	}
+}
+
+// empty. Версия пустого файла: манифеста у нее нет, но хеш - это хеш пустого содержимого.
+// Отличает ее от события без манифеста, которое содержимое не меняет
+func empty(info pc.Info) bool {
+
+	if info.Size != 0 {
+		return false
+	}
+
+	name := info.HashAlgo
+	if name == "" {
+		name = ut.HASH_SHA256
+	}
+	hasher, err := ut.NewHasher(name)
+	if err != nil {
+		return false
+	}
+
+	return info.Hash == hex.EncodeToString(hasher.New().Sum(nil))
+}
+
+// version. Изменение содержимого файла для рассылки: клиент загружает эту версию (см. supervisor.Download)
+func version(info pc.Info) pc.Info {
+
+	info.Action = fsnotify.Write
+	info.OldPath = ""
+
+	return info
+}
+
+// push. Рассылает изменение всем клиентам, кроме того, от которого оно пришло
+func (s *Server) push(from *wire.Conn, info pc.Info) {
+
+	s.mx.Lock()
+	conns := make([]*wire.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		if conn != from {
+			conns = append(conns, conn)
+		}
+	}
+	s.mx.Unlock()
+
+	s.log.Debug(fmt.Sprintf("[server.push()] info: %s, clients: %d;", info.ToString(), len(conns)))
+
+	for _, conn := range conns {
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_INFO, Info: info}); err != nil {
+			s.log.Debug(fmt.Sprintf("[server.push()] conn: %s closed, err: %v;", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// watchRevoke. Раз в revoke проверяет, действует ли токен устройства, и закрывает соединение отозванного устройства.
+// Клиент получает отказ REJECT_UNAUTHORIZED и больше не переподключается
+func (s *Server) watchRevoke(conn *wire.Conn, device devices.Device, done chan struct{}) {
+
+	tick := time.NewTicker(s.revoke)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			if s.devices.Active(device.ID) {
+				continue
+			}
+			s.log.Warn(fmt.Sprintf("[server.watchRevoke()] device: %s revoked, err: %v;", device.ToString(), s.reject(conn, wire.REJECT_UNAUTHORIZED, "revoked")))
+			conn.Close()
+			return
+		}
+	}
+}
+
+// handshake. Завершает TLS рукопожатие и возвращает отпечаток сертификата клиента ("" без TLS или без сертификата)
+func (s *Server) handshake(nc net.Conn) (string, error) {
+
+	tc, ok := nc.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return "", fmt.Errorf("[server.handshake()] (tc.HandshakeContext) client: %s, err: %w;", nc.RemoteAddr(), err)
+	}
+
+	peers := tc.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return "", nil
+	}
+
+	return certs.Fingerprint(peers[0]), nil
+}
+
+// hello. Первое сообщение клиента - Hello. Сервер проверяет токен устройства (и закрепленный за ним сертификат),
+// версию протокола и папку и выбирает общие алгоритмы. При отказе клиент получает TYPE_REJECT с кодом причины
+func (s *Server) hello(conn *wire.Conn, peer string) (*wire.Hello, devices.Device, *wire.Welcome, error) {
+
+	none := devices.Device{}
+
+	m, err := conn.Recv()
+	if err != nil {
+		return nil, none, nil, fmt.Errorf("[server.hello()] client: %s, err: %w;", conn.RemoteAddr(), err)
+	}
+
+	if m.Type != wire.TYPE_HELLO || m.Hello == nil || m.Hello.Device == "" {
+		return nil, none, nil, s.reject(conn, wire.REJECT_BAD_HELLO, "")
+	}
+	h := m.Hello
+
+	s.log.Debug(fmt.Sprintf("[server.hello()] client: %s, hello: %s;", conn.RemoteAddr(), h.ToString()))
+
+	device, err := s.devices.Check(h.Token)
+	// отозванный и неизвестный токены для клиента не различаются
+	if errors.Is(err, devices.ERROR__BAD_TOKEN__) || errors.Is(err, devices.ERROR__REVOKED__) {
+		s.log.Warn(err)
+		return nil, none, nil, s.reject(conn, wire.REJECT_UNAUTHORIZED, "")
+	}
+	// реестр не прочитался: соединение просто закрывается, и клиент переподключится позже
+	if err != nil {
+		return nil, none, nil, fmt.Errorf("[server.hello()] client: %s, err: %w;", conn.RemoteAddr(), err)
+	}
+
+	// украденный токен без сертификата устройства не поможет
+	if device.Cert != "" && device.Cert != peer {
+		s.log.Warn(fmt.Sprintf("[server.hello()] device: %s, cert: %q is not pinned;", device.ToString(), peer))
+		return nil, none, nil, s.reject(conn, wire.REJECT_UNAUTHORIZED, "")
+	}
+
+	// новый клиент работает со старым сервером по версии сервера, если он ее еще поддерживает (проверяет клиент)
+	protocol := h.Protocol
+	if protocol > wire.PROTOCOL {
+		protocol = wire.PROTOCOL
+	}
+	if protocol < wire.MIN_PROTOCOL {
+		return nil, none, nil, s.reject(conn, wire.REJECT_PROTOCOL, fmt.Sprintf(
+			"client: %d, server supports: %d..%d", h.Protocol, wire.MIN_PROTOCOL, wire.PROTOCOL,
+		))
+	}
+
+	if h.Root != s.root {
+		return nil, none, nil, s.reject(conn, wire.REJECT_ROOT, fmt.Sprintf("root: %s", h.Root))
+	}
+
+	hash, ok := wire.Choose(h.Hashes, s.hashes)
+	if !ok {
+		return nil, none, nil, s.reject(conn, wire.REJECT_CAPABILITY, fmt.Sprintf(
+			"hashes: %v, server supports: %v", h.Hashes, s.hashes,
+		))
+	}
+
+	// без сжатия умеют все
+	compression, ok := wire.Choose(h.Compressions, s.compress)
+	if !ok {
+		compression = wire.COMPRESSION_NONE
+	}
+
+	welcome := &wire.Welcome{Protocol: protocol, Hash: hash, Compression: compression}
+
+	// до Welcome: клиент, который получил Welcome, уже не пропустит ни одного изменения
+	s.join(conn)
+	if err := conn.Send(&wire.Message{Type: wire.TYPE_WELCOME, Welcome: welcome}); err != nil {
+		return nil, none, nil, fmt.Errorf("[server.hello()] (conn.Send) client: %s, err: %w;", conn.RemoteAddr(), err)
+	}
+
+	return h, device, welcome, nil
+}
+
+// reject. Отправляет клиенту отказ и возвращает ошибку для лога
+func (s *Server) reject(conn *wire.Conn, code byte, text string) error {
+
+	conn.Send(&wire.Message{Type: wire.TYPE_REJECT, Code: code, Text: text})
+
+	return fmt.Errorf("[server.reject()] client: %s, reason: %s, text: %s;", conn.RemoteAddr(), wire.Reason(code), text)
+}
+
+// chunk. Разбирает кусок файла и отдает его хранилищу. Смещение не нужно: место куска сервер знает по манифесту.
+// Если это последний недостающий кусок версии из uploads, версия рассылается остальным клиентам
+func (s *Server) chunk(frame []byte) error {
+
+	opt := options.Options{Opt: frame}
+	options.DecodeOptions(s.ctx, log.Default(), &opt)
+	if opt.Err != nil {
+		return fmt.Errorf("[server.chunk()] (options.DecodeOptions) err: %w;", opt.Err)
+	}
+
+	if err := s.storage.PutChunk(opt.FilePath, opt.Buffer); err != nil {
+		return err
+	}
+
+	path, err := pc.Normalize(opt.FilePath)
+	if err != nil {
+		return nil
+	}
+
+	s.mx.Lock()
+	_, ok := s.uploads[path]
+	s.mx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// хеш считается второй раз, но только пока версию ждут другие клиенты
+	hash := chunker.Hash(opt.Buffer)
+
+	s.mx.Lock()
+	u, ok := s.uploads[path]
+	if ok {
+		delete(u.need, hash)
+		if len(u.need) > 0 {
+			ok = false
+		} else {
+			delete(s.uploads, path)
+		}
+	}
+	s.mx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// пока шли куски, могла прийти следующая версия
+	if info, found := s.storage.Get(path); found && info.Hash == u.hash {
+		s.push(u.from, version(info))
+	}
+
+	return nil
+}
+
+// get. Отправляет клиенту запрошенные интервалы файла (TYPE_GET) кусками TYPE_CHUNK и в конце TYPE_SENT.
+// Клиент пишет куски по CurrentOffset, поэтому Index - только порядковый номер в ответе
+func (s *Server) get(conn *wire.Conn, m *wire.Message) {
+
+	s.log.Debug(fmt.Sprintf("[server.get()] path: %s, hash: %s, ranges: %d;", m.Info.Path, m.Info.Hash, len(m.Ranges)))
+
+	var index uint16
+	send := func(offset int64, data []byte) error {
+		opt := options.Options{FilePath: m.Info.Path, CurrentOffset: offset, Index: index, Buffer: data}
+		options.EncodeOptions(s.ctx, nil, &opt)
+		if opt.Err != nil {
+			return opt.Err
+		}
+		index++
+		return conn.Send(&wire.Message{Type: wire.TYPE_CHUNK, Info: pc.Info{Path: m.Info.Path}, Chunk: opt.Opt})
+	}
+
+	sent := &wire.Message{Type: wire.TYPE_SENT, Info: pc.Info{Path: m.Info.Path, Hash: m.Info.Hash}}
+	for _, r := range m.Ranges {
+		if err := s.storage.ReadRange(m.Info.Path, m.Info.Hash, r.Start, r.End, send); err != nil {
+			s.log.Warn(err)
+			sent.Text = err.Error()
+			break
+		}
+	}
+
+	if err := conn.Send(sent); err != nil {
+		s.log.Debug(fmt.Sprintf("[server.get()] conn: %s closed, err: %v;", conn.RemoteAddr(), err))
+	}
+}
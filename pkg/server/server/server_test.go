@@ -0,0 +1,603 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/internal/certs"
+	"github.com/preegnees/gobox/internal/options"
+	"github.com/preegnees/gobox/internal/wire"
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/server/devices"
+	"github.com/preegnees/gobox/pkg/server/storage"
+)
+
+const PATH = "TestStorage"
+
+// newServer. Запускает сервер и регистрирует в нем устройство, возвращает его токен
+func newServer(t *testing.T, ctx context.Context) (*Server, string) {
+
+	srv, _, token := newServerTLS(t, ctx, nil)
+
+	return srv, token
+}
+
+// newServerTLS. newServer с настройками TLS, возвращает и реестр устройств
+func newServerTLS(t *testing.T, ctx context.Context, conf *tls.Config) (*Server, *devices.Registry, string) {
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	st, err := storage.New(storage.ConfStorage{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	reg, err := devices.New(devices.ConfDevices{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	_, token, err := reg.Add("laptop")
+	if err != nil {
+		panic(err)
+	}
+
+	srv, err := New(ConfServer{
+		Ctx:         ctx,
+		Log:         logger,
+		Addr:        "127.0.0.1:0",
+		TLS:         conf,
+		Devices:     reg,
+		RevokeCheck: 50 * time.Millisecond,
+		Storage:     st,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	go srv.Serve()
+
+	return srv, reg, token
+}
+
+func dial(t *testing.T, srv *Server, token string) *wire.Conn {
+
+	return hello(t, srv, wire.Hello{
+		Device:       "device",
+		Protocol:     wire.PROTOCOL,
+		Token:        token,
+		Hashes:       []string{ut.HASH_SHA256},
+		Compressions: []string{wire.COMPRESSION_NONE},
+		Root:         ROOT,
+	})
+}
+
+func hello(t *testing.T, srv *Server, h wire.Hello) *wire.Conn {
+
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	conn := wire.NewConn(c)
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.Send(&wire.Message{Type: wire.TYPE_HELLO, Hello: &h}); err != nil {
+		panic(err)
+	}
+
+	return conn
+}
+
+func TestUnauthorized(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, token := newServer(t, ctx)
+
+	id, _, _ := strings.Cut(token, devices.SEPARATOR)
+
+	for _, bad := range []string{"", "wrong", id + devices.SEPARATOR + "wrong", "0000000000000000" + devices.SEPARATOR + "x"} {
+		conn := dial(t, srv, bad)
+
+		m, err := conn.Recv()
+		if err != nil {
+			panic(err)
+		}
+		if m.Type != wire.TYPE_REJECT || m.Code != wire.REJECT_UNAUTHORIZED {
+			t.Fatalf("token: %q, m: %s", bad, m.ToString())
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, token := newServer(t, ctx)
+
+	conn := dial(t, srv, token)
+	m, err := conn.Recv()
+	if err != nil {
+		panic(err)
+	}
+	if m.Type != wire.TYPE_WELCOME {
+		t.Fatalf("m: %s", m.ToString())
+	}
+
+	// отзыв через отдельный реестр, как это делает команда gobox-server device revoke
+	logger := logrus.New()
+	reg, err := devices.New(devices.ConfDevices{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	if _, err := reg.Revoke("laptop"); err != nil {
+		panic(err)
+	}
+
+	// открытое соединение закрывается, даже если клиент молчит
+	m, err = conn.Recv()
+	if err != nil {
+		panic(err)
+	}
+	if m.Type != wire.TYPE_REJECT || m.Code != wire.REJECT_UNAUTHORIZED {
+		t.Fatalf("m: %s", m.ToString())
+	}
+	if _, err := conn.Recv(); err == nil {
+		panic("conn of revoked device is open")
+	}
+
+	conn = dial(t, srv, token)
+	m, err = conn.Recv()
+	if err != nil {
+		panic(err)
+	}
+	if m.Type != wire.TYPE_REJECT || m.Code != wire.REJECT_UNAUTHORIZED {
+		t.Fatalf("m: %s", m.ToString())
+	}
+}
+
+func TestPinnedCert(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	ca := filepath.Join(PATH, "ca")
+	if err := certs.InitCA(ca, []string{"127.0.0.1"}); err != nil {
+		panic(err)
+	}
+	laptop, fp, err := certs.Issue(ca, "laptop", ca)
+	if err != nil {
+		panic(err)
+	}
+	phone, _, err := certs.Issue(ca, "phone", ca)
+	if err != nil {
+		panic(err)
+	}
+
+	conf, err := certs.ServerConfig(certs.ConfServerTLS{
+		Cert:     filepath.Join(ca, certs.SERVER_CERT),
+		Key:      filepath.Join(ca, certs.SERVER_KEY),
+		ClientCA: filepath.Join(ca, certs.CA_CERT),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	srv, reg, token := newServerTLS(t, ctx, conf)
+	if _, err := reg.Pin("laptop", fp); err != nil {
+		panic(err)
+	}
+
+	cases := []struct {
+		cert string
+		want byte
+	}{
+		{laptop, wire.TYPE_WELCOME},
+		// сертификат подписан тем же CA, но закреплен не за этим устройством
+		{phone, wire.TYPE_REJECT},
+	}
+
+	for _, c := range cases {
+		client, err := certs.ClientConfig(certs.ConfClientTLS{
+			CA:   filepath.Join(ca, certs.CA_CERT),
+			Cert: c.cert,
+			Key:  strings.TrimSuffix(c.cert, ".crt") + ".key",
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		nc, err := tls.Dial("tcp", srv.Addr().String(), client)
+		if err != nil {
+			panic(err)
+		}
+		conn := wire.NewConn(nc)
+		defer conn.Close()
+
+		h := wire.Hello{Device: "device", Protocol: wire.PROTOCOL, Token: token, Hashes: []string{ut.HASH_SHA256}, Root: ROOT}
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_HELLO, Hello: &h}); err != nil {
+			panic(err)
+		}
+
+		m, err := conn.Recv()
+		if err != nil {
+			panic(err)
+		}
+		if m.Type != c.want {
+			t.Fatalf("cert: %s, m: %s", c.cert, m.ToString())
+		}
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, token := newServer(t, ctx)
+
+	base := wire.Hello{
+		Device:       "device",
+		Protocol:     wire.PROTOCOL,
+		Token:        token,
+		Hashes:       []string{ut.HASH_SHA256},
+		Compressions: []string{wire.COMPRESSION_NONE},
+		Root:         ROOT,
+	}
+
+	cases := []struct {
+		name    string
+		change  func(h *wire.Hello)
+		code    byte
+		welcome wire.Welcome
+	}{
+		{"ok", func(h *wire.Hello) {}, 0, wire.Welcome{Protocol: wire.PROTOCOL, Hash: ut.HASH_SHA256, Compression: wire.COMPRESSION_NONE}},
+		{"newer client", func(h *wire.Hello) { h.Protocol = wire.PROTOCOL + 5 }, 0, wire.Welcome{Protocol: wire.PROTOCOL, Hash: ut.HASH_SHA256, Compression: wire.COMPRESSION_NONE}},
+		{"unknown compression", func(h *wire.Hello) { h.Compressions = []string{"lz4"} }, 0, wire.Welcome{Protocol: wire.PROTOCOL, Hash: ut.HASH_SHA256, Compression: wire.COMPRESSION_NONE}},
+		{"compression preference", func(h *wire.Hello) { h.Compressions = []string{"lz4", wire.COMPRESSION_GZIP} }, 0, wire.Welcome{Protocol: wire.PROTOCOL, Hash: ut.HASH_SHA256, Compression: wire.COMPRESSION_GZIP}},
+		{"hash preference", func(h *wire.Hello) { h.Hashes = []string{"md5", ut.HASH_SHA256} }, 0, wire.Welcome{Protocol: wire.PROTOCOL, Hash: ut.HASH_SHA256, Compression: wire.COMPRESSION_NONE}},
+		{"client preference", func(h *wire.Hello) { h.Hashes = []string{ut.HASH_BLAKE3, ut.HASH_SHA256} }, 0, wire.Welcome{Protocol: wire.PROTOCOL, Hash: ut.HASH_BLAKE3, Compression: wire.COMPRESSION_NONE}},
+		{"no device", func(h *wire.Hello) { h.Device = "" }, wire.REJECT_BAD_HELLO, wire.Welcome{}},
+		{"old protocol", func(h *wire.Hello) { h.Protocol = wire.MIN_PROTOCOL - 1 }, wire.REJECT_PROTOCOL, wire.Welcome{}},
+		{"unknown root", func(h *wire.Hello) { h.Root = "other" }, wire.REJECT_ROOT, wire.Welcome{}},
+		{"no common hash", func(h *wire.Hello) { h.Hashes = []string{"md5"} }, wire.REJECT_CAPABILITY, wire.Welcome{}},
+	}
+
+	for _, c := range cases {
+		h := base
+		c.change(&h)
+
+		conn := hello(t, srv, h)
+		m, err := conn.Recv()
+		if err != nil {
+			panic(err)
+		}
+
+		if c.code != 0 {
+			if m.Type != wire.TYPE_REJECT || m.Code != c.code {
+				t.Fatalf("case: %s, m: %s", c.name, m.ToString())
+			}
+			continue
+		}
+
+		if m.Type != wire.TYPE_WELCOME || m.Welcome == nil || *m.Welcome != c.welcome {
+			t.Fatalf("case: %s, m: %s", c.name, m.ToString())
+		}
+	}
+
+	// сервер только с sha256 принимает клиента, который предпочитает blake3, но знает и sha256
+	srv.hashes = []string{ut.HASH_SHA256}
+
+	h := base
+	h.Hashes = []string{ut.HASH_BLAKE3, ut.HASH_XXH3, ut.HASH_SHA256}
+	m, err := hello(t, srv, h).Recv()
+	if err != nil {
+		panic(err)
+	}
+	if m.Type != wire.TYPE_WELCOME || m.Welcome == nil || m.Welcome.Hash != ut.HASH_SHA256 {
+		t.Fatalf("sha256 only server, m: %s", m.ToString())
+	}
+}
+
+func TestInfoAndChunk(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, token := newServer(t, ctx)
+	conn := dial(t, srv, token)
+
+	m, err := conn.Recv()
+	if err != nil {
+		panic(err)
+	}
+	if m.Type != wire.TYPE_WELCOME {
+		panic("m.Type != wire.TYPE_WELCOME")
+	}
+
+	hello, world := []byte("hello "), []byte("world")
+	file := pc.Info{
+		Action: fsnotify.Create,
+		Path:   "folder/file.txt",
+		Hash:   chunker.Hash([]byte("hello world")),
+		Size:   11,
+		Chunks: []pc.Chunk{{Hash: chunker.Hash(hello), Size: 6}, {Hash: chunker.Hash(world), Size: 5}},
+	}
+
+	infos := []pc.Info{
+		{Action: pc.UPLOAD_CODE, Path: "folder", IsFolder: true},
+		file,
+		{Action: fsnotify.Create, Path: "removed.txt", Hash: "h2"},
+		{Action: fsnotify.Remove, Path: "removed.txt"},
+		// выход за корень хранилища отклоняется
+		{Action: fsnotify.Create, Path: "../escaped.txt", Hash: "h3"},
+		{Action: fsnotify.Create, Path: "/etc/escaped.txt", Hash: "h4"},
+	}
+	for _, info := range infos {
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_INFO, Info: info}); err != nil {
+			panic(err)
+		}
+	}
+
+	m, err = conn.Recv()
+	if err != nil {
+		panic(err)
+	}
+	if m.Type != wire.TYPE_NEED || m.Info.Path != file.Path || !reflect.DeepEqual(m.Hashes, []string{file.Chunks[0].Hash, file.Chunks[1].Hash}) {
+		t.Fatalf("m: %s", m.ToString())
+	}
+
+	for i, data := range [][]byte{world, hello} {
+		opt := options.Options{FilePath: file.Path, Index: uint16(i), Buffer: data}
+		options.EncodeOptions(ctx, log.Default(), &opt)
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_CHUNK, Chunk: opt.Opt}); err != nil {
+			panic(err)
+		}
+	}
+
+	waitFile(t, srv.storage, file.Path, "hello world")
+
+	if _, ok := srv.storage.Get("removed.txt"); ok {
+		panic("removed.txt still in index")
+	}
+	if srv.storage.Len() != 2 {
+		t.Fatalf("len: %d", srv.storage.Len())
+	}
+
+	// все куски уже есть на сервере: файл собирается без запроса к клиенту
+	copied := pc.Info{
+		Action: fsnotify.Create,
+		Path:   "copy.txt",
+		Hash:   chunker.Hash([]byte("worldhello world")),
+		Size:   16,
+		Chunks: []pc.Chunk{file.Chunks[1], file.Chunks[0], file.Chunks[1]},
+	}
+	if err := conn.Send(&wire.Message{Type: wire.TYPE_INFO, Info: copied}); err != nil {
+		panic(err)
+	}
+
+	waitFile(t, srv.storage, copied.Path, "worldhello world")
+	if need := srv.storage.Need(copied.Path); need != nil {
+		t.Fatalf("need: %v", need)
+	}
+}
+
+func TestGet(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, token := newServer(t, ctx)
+	conn := dial(t, srv, token)
+
+	if m, err := conn.Recv(); err != nil || m.Type != wire.TYPE_WELCOME {
+		t.Fatalf("m: %v, err: %v", m, err)
+	}
+
+	hello, world := []byte("hello "), []byte("world")
+	file := pc.Info{
+		Action: fsnotify.Create,
+		Path:   "file.txt",
+		Hash:   chunker.Hash([]byte("hello world")),
+		Size:   11,
+		Chunks: []pc.Chunk{{Hash: chunker.Hash(hello), Size: 6}, {Hash: chunker.Hash(world), Size: 5}},
+	}
+	if err := conn.Send(&wire.Message{Type: wire.TYPE_INFO, Info: file}); err != nil {
+		panic(err)
+	}
+	for i, data := range [][]byte{hello, world} {
+		opt := options.Options{FilePath: file.Path, Index: uint16(i), Buffer: data}
+		options.EncodeOptions(ctx, log.Default(), &opt)
+		if err := conn.Send(&wire.Message{Type: wire.TYPE_CHUNK, Chunk: opt.Opt}); err != nil {
+			panic(err)
+		}
+	}
+	waitFile(t, srv.storage, file.Path, "hello world")
+
+	// get. Запрашивает интервалы и собирает ответ сервера по смещениям
+	get := func(hash string, ranges []wire.Range) (map[int64]string, string) {
+		m := &wire.Message{Type: wire.TYPE_GET, Info: pc.Info{Path: file.Path, Hash: hash}, Ranges: ranges}
+		if err := conn.Send(m); err != nil {
+			panic(err)
+		}
+		got := map[int64]string{}
+		for {
+			m, err := conn.Recv()
+			if err != nil {
+				panic(err)
+			}
+			switch m.Type {
+			case wire.TYPE_CHUNK:
+				opt := options.Options{Opt: m.Chunk}
+				options.DecodeOptions(ctx, log.Default(), &opt)
+				if opt.Err != nil || opt.FilePath != file.Path {
+					t.Fatalf("opt: %v, path: %s", opt.Err, opt.FilePath)
+				}
+				got[opt.CurrentOffset] = string(opt.Buffer)
+			case wire.TYPE_SENT:
+				return got, m.Text
+			}
+		}
+	}
+
+	// интервал на стыке двух кусков приходит двумя частями
+	got, text := get(file.Hash, []wire.Range{{Start: 3, End: 8}, {Start: 10, End: 11}})
+	if text != "" || !reflect.DeepEqual(got, map[int64]string{3: "lo ", 6: "wo", 10: "d"}) {
+		t.Fatalf("got: %v, text: %s", got, text)
+	}
+
+	// версия, которой на сервере уже нет, не отдается
+	got, text = get("old", []wire.Range{{Start: 0, End: 11}})
+	if text == "" || len(got) != 0 {
+		t.Fatalf("got: %v, text: %s", got, text)
+	}
+}
+
+// waitFile. Ждет, пока в хранилище соберется файл с содержимым want
+func waitFile(t *testing.T, st *storage.Storage, path string, want string) {
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var buf bytes.Buffer
+		err := st.Read(path, &buf)
+		if err == nil && buf.String() == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("path: %s, data: %q, err: %v", path, buf.String(), err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMove(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, _ := newServer(t, ctx)
+
+	infos := []pc.Info{
+		{Action: pc.UPLOAD_CODE, Path: "box/project", IsFolder: true},
+		{Action: pc.UPLOAD_CODE, Path: "box/project/main.go", Hash: "h1"},
+		{Action: fsnotify.Rename, OldPath: "box/project", Path: "box/archive/project", IsFolder: true},
+	}
+	for _, info := range infos {
+		if err := srv.storage.Apply(info); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, ok := srv.storage.Get("box/project/main.go"); ok {
+		panic("old path is still in index")
+	}
+	info, ok := srv.storage.Get("box/archive/project/main.go")
+	if !ok || info.Hash != "h1" {
+		panic("moved file is not in index")
+	}
+	if _, ok := srv.storage.Get("box/archive/project"); !ok {
+		panic("folder is not moved")
+	}
+	if _, ok := srv.storage.Get("box/project"); ok {
+		panic("old folder is still in index")
+	}
+}
+
+// EMPTY. sha256 пустого содержимого
+const EMPTY = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestPush(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	srv, token := newServer(t, ctx)
+
+	from, to := dial(t, srv, token), dial(t, srv, token)
+	for _, conn := range []*wire.Conn{from, to} {
+		if m, err := conn.Recv(); err != nil || m.Type != wire.TYPE_WELCOME {
+			t.Fatalf("m: %v, err: %v", m, err)
+		}
+	}
+
+	infos := []pc.Info{
+		{Action: pc.UPLOAD_CODE, Path: "docs", IsFolder: true},
+		{Action: pc.UPLOAD_CODE, Path: "docs/a.txt", Hash: "h1"},
+		// папка уже есть, рассылать нечего
+		{Action: fsnotify.Create, Path: "docs", IsFolder: true},
+		{Action: fsnotify.Create, Path: "archive", IsFolder: true},
+		{Action: fsnotify.Rename, OldPath: "docs/a.txt", Path: "archive/a.txt"},
+		{Action: fsnotify.Remove, Path: "docs"},
+		// такого пути на сервере нет
+		{Action: fsnotify.Remove, Path: "unknown.txt"},
+		// пустой файл рассылается без манифеста, а смена прав - нет
+		{Action: fsnotify.Create, Path: "empty.txt", Hash: EMPTY},
+		{Action: fsnotify.Chmod, Path: "empty.txt", Hash: EMPTY},
+		{Action: fsnotify.Create, Path: "last", IsFolder: true},
+	}
+	for _, info := range infos {
+		if err := from.Send(&wire.Message{Type: wire.TYPE_INFO, Info: info}); err != nil {
+			panic(err)
+		}
+	}
+
+	want := []pc.Info{
+		{Action: fsnotify.Create, Path: "docs", IsFolder: true},
+		{Action: fsnotify.Create, Path: "archive", IsFolder: true},
+		{Action: fsnotify.Rename, OldPath: "docs/a.txt", Path: "archive/a.txt"},
+		{Action: fsnotify.Remove, Path: "docs", IsFolder: true},
+		{Action: fsnotify.Write, Path: "empty.txt", Hash: EMPTY},
+		{Action: fsnotify.Create, Path: "last", IsFolder: true},
+	}
+	for _, info := range want {
+		m, err := to.Recv()
+		if err != nil {
+			panic(err)
+		}
+		if m.Type != wire.TYPE_INFO || !reflect.DeepEqual(m.Info, info) {
+			t.Fatalf("want: %s, m: %s", info.ToString(), m.ToString())
+		}
+	}
+
+	// отправитель свои изменения назад не получает: следующее сообщение для него - ответ на TYPE_GET
+	if err := from.Send(&wire.Message{Type: wire.TYPE_GET, Info: pc.Info{Path: "archive/a.txt", Hash: "h1"}}); err != nil {
+		panic(err)
+	}
+	if m, err := from.Recv(); err != nil || m.Type != wire.TYPE_SENT {
+		t.Fatalf("m: %v, err: %v", m, err)
+	}
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	"github.com/preegnees/gobox/pkg/server/blobs"
+)
+
+var (
+	ERROR__UNKNOWN_FILE__     = errors.New("err file is not in index")
+	ERROR__UNEXPECTED_CHUNK__ = errors.New("err chunk is not in file manifest")
+	ERROR__BROKEN_MANIFEST__  = errors.New("err broken manifest")
+	ERROR__INCOMPLETE__       = errors.New("err file chunks are not uploaded yet")
+	ERROR__CHANGED__          = errors.New("err file version changed")
+)
+
+// Need. Куски файла, которых нет в хранилище, в порядке манифеста и без повторов.
+// Куски, которые уже есть, отмечаются как использованные, чтобы gc их не удалил (см. blobs.Store.Touch).
+// nil - файл целиком в хранилище или его нет в индексе
+func (s *Storage) Need(path string) []string {
+
+	s.mx.Lock()
+	info, ok := s.index[s.key(path)]
+	s.mx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var need []string
+	seen := make(map[string]struct{}, len(info.Chunks))
+	for _, c := range info.Chunks {
+		if _, ok := seen[c.Hash]; ok {
+			continue
+		}
+		seen[c.Hash] = struct{}{}
+		if !s.blobs.Touch(c.Hash) {
+			need = append(need, c.Hash)
+		}
+	}
+
+	return need
+}
+
+// PutChunk. Принимает кусок файла path. Кусок узнается по хешу, поэтому одинаковые куски приходят один раз
+func (s *Storage) PutChunk(path string, data []byte) error {
+
+	hash := chunker.Hash(data)
+
+	s.log.Debug(fmt.Sprintf("[storage.PutChunk()] path: %s, hash: %s, len: %d;", path, hash, len(data)))
+
+	if _, err := pc.Normalize(path); err != nil {
+		return fmt.Errorf("[storage.PutChunk()] (pc.Normalize) err: %w;", err)
+	}
+
+	s.mx.Lock()
+	info, ok := s.index[s.key(path)]
+	s.mx.Unlock()
+	if !ok {
+		return fmt.Errorf("[storage.PutChunk()] path: %s, werr: %w;", path, ERROR__UNKNOWN_FILE__)
+	}
+
+	if !contains(info, hash) {
+		return fmt.Errorf("[storage.PutChunk()] path: %s, hash: %s, werr: %w;", path, hash, ERROR__UNEXPECTED_CHUNK__)
+	}
+
+	// запись куска не держит мьютекс индекса: кусок не зависит от пути
+	if err := s.blobs.Put(hash, data); err != nil {
+		return fmt.Errorf("[storage.PutChunk()] (blobs.Put) path: %s, err: %w;", path, err)
+	}
+
+	return nil
+}
+
+// Read. Пишет в w содержимое файла path, собранное из кусков
+func (s *Storage) Read(path string, w io.Writer) error {
+
+	s.mx.Lock()
+	info, ok := s.index[s.key(path)]
+	s.mx.Unlock()
+	if !ok || info.IsFolder {
+		return fmt.Errorf("[storage.Read()] path: %s, werr: %w;", path, ERROR__UNKNOWN_FILE__)
+	}
+
+	for _, c := range info.Chunks {
+		data, err := s.blobs.Get(c.Hash)
+		if errors.Is(err, blobs.ERROR__NOT_FOUND__) {
+			return fmt.Errorf("[storage.Read()] path: %s, hash: %s, werr: %w;", path, c.Hash, ERROR__INCOMPLETE__)
+		}
+		if err != nil {
+			return fmt.Errorf("[storage.Read()] (blobs.Get) path: %s, err: %w;", path, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("[storage.Read()] (w.Write) path: %s, err: %w;", path, err)
+		}
+	}
+
+	return nil
+}
+
+// ReadRange. Отдает fn части содержимого файла path версии hash, которые попадают в [start, end), по одной на кусок.
+// offset - смещение data в файле. Если в индексе уже другая версия файла, возвращается ERROR__CHANGED__
+func (s *Storage) ReadRange(path string, hash string, start int64, end int64, fn func(offset int64, data []byte) error) error {
+
+	s.mx.Lock()
+	info, ok := s.index[s.key(path)]
+	s.mx.Unlock()
+	if !ok || info.IsFolder {
+		return fmt.Errorf("[storage.ReadRange()] path: %s, werr: %w;", path, ERROR__UNKNOWN_FILE__)
+	}
+	if info.Hash != hash {
+		return fmt.Errorf("[storage.ReadRange()] path: %s, hash: %s, now: %s, werr: %w;", path, hash, info.Hash, ERROR__CHANGED__)
+	}
+
+	var offset int64
+	for _, c := range info.Chunks {
+		from, to := offset, offset+c.Size
+		offset = to
+		if to <= start || from >= end {
+			continue
+		}
+
+		data, err := s.blobs.Get(c.Hash)
+		if errors.Is(err, blobs.ERROR__NOT_FOUND__) {
+			return fmt.Errorf("[storage.ReadRange()] path: %s, hash: %s, werr: %w;", path, c.Hash, ERROR__INCOMPLETE__)
+		}
+		if err != nil {
+			return fmt.Errorf("[storage.ReadRange()] (blobs.Get) path: %s, err: %w;", path, err)
+		}
+
+		lo, hi := int64(0), c.Size
+		if start > from {
+			lo = start - from
+		}
+		if end < to {
+			hi = end - from
+		}
+		if hi > int64(len(data)) {
+			return fmt.Errorf("[storage.ReadRange()] path: %s, hash: %s, werr: %w;", path, c.Hash, ERROR__BROKEN_MANIFEST__)
+		}
+
+		if err := fn(from+lo, data[lo:hi]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// contains. Есть ли кусок в манифесте файла
+func contains(info pc.Info, hash string) bool {
+
+	for _, c := range info.Chunks {
+		if c.Hash == hash {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	"github.com/preegnees/gobox/pkg/server/blobs"
+)
+
+// GRACE. Сколько gc не трогает недавно использованный кусок. Время должно быть больше,
+// чем длится сам gc: кусок, на который сервер сослался после чтения журнала, свежий и остается
+const GRACE = time.Hour
+
+// ConfGC. Конфигурация сборки мусора. Dir - корень хранилища сервера, DryRun - только посчитать
+type ConfGC struct {
+	Log    *logrus.Logger
+	Dir    string
+	Grace  time.Duration
+	DryRun bool
+}
+
+func (c *ConfGC) ToString() string {
+
+	return fmt.Sprintf("levelLog: %s, dir: %s, grace: %v, dryRun: %v", c.Log.Level, c.Dir, c.Grace, c.DryRun)
+}
+
+// Report. Итог сборки мусора
+type Report struct {
+	Chunks     int
+	Referenced int
+	Removed    int
+	Freed      int64
+}
+
+// ToString. Report struct в строку
+func (r *Report) ToString() string {
+	return fmt.Sprintf("Chunks: %d; Referenced: %d; Removed: %d; Freed: %d;", r.Chunks, r.Referenced, r.Removed, r.Freed)
+}
+
+// GC. Удаляет куски, на которые не ссылается ни один манифест индекса.
+// Работает отдельно от сервера, по журналу, и не мешает подключенным клиентам:
+// кусок, который сервер использовал в последние Grace, остается (см. blobs.Store.Remove)
+func GC(cnf ConfGC) (Report, error) {
+
+	if cnf.Log == nil {
+		return Report{}, fmt.Errorf("[storage.GC()] log is nil;")
+	}
+
+	if cnf.Grace <= 0 {
+		cnf.Grace = GRACE
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[storage.GC()] struct cnf: %v;", cnf.ToString()))
+
+	store, err := blobs.New(blobs.ConfStore{Log: cnf.Log, Dir: cnf.Dir})
+	if err != nil {
+		return Report{}, fmt.Errorf("[storage.GC()] (blobs.New) err: %w;", err)
+	}
+
+	if !cnf.DryRun {
+		if err := store.Recover(cnf.Grace); err != nil {
+			return Report{}, err
+		}
+	}
+
+	// индекс только для чтения: журнал остается у сервера
+	s := &Storage{
+		log:   cnf.Log,
+		dir:   cnf.Dir,
+		index: make(map[string]pc.Info),
+		refs:  make(map[string]int),
+	}
+	if err := s.load(); err != nil {
+		return Report{}, err
+	}
+
+	var report Report
+	var garbage []string
+	err = store.Walk(func(hash string, size int64, modTime time.Time) error {
+		report.Chunks++
+		if s.refs[hash] > 0 {
+			report.Referenced++
+			return nil
+		}
+		if cnf.DryRun {
+			if time.Since(modTime) >= cnf.Grace {
+				report.Removed++
+				report.Freed += size
+			}
+			return nil
+		}
+		garbage = append(garbage, hash)
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	for _, hash := range garbage {
+		freed, err := store.Remove(hash, cnf.Grace)
+		if err != nil {
+			return report, err
+		}
+		if freed > 0 {
+			report.Removed++
+			report.Freed += freed
+		}
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[storage.GC()] report: %s;", report.ToString()))
+
+	return report, nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+const PATH = "TestDir"
+
+// manifest. Info файла из кусков parts
+func manifest(path string, parts ...string) pc.Info {
+
+	info := pc.Info{Action: fsnotify.Create, Path: path}
+	var all []byte
+	for _, p := range parts {
+		info.Chunks = append(info.Chunks, pc.Chunk{Hash: chunker.Hash([]byte(p)), Size: int64(len(p))})
+		all = append(all, p...)
+	}
+	info.Hash, info.Size = chunker.Hash(all), int64(len(all))
+
+	return info
+}
+
+// upload. Применяет Info и загружает куски, которых не хватает
+func upload(s *Storage, info pc.Info, parts ...string) {
+
+	if err := s.Apply(info); err != nil {
+		panic(err)
+	}
+	need := map[string]struct{}{}
+	for _, h := range s.Need(info.Path) {
+		need[h] = struct{}{}
+	}
+	for _, p := range parts {
+		if _, ok := need[chunker.Hash([]byte(p))]; ok {
+			if err := s.PutChunk(info.Path, []byte(p)); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+func TestDedupAndGC(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	logger := logrus.New()
+
+	s, err := New(ConfStorage{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	upload(s, manifest("a.txt", "one", "two"), "one", "two")
+	// общий кусок хранится один раз
+	b := manifest("b.txt", "two", "three")
+	if need := s.Need(b.Path); need != nil {
+		t.Fatalf("need: %v", need)
+	}
+	if err := s.Apply(b); err != nil {
+		panic(err)
+	}
+	if need := s.Need(b.Path); len(need) != 1 || need[0] != chunker.Hash([]byte("three")) {
+		t.Fatalf("need: %v", need)
+	}
+	if err := s.PutChunk(b.Path, []byte("one")); err == nil {
+		panic("chunk outside of manifest is accepted")
+	}
+	if err := s.PutChunk(b.Path, []byte("three")); err != nil {
+		panic(err)
+	}
+	if s.refs[chunker.Hash([]byte("two"))] != 2 {
+		t.Fatalf("refs: %v", s.refs)
+	}
+
+	// новая версия a.txt и удаление b.txt оставляют без ссылок "one" и "three"
+	upload(s, manifest("a.txt", "two", "four"), "two", "four")
+	if err := s.Apply(pc.Info{Action: fsnotify.Rename, OldPath: "a.txt", Path: "c.txt", Hash: manifest("", "two", "four").Hash}); err != nil {
+		panic(err)
+	}
+	if err := s.Apply(pc.Info{Action: fsnotify.Remove, Path: "b.txt"}); err != nil {
+		panic(err)
+	}
+
+	// смена прав с клиента на другом алгоритме хеша содержимое не теряет
+	if err := s.Apply(pc.Info{Action: fsnotify.Chmod, Path: "c.txt", Hash: "d447b1ea40e6988b", HashAlgo: "xxh3"}); err != nil {
+		panic(err)
+	}
+	if info := s.index[s.key("c.txt")]; info.HashAlgo != "" || info.Hash != manifest("", "two", "four").Hash {
+		t.Fatalf("info: %s", info.ToString())
+	}
+
+	var buf bytes.Buffer
+	if err := s.Read("c.txt", &buf); err != nil || buf.String() != "twofour" {
+		t.Fatalf("data: %q, err: %v", buf.String(), err)
+	}
+
+	// gc работает рядом с открытым хранилищем, недавние куски не трогает
+	report, err := GC(ConfGC{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	if report.Chunks != 4 || report.Referenced != 2 || report.Removed != 0 {
+		t.Fatalf("report: %s", report.ToString())
+	}
+
+	report, err = GC(ConfGC{Log: logger, Dir: PATH, Grace: time.Nanosecond, DryRun: true})
+	if err != nil || report.Removed != 2 {
+		t.Fatalf("report: %s, err: %v", report.ToString(), err)
+	}
+	if !s.blobs.Touch(chunker.Hash([]byte("one"))) {
+		panic("dry run removed chunk")
+	}
+
+	time.Sleep(time.Millisecond)
+	report, err = GC(ConfGC{Log: logger, Dir: PATH, Grace: time.Nanosecond})
+	if err != nil || report.Removed != 2 || report.Freed != int64(len("one")+len("three")) {
+		t.Fatalf("report: %s, err: %v", report.ToString(), err)
+	}
+
+	buf.Reset()
+	if err := s.Read("c.txt", &buf); err != nil || buf.String() != "twofour" {
+		t.Fatalf("data: %q, err: %v", buf.String(), err)
+	}
+
+	// после перезапуска ссылки восстанавливаются из журнала
+	s.Close()
+	s, err = New(ConfStorage{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	if len(s.refs) != 2 || s.Need("c.txt") != nil {
+		t.Fatalf("refs: %v", s.refs)
+	}
+}
@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+	ut "github.com/preegnees/gobox/pkg/client/file/utils"
+	"github.com/preegnees/gobox/pkg/server/blobs"
+)
+
+const (
+	// JOURNAL. Журнал принятых метаданных, по нему восстанавливается индекс после перезапуска
+	JOURNAL = "journal.log"
+)
+
+// ConfStorage. Конфигурация хранилища
+type ConfStorage struct {
+	Log *logrus.Logger
+	Dir string
+}
+
+func (c *ConfStorage) ToString() string {
+
+	return fmt.Sprintf("levelLog: %s, dir: %s", c.Log.Level, c.Dir)
+}
+
+// Storage. Хранилище сервера: индекс метаданных с манифестами файлов + куски (blobs.Store).
+// refs - сколько раз кусок встречается в манифестах индекса, кусок без ссылок удаляет gc
+type Storage struct {
+	log     *logrus.Logger
+	dir     string
+	mx      sync.Mutex
+	index   map[string]pc.Info
+	refs    map[string]int
+	blobs   *blobs.Store
+	journal *os.File
+}
+
+// New. Создает хранилище и восстанавливает индекс из журнала
+func New(cnf ConfStorage) (*Storage, error) {
+
+	if cnf.Log == nil {
+		return nil, fmt.Errorf("[storage.New()] log is nil;")
+	}
+
+	cnf.Log.Debug(fmt.Sprintf("[storage.New()] struct cnf: %v;", cnf.ToString()))
+
+	if cnf.Dir == "" {
+		return nil, fmt.Errorf("[storage.New()] dir is empty;")
+	}
+
+	if err := os.MkdirAll(cnf.Dir, 0777); err != nil {
+		return nil, fmt.Errorf("[storage.New()] (os.MkdirAll) dir: %s, err: %w;", cnf.Dir, err)
+	}
+
+	store, err := blobs.New(blobs.ConfStore{Log: cnf.Log, Dir: cnf.Dir})
+	if err != nil {
+		return nil, fmt.Errorf("[storage.New()] (blobs.New) err: %w;", err)
+	}
+
+	s := &Storage{
+		log:   cnf.Log,
+		dir:   cnf.Dir,
+		index: make(map[string]pc.Info),
+		refs:  make(map[string]int),
+		blobs: store,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(filepath.Join(cnf.Dir, JOURNAL), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("[storage.New()] (os.OpenFile) journal, err: %w;", err)
+	}
+	s.journal = journal
+
+	cnf.Log.Debug(fmt.Sprintf("[storage.New()] loaded %d entries, %d chunks;", len(s.index), len(s.refs)))
+
+	return s, nil
+}
+
+// Close. Закрывает журнал
+func (s *Storage) Close() error {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.journal.Close()
+}
+
+// Apply. Применяет метаданные, пришедшие от клиента (снимок UPLOAD_CODE или событие fsnotify)
+func (s *Storage) Apply(info pc.Info) error {
+
+	s.log.Debug(fmt.Sprintf("[storage.Apply()] info: %s;", info.ToString()))
+
+	info, err := validate(info)
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.apply(info)
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("[storage.Apply()] (json.Marshal) path: %s, err: %w;", info.Path, err)
+	}
+
+	if _, err := s.journal.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("[storage.Apply()] (journal.Write) path: %s, err: %w;", info.Path, err)
+	}
+
+	return nil
+}
+
+// Get. Возвращает последние известные метаданные по пути
+func (s *Storage) Get(path string) (pc.Info, bool) {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	info, ok := s.index[s.key(path)]
+	return info, ok
+}
+
+// Len. Количество записей в индексе
+func (s *Storage) Len() int {
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return len(s.index)
+}
+
+// apply. Применяет метаданные к индексу, вызывается под мьютексом. Содержимое файлов
+// хранится только в кусках, поэтому apply не трогает диск и им же проигрывается журнал
+func (s *Storage) apply(info pc.Info) {
+
+	key := s.key(info.Path)
+	if key == "" {
+		return
+	}
+	info.Path = key
+
+	// UPLOAD_CODE = 100 содержит бит fsnotify.Remove, поэтому его нужно проверять первым
+	if info.Action != pc.UPLOAD_CODE && info.Action.Has(fsnotify.Remove) {
+		s.drop(key)
+		return
+	}
+
+	if info.Action == fsnotify.Rename && info.OldPath != "" {
+		s.move(s.key(info.OldPath), key)
+	}
+
+	// событие без манифеста (перемещение, смена прав) содержимое не меняет.
+	// Хеш другого алгоритма (клиенты во время перехода на другой алгоритм) не сравнить, остается прежний
+	if prev, ok := s.index[key]; ok && !info.IsFolder && info.Chunks == nil {
+		switch {
+		case algo(prev) != algo(info):
+			info.Hash, info.HashAlgo, info.Size, info.Chunks = prev.Hash, prev.HashAlgo, prev.Size, prev.Chunks
+		case prev.Hash == info.Hash:
+			info.Size, info.Chunks = prev.Size, prev.Chunks
+		}
+	}
+
+	s.set(key, info)
+}
+
+// algo. Алгоритм хеша Info, пустой (записи старых версий) - это sha256
+func algo(info pc.Info) string {
+
+	if info.HashAlgo == "" {
+		return ut.HASH_SHA256
+	}
+
+	return info.HashAlgo
+}
+
+// load. Восстанавливает индекс из журнала
+func (s *Storage) load() error {
+
+	f, err := os.Open(filepath.Join(s.dir, JOURNAL))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[storage.load()] (os.Open) journal, err: %w;", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// недописанная строка остается после аварийной остановки, ее пропускаем
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("[storage.load()] (r.ReadBytes) err: %w;", err)
+		}
+
+		var info pc.Info
+		if err := json.Unmarshal(line, &info); err != nil {
+			s.log.Warn(fmt.Sprintf("[storage.load()] skip broken record, err: %v;", err))
+			continue
+		}
+
+		s.apply(info)
+	}
+}
+
+// set. Записывает в индекс метаданные key и пересчитывает ссылки на куски
+func (s *Storage) set(key string, info pc.Info) {
+
+	if prev, ok := s.index[key]; ok {
+		s.unref(prev)
+	}
+	s.index[key] = info
+	for _, c := range info.Chunks {
+		s.refs[c.Hash]++
+	}
+}
+
+// unref. Убирает ссылки манифеста на куски
+func (s *Storage) unref(info pc.Info) {
+
+	for _, c := range info.Chunks {
+		if s.refs[c.Hash]--; s.refs[c.Hash] <= 0 {
+			delete(s.refs, c.Hash)
+		}
+	}
+}
+
+// drop. Убирает из индекса путь и всех его потомков
+func (s *Storage) drop(key string) {
+
+	for k := range s.index {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			s.unref(s.index[k])
+			delete(s.index, k)
+		}
+	}
+}
+
+// move. Переносит в индексе путь и всех его потомков на новое место. Манифесты перенесенных записей не меняются,
+// а то, что было на новом месте, перемещение заменяет, поэтому оно убирается вместе со своими ссылками
+func (s *Storage) move(oldKey string, newKey string) {
+
+	if oldKey == newKey {
+		return
+	}
+
+	moved := make(map[string]pc.Info)
+	for k, info := range s.index {
+		if k != oldKey && !strings.HasPrefix(k, oldKey+"/") {
+			continue
+		}
+		delete(s.index, k)
+		info.Path = newKey + strings.TrimPrefix(k, oldKey)
+		moved[info.Path] = info
+	}
+
+	if len(moved) == 0 {
+		return
+	}
+
+	s.drop(newKey)
+	for k, info := range moved {
+		s.index[k] = info
+	}
+}
+
+// validate. Пути от клиента должны быть относительными и не выходить за корень (см. pc.Normalize).
+// Возвращает Info с нормализованными путями: в индекс и журнал попадают только они
+func validate(info pc.Info) (pc.Info, error) {
+
+	path, err := pc.Normalize(info.Path)
+	if err != nil {
+		return info, fmt.Errorf("[storage.validate()] (pc.Normalize) err: %w;", err)
+	}
+	info.Path = path
+
+	if info.OldPath != "" {
+		old, err := pc.Normalize(info.OldPath)
+		if err != nil {
+			return info, fmt.Errorf("[storage.validate()] (pc.Normalize) old path, err: %w;", err)
+		}
+		info.OldPath = old
+	}
+
+	// манифест должен сходиться с размером, а хеши кусков становятся именами файлов
+	var size int64
+	for _, c := range info.Chunks {
+		if !blobs.Valid(c.Hash) || c.Size <= 0 {
+			return info, fmt.Errorf("[storage.validate()] path: %s, hash: %q, size: %d, werr: %w;", info.Path, c.Hash, c.Size, ERROR__BROKEN_MANIFEST__)
+		}
+		size += c.Size
+	}
+	if info.Chunks != nil && size != info.Size {
+		return info, fmt.Errorf(
+			"[storage.validate()] path: %s, size: %d, chunks: %d, werr: %w;",
+			info.Path, info.Size, size, ERROR__BROKEN_MANIFEST__,
+		)
+	}
+
+	return info, nil
+}
+
+// key. Ключ индекса - нормализованный путь (pc.Normalize), поэтому NFD и NFC имена одного файла совпадают.
+// Путь, который Normalize не принимает, в индекс не попадает (validate), для него ключ пустой
+func (s *Storage) key(path string) string {
+
+	clean, err := pc.Normalize(path)
+	if err != nil {
+		return ""
+	}
+
+	return clean
+}
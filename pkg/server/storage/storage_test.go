@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/preegnees/gobox/pkg/client/file/chunker"
+	pc "github.com/preegnees/gobox/pkg/client/file/protocol"
+)
+
+func TestNormalizedKey(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	s, err := New(ConfStorage{Log: logrus.New(), Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+
+	// macOS присылает имена в NFD, Linux - обычно в NFC
+	nfd, nfc := "docs/./cafe\u0301.txt", "docs/caf\u00e9.txt"
+	upload(s, manifest(nfd, "one"), "one")
+
+	info, ok := s.Get(nfc)
+	if !ok || info.Path != nfc {
+		t.Fatalf("info: %s, ok: %v", info.ToString(), ok)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Read(nfc, &buf); err != nil || buf.String() != "one" {
+		t.Fatalf("data: %q, err: %v", buf.String(), err)
+	}
+
+	if err := s.Apply(pc.Info{Action: fsnotify.Rename, OldPath: nfc, Path: "docs/moved.txt"}); err != nil {
+		panic(err)
+	}
+	s.Close()
+
+	// журнал хранит нормализованные пути и проигрывается в тот же индекс
+	s, err = New(ConfStorage{Log: logrus.New(), Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	if _, ok := s.Get("docs/moved.txt/"); !ok || s.Len() != 1 {
+		t.Fatalf("moved file is not in index, len: %d", s.Len())
+	}
+}
+
+func TestRenameOverExisting(t *testing.T) {
+
+	defer os.RemoveAll(PATH)
+
+	logger := logrus.New()
+
+	s, err := New(ConfStorage{Log: logger, Dir: PATH})
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	upload(s, manifest("a.txt", "one", "two"), "one", "two")
+	upload(s, manifest("b.txt", "two", "three"), "two", "three")
+
+	// перемещение заменяет b.txt, его куски больше никому не нужны
+	if err := s.Apply(pc.Info{Action: fsnotify.Rename, OldPath: "a.txt", Path: "b.txt", Hash: manifest("", "one", "two").Hash}); err != nil {
+		panic(err)
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("len: %d", s.Len())
+	}
+	if s.refs[chunker.Hash([]byte("two"))] != 1 || len(s.refs) != 2 {
+		t.Fatalf("refs: %v", s.refs)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Read("b.txt", &buf); err != nil || buf.String() != "onetwo" {
+		t.Fatalf("data: %q, err: %v", buf.String(), err)
+	}
+
+	time.Sleep(time.Millisecond)
+	report, err := GC(ConfGC{Log: logger, Dir: PATH, Grace: time.Nanosecond})
+	if err != nil || report.Removed != 1 || report.Freed != int64(len("three")) {
+		t.Fatalf("report: %s, err: %v", report.ToString(), err)
+	}
+}